@@ -1,48 +1,43 @@
 package main
 
 import (
-	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/pem"
-	"errors"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
-)
 
-func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	block, _ := pem.Decode(b)
-	if block == nil {
-		return nil, errors.New("invalid PEM")
-	}
-	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
-		return k, nil
-	}
-	keyAny, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
-	}
-	k, ok := keyAny.(*rsa.PrivateKey)
-	if !ok {
-		return nil, errors.New("PEM is not RSA private key")
-	}
-	return k, nil
-}
+	"secure_packager/pkg/envelope"
+)
 
 func main() {
-	privPath := flag.String("priv", "", "Vendor RSA private key (PEM)")
+	privPath := flag.String("priv", "", "Vendor RSA private key (PEM), optionally encrypted")
+	keyPassEnv := flag.String("key-passphrase-env", "", "Name of an environment variable holding the passphrase of an encrypted -priv key; otherwise it is prompted for")
+	keyPassFD := flag.Int("key-passphrase-fd", -1, "Read the passphrase of an encrypted -priv key from this file descriptor")
 	expiry := flag.String("expiry", "", "Expiry date YYYY-MM-DD")
 	company := flag.String("company", "", "Company name")
 	email := flag.String("email", "", "Email address")
+	packageID := flag.String("package-id", "", "Optional package ID (package_id in the package manifest) to bind the token to")
+	packagePath := flag.String("package", "", "Optional encrypted_files.zip to bind the token to; for packages made with -license-key-share this also puts the package's key share in the token")
+	customerPub := flag.String("customer-pub", "", "Optional customer public key (PEM) to bind the token to")
+	subject := flag.String("subject", "", "Optional subject the license is issued to (e.g. a customer or deployment ID)")
+	notBefore := flag.String("not-before", "", "Optional first valid date YYYY-MM-DD")
+	entitlements := map[string]any{}
+	flag.Func("entitlement", "Entitlement as key=value, repeatable; values that parse as JSON (numbers, true/false, lists) keep their type", func(s string) error {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("want key=value")
+		}
+		var val any
+		if json.Unmarshal([]byte(v), &val) != nil {
+			val = v
+		}
+		entitlements[k] = val
+		return nil
+	})
+	legacy := flag.Bool("legacy", false, "Issue a legacy colon-delimited token for unpackers that predate version 2 tokens; -subject, -not-before and -entitlement are not supported")
 	out := flag.String("out", "token.txt", "Output token path")
 	flag.Parse()
 
@@ -50,32 +45,93 @@ func main() {
 		fmt.Println("Usage: issue-token -priv vendor_private.pem -expiry YYYY-MM-DD -company NAME -email ADDRESS [-out token.txt]")
 		os.Exit(1)
 	}
-	if _, err := time.Parse("2006-01-02", *expiry); err != nil {
+	exp, err := time.Parse(time.DateOnly, *expiry)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "invalid expiry: %v\n", err)
 		os.Exit(1)
 	}
 
-	priv, err := readRSAPrivateKey(*privPath)
+	priv, err := envelope.ReadRSAPrivateKeyFunc(*privPath, envelope.KeyPassphrase(*keyPassEnv, *keyPassFD))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "reading private key failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Keep placeholder for compatibility with existing format
-	payload := fmt.Sprintf("%s:%s:%s:%s", *expiry, *company, *email, "NOFERNET")
-	sum := sha256.Sum256([]byte(payload))
-	sig, err := rsa.SignPSS(rand.Reader, priv, crypto.SHA256, sum[:], nil)
+	lic := envelope.License{Expiry: exp, Company: *company, Email: *email, PackageID: *packageID, Subject: *subject}
+	if len(entitlements) > 0 {
+		lic.Entitlements = entitlements
+	}
+	if *notBefore != "" {
+		if lic.NotBefore, err = time.Parse(time.DateOnly, *notBefore); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid not-before: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *legacy && (lic.Subject != "" || lic.Entitlements != nil || !lic.NotBefore.IsZero()) {
+		fmt.Fprintln(os.Stderr, "-legacy tokens cannot carry -subject, -not-before or -entitlement")
+		os.Exit(1)
+	}
+	if *packagePath != "" {
+		id, share, err := readKeyShare(*packagePath, priv)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading package failed: %v\n", err)
+			os.Exit(1)
+		}
+		if lic.PackageID != "" && lic.PackageID != id {
+			fmt.Fprintf(os.Stderr, "-package-id %s does not match the package (%s)\n", lic.PackageID, id)
+			os.Exit(1)
+		}
+		lic.PackageID, lic.KeyShare = id, share
+	}
+	if *customerPub != "" {
+		pub, err := envelope.ReadPublicKey(*customerPub)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading customer public key failed: %v\n", err)
+			os.Exit(1)
+		}
+		if lic.CustomerKey, err = envelope.KeyFingerprint(pub); err != nil {
+			fmt.Fprintf(os.Stderr, "fingerprinting customer public key failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	issue := envelope.IssueLicense
+	if *legacy {
+		issue = envelope.IssueLegacyLicense
+	}
+	token, err := issue(priv, lic)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "sign failed: %v\n", err)
 		os.Exit(1)
 	}
-	sigB64 := base64.URLEncoding.EncodeToString(sig)
-	token := fmt.Sprintf("%s:%s:%s:%s:%s", *expiry, *company, *email, "NOFERNET", sigB64)
-	tokenB64 := base64.URLEncoding.EncodeToString([]byte(token))
 
-	if err := os.WriteFile(*out, []byte(tokenB64), 0644); err != nil {
+	// Tokens may carry a share of the data key; keep them to their owner,
+	// including when overwriting an older token
+	if err := os.WriteFile(*out, token, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "write token failed: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.Chmod(*out, 0600); err != nil {
 		fmt.Fprintf(os.Stderr, "write token failed: %v\n", err)
 		os.Exit(1)
 	}
 	fmt.Printf("✅ Token issued -> %s\n", *out)
+	if lic.KeyShare != nil {
+		fmt.Println("⚠️ WARNING: the token carries a share of the package's data key; send it to the customer over a protected channel and keep it private.")
+	}
+}
+
+// readKeyShare returns the package ID and license key share of the package
+// at path.
+func readKeyShare(path string, vendorPriv *rsa.PrivateKey) (string, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	return envelope.ReadKeyShare(f, st.Size(), vendorPriv)
 }
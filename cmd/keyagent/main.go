@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"secure_packager/pkg/envelope"
+)
+
+// stringList collects the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// idList collects numeric user or group IDs, repeated or comma-separated.
+type idList []int
+
+func (l *idList) String() string {
+	s := make([]string, len(*l))
+	for i, id := range *l {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *idList) Set(v string) error {
+	for _, f := range strings.Split(v, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || id < 0 {
+			return fmt.Errorf("invalid ID %q", f)
+		}
+		*l = append(*l, id)
+	}
+	return nil
+}
+
+func main() {
+	var keyPaths stringList
+	flag.Var(&keyPaths, "key", "Private key (PEM, optionally encrypted) to unwrap data keys with; repeatable")
+	socket := flag.String("socket", os.Getenv(envelope.AgentSocketEnv), "Unix socket to listen on; defaults to $"+envelope.AgentSocketEnv)
+	var allowUIDs, allowGIDs idList
+	flag.Var(&allowUIDs, "allow-uid", "Also admit peers running as this user ID; repeatable or comma-separated. The agent's own user is always admitted")
+	flag.Var(&allowGIDs, "allow-gid", "Also admit peers whose primary group is this group ID; repeatable or comma-separated")
+	keyPassEnv := flag.String("key-passphrase-env", "", "Name of an environment variable holding the passphrase of encrypted -key files; otherwise it is prompted for")
+	keyPassFD := flag.Int("key-passphrase-fd", -1, "Read the passphrase of encrypted -key files from this file descriptor")
+	flag.Parse()
+
+	if len(keyPaths) == 0 || *socket == "" {
+		fmt.Println("Usage: keyagent -key customer_private.pem [-key ...] -socket /run/secure-packager/agent.sock [-allow-uid 65532] [-allow-gid ...]")
+		os.Exit(1)
+	}
+	path, err := filepath.Abs(*socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -socket: %v\n", err)
+		os.Exit(1)
+	}
+
+	passphrase := envelope.KeyPassphrase(*keyPassEnv, *keyPassFD)
+	var keys []crypto.PrivateKey
+	for _, p := range keyPaths {
+		priv, err := envelope.ReadPrivateKeyFunc(p, passphrase)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Reading private key %s failed: %v\n", p, err)
+			os.Exit(1)
+		}
+		keys = append(keys, priv)
+	}
+	h, err := envelope.NewKeyServiceHandler(keys, envelope.KeyServiceOptions{Log: os.Stdout})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to use keys: %v\n", err)
+		os.Exit(1)
+	}
+	l, err := envelope.ListenKeyAgent(path, envelope.AgentOptions{AllowUIDs: allowUIDs, AllowGIDs: allowGIDs, Log: os.Stdout})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Starting key agent failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Remove the socket on the way out, so unpack does not find a dead agent
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		l.Close()
+	}()
+
+	fmt.Printf("✅ Key agent holding %d key(s) listening on %s\n", len(keys), path)
+	fmt.Printf("export %s=%s\n", envelope.AgentSocketEnv, path)
+	err = (&http.Server{Handler: h}).Serve(l)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Fprintf(os.Stderr, "Key agent stopped: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Key agent stopped")
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestIDList(t *testing.T) {
+	var l idList
+	for _, v := range []string{"1000", "65532, 0"} {
+		if err := l.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if want := (idList{1000, 65532, 0}); !slices.Equal(l, want) {
+		t.Errorf("got %v, want %v", l, want)
+	}
+	if s := l.String(); s != "1000,65532,0" {
+		t.Errorf("String() = %q", s)
+	}
+	for _, v := range []string{"", "root", "-1", "1,,2", "1.5"} {
+		if err := new(idList).Set(v); err == nil {
+			t.Errorf("Set(%q) accepted", v)
+		}
+	}
+}
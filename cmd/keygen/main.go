@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"secure_packager/pkg/envelope"
+)
+
+func main() {
+	keyType := flag.String("type", envelope.KeyTypeRSA, "Key type: rsa, p256, x25519, ed25519 (signing only) or mlkem768-x25519 (hybrid post-quantum)")
+	bits := flag.Int("bits", 3072, "RSA key size: 2048, 3072 or 4096")
+	outDir := flag.String("out", ".", "Output directory")
+	name := flag.String("name", "customer", "Key name; writes <name>_private.pem and <name>_public.pem")
+	force := flag.Bool("force", false, "Overwrite existing key files")
+	unencrypted := flag.Bool("unencrypted", false, "Write the private key unencrypted instead of protecting it with a passphrase")
+	keyPassEnv := flag.String("key-passphrase-env", "", "Name of an environment variable holding the private key passphrase; otherwise it is prompted for")
+	keyPassFD := flag.Int("key-passphrase-fd", -1, "Read the private key passphrase from this file descriptor")
+	requestPath := flag.String("request", "", "Also write a key request signed with the new key, to send to the vendor with the public key (rsa and p256 keys)")
+	company := flag.String("company", "", "Company name for -request")
+	email := flag.String("email", "", "Email address for -request")
+	nonce := flag.String("nonce", "", "Challenge from the vendor to include in -request; random if omitted")
+	flag.Parse()
+
+	if *requestPath != "" && (*company == "" || *email == "") {
+		fmt.Println("Usage: keygen [-type rsa] [-out DIR] [-name customer] [-request key_request.jwt -company NAME -email ADDRESS]")
+		os.Exit(1)
+	}
+	if *requestPath != "" && *keyType != envelope.KeyTypeRSA && *keyType != envelope.KeyTypeP256 {
+		fmt.Fprintln(os.Stderr, "-request needs an rsa or p256 key: x25519 and hybrid keys cannot sign, and ed25519 keys are signing-only and cannot be package recipients")
+		os.Exit(1)
+	}
+	privPath := filepath.Join(*outDir, *name+"_private.pem")
+	pubPath := filepath.Join(*outDir, *name+"_public.pem")
+	if !*force {
+		for _, p := range []string{privPath, pubPath} {
+			if _, err := os.Stat(p); err == nil {
+				fmt.Fprintf(os.Stderr, "%s already exists; use -force to overwrite it\n", p)
+				os.Exit(1)
+			}
+		}
+	}
+
+	priv, err := envelope.GenerateKey(*keyType, *bits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generating key failed: %v\n", err)
+		os.Exit(1)
+	}
+	pub, err := envelope.PublicKeyOf(priv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generating key failed: %v\n", err)
+		os.Exit(1)
+	}
+	kid, err := envelope.KeyFingerprint(pub)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fingerprinting key failed: %v\n", err)
+		os.Exit(1)
+	}
+	var request []byte
+	if *requestPath != "" {
+		if request, err = envelope.CreateKeyRequest(priv, envelope.KeyRequest{Company: *company, Email: *email, Nonce: *nonce}); err != nil {
+			fmt.Fprintf(os.Stderr, "creating key request failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var passphrase []byte
+	if !*unencrypted {
+		if *keyPassEnv != "" || *keyPassFD >= 0 {
+			passphrase, err = envelope.KeyPassphrase(*keyPassEnv, *keyPassFD)()
+		} else {
+			passphrase, err = envelope.PromptPassphrase("Private key passphrase: ", true)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading passphrase failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "creating output dir failed: %v\n", err)
+		os.Exit(1)
+	}
+	if err := envelope.WriteKeyPair(privPath, pubPath, priv, passphrase); err != nil {
+		fmt.Fprintf(os.Stderr, "writing keys failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s and %s\n", privPath, pubPath)
+	if request != nil {
+		if err := os.WriteFile(*requestPath, append(request, '\n'), 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "writing key request failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("📄 Wrote key request %s; send it to the vendor instead of the bare public key\n", *requestPath)
+	}
+	fmt.Printf("🔑 Key fingerprint: %s\n", kid)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"secure_packager/pkg/envelope"
+)
+
+// stringList collects the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8700", "Address to serve the key service on")
+	var keyPaths stringList
+	flag.Var(&keyPaths, "key", "Private key (PEM, optionally encrypted) to unwrap data keys with; repeatable")
+	tokenEnv := flag.String("token-env", "", "Name of an environment variable holding the bearer token clients must present")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate (PEM) to serve https with; required unless -listen is a loopback address")
+	tlsKey := flag.String("tls-key", "", "TLS private key (PEM) for -tls-cert")
+	keyPassEnv := flag.String("key-passphrase-env", "", "Name of an environment variable holding the passphrase of encrypted -key files; otherwise it is prompted for")
+	keyPassFD := flag.Int("key-passphrase-fd", -1, "Read the passphrase of encrypted -key files from this file descriptor")
+	flag.Parse()
+
+	if len(keyPaths) == 0 {
+		fmt.Println("Usage: keyserver -key customer_private.pem [-key ...] [-listen 127.0.0.1:8700] [-token-env VAR] [-tls-cert cert.pem -tls-key key.pem]")
+		os.Exit(1)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintln(os.Stderr, "-tls-cert and -tls-key must be given together")
+		os.Exit(1)
+	}
+	host, _, err := net.SplitHostPort(*listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -listen address: %v\n", err)
+		os.Exit(1)
+	}
+	if ip := net.ParseIP(host); *tlsCert == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		fmt.Fprintln(os.Stderr, "-listen on a non-loopback address requires -tls-cert and -tls-key")
+		os.Exit(1)
+	}
+
+	passphrase := envelope.KeyPassphrase(*keyPassEnv, *keyPassFD)
+	var keys []crypto.PrivateKey
+	for _, p := range keyPaths {
+		priv, err := envelope.ReadPrivateKeyFunc(p, passphrase)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Reading private key %s failed: %v\n", p, err)
+			os.Exit(1)
+		}
+		keys = append(keys, priv)
+	}
+	opts := envelope.KeyServiceOptions{Log: os.Stdout}
+	if *tokenEnv != "" {
+		if opts.Token = os.Getenv(*tokenEnv); opts.Token == "" {
+			fmt.Fprintf(os.Stderr, "Environment variable %s is empty\n", *tokenEnv)
+			os.Exit(1)
+		}
+	} else {
+		fmt.Println("⚠️ WARNING: no -token-env given; any local process can have data keys unwrapped.")
+	}
+	h, err := envelope.NewKeyServiceHandler(keys, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to use keys: %v\n", err)
+		os.Exit(1)
+	}
+	for _, k := range keys {
+		pub, err := envelope.PublicKeyOf(k)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to use keys: %v\n", err)
+			os.Exit(1)
+		}
+		kid, err := envelope.KeyFingerprint(pub)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to use keys: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("🔑 Serving key %s\n", kid)
+	}
+
+	srv := &http.Server{Addr: *listen, Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	scheme := "http"
+	if *tlsCert != "" {
+		scheme = "https"
+	}
+	fmt.Printf("✅ Key service listening on %s://%s\n", scheme, *listen)
+	if *tlsCert != "" {
+		err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	fmt.Fprintf(os.Stderr, "Key service stopped: %v\n", err)
+	os.Exit(1)
+}
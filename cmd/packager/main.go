@@ -2,12 +2,9 @@ package main
 
 import (
 	"archive/zip"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
+	"context"
+	"crypto"
 	"crypto/x509"
-	"encoding/pem"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -15,210 +12,344 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/fernet/fernet-go"
+	"secure_packager/pkg/envelope"
 )
 
-func readRSAPublicKey(path string) (*rsa.PublicKey, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	block, _ := pem.Decode(b)
-	if block == nil {
-		return nil, errors.New("invalid PEM")
-	}
-	if pub, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
-		if k, ok := pub.(*rsa.PublicKey); ok {
-			return k, nil
+// teeEntryWriter hands every entry to several EntryWriters at once.
+type teeEntryWriter []envelope.EntryWriter
+
+func (t teeEntryWriter) Create(name string) (io.Writer, error) {
+	ws := make([]io.Writer, 0, len(t))
+	for _, ew := range t {
+		w, err := ew.Create(name)
+		if err != nil {
+			return nil, err
 		}
-		return nil, errors.New("not RSA public key")
+		ws = append(ws, w)
 	}
-	k, err := x509.ParsePKCS1PublicKey(block.Bytes)
-	if err != nil {
-		return nil, err
-	}
-	return k, nil
+	return io.MultiWriter(ws...), nil
 }
 
-func encryptFilesWithFernet(key *fernet.Key, inputDir, outputDir string) error {
-	entries, err := os.ReadDir(inputDir)
-	if err != nil {
-		return err
-	}
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return err
-	}
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
+// stringList collects the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// verifyKeyRequests verifies the key requests at paths and returns their
+// public keys. Every key in pubs must match one of them, so a public key
+// swapped on its way from the customer is caught. Without a nonce, unless
+// allowNoNonce, requests are refused, as an old or replayed one would pass.
+func verifyKeyRequests(paths []string, nonce string, allowNoNonce bool, pubs []crypto.PublicKey) []crypto.PublicKey {
+	if nonce == "" {
+		if !allowNoNonce {
+			fmt.Fprintln(os.Stderr, "-key-request requires -key-request-nonce, the challenge sent to the customer; pass -allow-no-nonce to accept requests without one")
+			os.Exit(1)
 		}
-		inPath := filepath.Join(inputDir, e.Name())
-		outPath := filepath.Join(outputDir, e.Name()+".enc")
-		data, err := os.ReadFile(inPath)
+		fmt.Println("⚠️ WARNING: no -key-request-nonce given; key requests prove possession of the key but not that they answer your challenge, so a replayed request is accepted.")
+	}
+	var out []crypto.PublicKey
+	verified := make(map[string]bool)
+	for _, p := range paths {
+		req, err := envelope.ReadKeyRequest(p)
 		if err != nil {
-			return err
+			fmt.Fprintf(os.Stderr, "❌ Key request %s rejected: %v\n", p, err)
+			os.Exit(1)
+		}
+		if nonce != "" && req.Nonce != nonce {
+			fmt.Fprintf(os.Stderr, "❌ Key request %s does not carry the expected nonce; it was not made in answer to your challenge\n", p)
+			os.Exit(1)
 		}
-		ct, err := fernet.EncryptAndSign(data, key)
+		fmt.Printf("✅ Key request %s verified: %s <%s>, key %s, made %s\n", p, req.Company, req.Email, req.KeyID, req.IssuedAt.Format("2006-01-02"))
+		if !verified[req.KeyID] {
+			verified[req.KeyID] = true
+			out = append(out, req.PublicKey)
+		}
+	}
+	for _, pub := range pubs {
+		kid, err := envelope.KeyFingerprint(pub)
 		if err != nil {
-			return err
+			fmt.Fprintf(os.Stderr, "Failed to use public key: %v\n", err)
+			os.Exit(1)
 		}
-		if err := os.WriteFile(outPath, ct, 0644); err != nil {
-			return err
+		if !verified[kid] {
+			fmt.Fprintf(os.Stderr, "❌ Public key %s does not match any key request; it may have been swapped\n", kid)
+			os.Exit(1)
 		}
-		fmt.Printf("Encrypted %s -> %s\n", e.Name(), filepath.Base(outPath))
 	}
-	return nil
+	return out
 }
 
-func wrapFernetKey(pub *rsa.PublicKey, key *fernet.Key) ([]byte, error) {
-	// Encrypt the base64-encoded fernet key string bytes with RSA-OAEP
-	enc := []byte(key.Encode())
-	label := []byte("secure_packager")
-	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, enc, label)
-	if err != nil {
-		return nil, err
+// certificateRecipients validates the certificates at paths against the
+// roots bundle and CRLs and returns a KeyWrapper for each.
+func certificateRecipients(paths []string, rootsPath string, crlPaths []string) []envelope.KeyWrapper {
+	if rootsPath == "" {
+		fmt.Fprintln(os.Stderr, "-cert requires -cert-roots <roots.pem>")
+		os.Exit(1)
 	}
-	return wrapped, nil
-}
-
-func zipOutputs(srcDir, zipPath string) error {
-	f, err := os.Create(zipPath)
-	if err != nil {
-		return err
+	var opts envelope.CertificateOptions
+	var err error
+	if opts.Roots, err = envelope.ReadCertPool(rootsPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Reading root certificates failed: %v\n", err)
+		os.Exit(1)
 	}
-	defer f.Close()
-	zw := zip.NewWriter(f)
-	defer zw.Close()
-
-	addFile := func(path, name string) error {
-		in, err := os.Open(path)
+	for _, p := range crlPaths {
+		crl, err := envelope.ReadCRL(p)
 		if err != nil {
-			return err
+			fmt.Fprintf(os.Stderr, "Reading CRL %s failed: %v\n", p, err)
+			os.Exit(1)
 		}
-		defer in.Close()
-		w, err := zw.Create(name)
+		opts.CRLs = append(opts.CRLs, crl)
+	}
+	var out []envelope.KeyWrapper
+	for _, p := range paths {
+		certs, err := envelope.ReadCertificates(p)
 		if err != nil {
-			return err
+			fmt.Fprintf(os.Stderr, "Reading certificate %s failed: %v\n", p, err)
+			os.Exit(1)
 		}
-		_, err = io.Copy(w, in)
-		return err
-	}
-
-	entries, err := os.ReadDir(srcDir)
-	if err != nil {
-		return err
-	}
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
+		opts.Intermediates = x509.NewCertPool()
+		for _, c := range certs[1:] {
+			opts.Intermediates.AddCert(c)
 		}
-		p := filepath.Join(srcDir, e.Name())
-		if err := addFile(p, e.Name()); err != nil {
-			return err
+		w, err := envelope.NewCertificateWrapper(certs[0], opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Certificate %s rejected: %v\n", p, err)
+			os.Exit(1)
 		}
+		fmt.Printf("✅ Certificate %s verified: %s, serial %x, valid until %s\n", p, certs[0].Subject, certs[0].SerialNumber, certs[0].NotAfter.Format("2006-01-02"))
+		out = append(out, w)
 	}
-	return nil
+	return out
 }
 
 func main() {
-	inputDir := flag.String("in", "", "Input directory with files to encrypt")
+	inputDir := flag.String("in", "", "Input directory to encrypt, including all subdirectories")
 	outDir := flag.String("out", "", "Output directory for encrypted payload")
-	customerPub := flag.String("pub", "", "Path to customer's RSA public key (PEM)")
+	var customerPubs stringList
+	flag.Var(&customerPubs, "pub", "Path to customer's RSA, X25519, P-256 or ML-KEM-768 + X25519 public key (PEM); repeat to wrap the data key for several recipients")
+	recipientsPath := flag.String("recipients", "", "Optional file of concatenated PEM public keys to wrap the data key for, in addition to -pub")
+	var keyRequests stringList
+	flag.Var(&keyRequests, "key-request", "Customer key request (keygen -request) to verify and wrap the data key for; repeatable. When given, every -pub and -recipients key must match a verified request")
+	keyRequestNonce := flag.String("key-request-nonce", "", "Challenge sent to the customer for keygen -nonce; every -key-request must carry it. Required with -key-request unless -allow-no-nonce")
+	allowNoNonce := flag.Bool("allow-no-nonce", false, "Accept -key-request without -key-request-nonce; an old or replayed request then passes")
+	var certPaths stringList
+	flag.Var(&certPaths, "cert", "Customer X.509 certificate (PEM, leaf first, optionally followed by intermediates) to wrap the data key for; repeatable, requires -cert-roots")
+	certRoots := flag.String("cert-roots", "", "PEM bundle of root CA certificates that -cert certificates must chain to")
+	var crlPaths stringList
+	flag.Var(&crlPaths, "crl", "Certificate revocation list (PEM or DER) to check -cert chains against; repeatable")
+	var custodianPubs stringList
+	flag.Var(&custodianPubs, "custodian", "Custodian public key (PEM) to give a share of the data key instead of the whole key; repeatable, requires -threshold")
+	threshold := flag.Int("threshold", 0, "Number of -custodian shares needed to recover the data key, at least 2")
+	escrowPub := flag.String("escrow-pub", "", "Optional vendor escrow public key to also wrap the data key for, flagged in the manifest, so the package can be recovered for a new customer key with recover")
+	passphrase := flag.Bool("passphrase", false, "Also wrap the data key for a passphrase, prompted for on the terminal, so customers without a key pair can unpack; may be used without -pub")
+	passphraseFD := flag.Int("passphrase-fd", -1, "Read the -passphrase passphrase from this file descriptor instead of prompting (implies -passphrase)")
+	kdf := flag.String("kdf", envelope.KDFArgon2id, "Passphrase key derivation: argon2id or scrypt")
 	makeZip := flag.Bool("zip", true, "Also create encrypted_files.zip in output directory")
 	cleanup := flag.Bool("cleanup", true, "After zipping, remove generated .enc files and helper artifacts")
 	licenseMode := flag.Bool("license", false, "If set, write manifest to require license check in unzip")
 	vendorPubPath := flag.String("vendor-pub", "", "Vendor public key (PEM) to embed for license verification when -license is set")
+	keyShare := flag.Bool("license-key-share", false, "With -license, split the data key so the package only decrypts with a key share carried in a license token issued for it (issue-token -package)")
+	signKeyPath := flag.String("sign-key", "", "Optional vendor RSA private key (PEM) to sign manifest.json with, so customers can verify the package came from you")
+	keyPassEnv := flag.String("key-passphrase-env", "", "Name of an environment variable holding the passphrase of an encrypted -sign-key; otherwise it is prompted for")
+	keyPassFD := flag.Int("key-passphrase-fd", -1, "Read the passphrase of an encrypted -sign-key from this file descriptor")
+	suite := flag.String("cipher", "fernet", "Payload cipher suite: fernet (compatible with every unpack release), aes-256-gcm or xchacha20-poly1305")
+	chunkSize := flag.Int("chunk-size", envelope.DefaultChunkSize, "Plaintext bytes per encrypted chunk; files are streamed chunk by chunk")
+	private := flag.Bool("private", false, "Privacy mode: give payload entries random names, keep file names and sizes only in an encrypted index, and pad files to size buckets")
 	flag.Parse()
 
-	if *inputDir == "" || *outDir == "" || *customerPub == "" {
-		fmt.Println("Usage: packager -in <input_dir> -out <output_dir> -pub <customer_public.pem> [-zip=true]")
+	usePassphrase := *passphrase || *passphraseFD >= 0
+	if *inputDir == "" || *outDir == "" || (len(customerPubs) == 0 && *recipientsPath == "" && len(keyRequests) == 0 && len(certPaths) == 0 && len(custodianPubs) == 0 && !usePassphrase) {
+		fmt.Println("Usage: packager -in <input_dir> -out <output_dir> {-pub <customer_public.pem> [-pub ...] [-recipients keys.pem] | -key-request <key_request.jwt> | -cert <customer_cert.pem> -cert-roots <roots.pem> | -custodian <custodian_public.pem> [-custodian ...] -threshold m | -passphrase} [-zip=true]")
 		os.Exit(1)
 	}
-
-	pub, err := readRSAPublicKey(*customerPub)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read public key: %v\n", err)
+	if len(custodianPubs) > 0 && (len(customerPubs) > 0 || *recipientsPath != "" || len(keyRequests) > 0 || len(certPaths) > 0 || usePassphrase || *escrowPub != "") {
+		fmt.Fprintln(os.Stderr, "-custodian cannot be combined with -pub, -recipients, -key-request, -cert, -passphrase or -escrow-pub, which would each recover the data key alone")
 		os.Exit(1)
 	}
-
-	if err := os.MkdirAll(*outDir, 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create output dir: %v\n", err)
+	if (len(custodianPubs) > 0 || *threshold != 0) && (*threshold < 2 || *threshold > len(custodianPubs)) {
+		fmt.Fprintf(os.Stderr, "-threshold must be between 2 and the number of -custodian keys (%d)\n", len(custodianPubs))
 		os.Exit(1)
 	}
-
-	k := new(fernet.Key)
-	if err := k.Generate(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to generate fernet key: %v\n", err)
+	if *keyRequestNonce != "" && len(keyRequests) == 0 {
+		fmt.Fprintln(os.Stderr, "-key-request-nonce requires -key-request")
 		os.Exit(1)
 	}
 
-	if err := encryptFilesWithFernet(k, *inputDir, *outDir); err != nil {
-		fmt.Fprintf(os.Stderr, "Encryption failed: %v\n", err)
-		os.Exit(1)
+	var pubs []crypto.PublicKey
+	for _, p := range customerPubs {
+		pub, err := envelope.ReadPublicKey(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read public key %s: %v\n", p, err)
+			os.Exit(1)
+		}
+		pubs = append(pubs, pub)
 	}
-
-	wrapped, err := wrapFernetKey(pub, k)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Wrapping key failed: %v\n", err)
-		os.Exit(1)
+	if *recipientsPath != "" {
+		more, err := envelope.ReadPublicKeys(*recipientsPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read recipients file: %v\n", err)
+			os.Exit(1)
+		}
+		pubs = append(pubs, more...)
 	}
-
-	if err := os.WriteFile(filepath.Join(*outDir, "wrapped_key.bin"), wrapped, 0644); err != nil {
-		fmt.Fprintf(os.Stderr, "Writing wrapped key failed: %v\n", err)
+	if len(keyRequests) > 0 {
+		pubs = verifyKeyRequests(keyRequests, *keyRequestNonce, *allowNoNonce, pubs)
+	}
+	var recipients []envelope.KeyWrapper
+	for _, pub := range pubs {
+		w, err := envelope.NewKeyWrapper(pub)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to use public key: %v\n", err)
+			os.Exit(1)
+		}
+		recipients = append(recipients, w)
+	}
+	if len(certPaths) > 0 {
+		recipients = append(recipients, certificateRecipients(certPaths, *certRoots, crlPaths)...)
+	} else if *certRoots != "" || len(crlPaths) > 0 {
+		fmt.Fprintln(os.Stderr, "-cert-roots and -crl require -cert")
 		os.Exit(1)
 	}
-	fmt.Println("Wrote wrapped_key.bin")
+	var custodians []envelope.KeyWrapper
+	for _, p := range custodianPubs {
+		pub, err := envelope.ReadPublicKey(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read custodian public key %s: %v\n", p, err)
+			os.Exit(1)
+		}
+		w, err := envelope.NewKeyWrapper(pub)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to use custodian public key %s: %v\n", p, err)
+			os.Exit(1)
+		}
+		custodians = append(custodians, w)
+	}
+	if *escrowPub != "" {
+		if len(recipients) == 0 {
+			fmt.Fprintln(os.Stderr, "-escrow-pub needs a customer recipient (-pub, -key-request or -cert)")
+			os.Exit(1)
+		}
+		pub, err := envelope.ReadPublicKey(*escrowPub)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read escrow public key: %v\n", err)
+			os.Exit(1)
+		}
+		w, err := envelope.NewKeyWrapper(pub)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to use escrow public key: %v\n", err)
+			os.Exit(1)
+		}
+		recipients = append(recipients, envelope.NewEscrowWrapper(w))
+	}
+	if usePassphrase {
+		var p []byte
+		var err error
+		if *passphraseFD >= 0 {
+			p, err = envelope.ReadPassphraseFD(*passphraseFD)
+		} else {
+			p, err = envelope.PromptPassphrase("Package passphrase: ", true)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Reading passphrase failed: %v\n", err)
+			os.Exit(1)
+		}
+		w, err := envelope.NewPassphraseWrapper(p, *kdf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to use passphrase: %v\n", err)
+			os.Exit(1)
+		}
+		recipients = append(recipients, w)
+	}
 
+	var err error
+	opts := envelope.PackOptions{Recipients: recipients, Custodians: custodians, Threshold: *threshold, License: *licenseMode, LicenseKeyShare: *keyShare, CipherSuite: strings.ToUpper(*suite), ChunkSize: *chunkSize, Private: *private, Log: os.Stdout}
 	// Optional: include licensing manifest and vendor public key for verification at unpack time
 	if *licenseMode {
-		if vendorPubPath == nil || strings.TrimSpace(*vendorPubPath) == "" {
+		if strings.TrimSpace(*vendorPubPath) == "" {
 			fmt.Fprintln(os.Stderr, "-license requires -vendor-pub <vendor_public.pem>")
 			os.Exit(1)
 		}
-		manifest := []byte("{\n  \"license_required\": true,\n  \"vendor_public_key\": \"vendor_public.pem\"\n}\n")
-		if err := os.WriteFile(filepath.Join(*outDir, "manifest.json"), manifest, 0644); err != nil {
-			fmt.Fprintf(os.Stderr, "Writing manifest failed: %v\n", err)
+		if opts.VendorPublicKey, err = os.ReadFile(*vendorPubPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Reading vendor public key failed: %v\n", err)
 			os.Exit(1)
 		}
-		// Copy vendor public key alongside manifest so the unpacker can verify tokens without external files
-		vp, err := os.ReadFile(*vendorPubPath)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Reading vendor public key failed: %v\n", err)
+	}
+
+	if *keyShare && !*licenseMode {
+		fmt.Fprintln(os.Stderr, "-license-key-share requires -license")
+		os.Exit(1)
+	}
+	if *signKeyPath != "" {
+		if opts.SigningKey, err = envelope.ReadRSAPrivateKeyFunc(*signKeyPath, envelope.KeyPassphrase(*keyPassEnv, *keyPassFD)); err != nil {
+			fmt.Fprintf(os.Stderr, "Reading signing key failed: %v\n", err)
 			os.Exit(1)
 		}
-		if err := os.WriteFile(filepath.Join(*outDir, "vendor_public.pem"), vp, 0644); err != nil {
-			fmt.Fprintf(os.Stderr, "Writing vendor public key failed: %v\n", err)
+	}
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create output dir: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Never package our own output: the zip when writing into the input
+	// directory, or the whole output directory when it is nested inside it
+	zipPath := filepath.Join(*outDir, envelope.ArchiveName)
+	absIn, err1 := filepath.Abs(*inputDir)
+	absOut, err2 := filepath.Abs(*outDir)
+	if err1 == nil && err2 == nil {
+		absZip := filepath.Join(absOut, envelope.ArchiveName)
+		opts.Exclude = func(name string) bool {
+			p := filepath.Join(absIn, filepath.FromSlash(name))
+			return p == absZip || (p == absOut && absOut != absIn)
+		}
+	}
+
+	// Loose artifacts are kept in the output directory unless they only
+	// exist to be zipped and cleanup is requested
+	var dst teeEntryWriter
+	if !*makeZip || !*cleanup {
+		dw := envelope.NewDirWriter(*outDir)
+		defer dw.Close()
+		dst = append(dst, dw)
+	}
+	var zf *os.File
+	var zw *zip.Writer
+	if *makeZip {
+		if zf, err = os.Create(zipPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Zipping failed: %v\n", err)
 			os.Exit(1)
 		}
-		fmt.Println("Wrote manifest.json and vendor_public.pem for license enforcement")
+		zw = zip.NewWriter(zf)
+		dst = append(dst, envelope.ZipEntryWriter(zw))
+	}
+
+	// A partly written zip must not be left behind looking like a package
+	if err := envelope.PackTo(context.Background(), dst, os.DirFS(*inputDir), opts); err != nil {
+		if zf != nil {
+			zf.Close()
+			os.Remove(zipPath)
+		}
+		fmt.Fprintf(os.Stderr, "Packaging failed: %v\n", err)
+		os.Exit(1)
 	}
 
 	if *makeZip {
-		zipPath := filepath.Join(*outDir, "encrypted_files.zip")
-		if err := zipOutputs(*outDir, zipPath); err != nil {
+		err := zw.Close()
+		if cerr := zf.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(zipPath)
 			fmt.Fprintf(os.Stderr, "Zipping failed: %v\n", err)
 			os.Exit(1)
 		}
 		fmt.Printf("Created %s\n", zipPath)
-		if *cleanup {
-			// Remove generated artifacts, but keep the zip and any user-provided files
-			entries, err := os.ReadDir(*outDir)
-			if err == nil {
-				for _, e := range entries {
-					if e.IsDir() {
-						continue
-					}
-					name := e.Name()
-					// Keep the final zip
-					if name == "encrypted_files.zip" {
-						continue
-					}
-					// Remove our generated files: .enc, wrapped_key.bin, manifest.json, vendor_public.pem
-					if strings.HasSuffix(name, ".enc") || name == "wrapped_key.bin" || name == "manifest.json" || name == "vendor_public.pem" {
-						_ = os.Remove(filepath.Join(*outDir, name))
-					}
-				}
-			}
-		}
 	}
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"secure_packager/pkg/envelope"
+)
+
+// stringList collects the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func main() {
+	zipPath := flag.String("zip", "", "Package (encrypted_files.zip) made with packager -escrow-pub")
+	outPath := flag.String("out", "", "Path to write the recovered package to")
+	escrowPriv := flag.String("escrow-priv", "", "Vendor escrow private key (PEM), optionally encrypted")
+	var pubs stringList
+	flag.Var(&pubs, "pub", "Customer's new public key (PEM) to wrap the data key for; repeatable")
+	keepOthers := flag.Bool("keep-others", true, "Keep the package's current recipients, so existing customers can still unpack; -keep-others=false drops all but escrow recipients and custodians")
+	signKeyPath := flag.String("sign-key", "", "Vendor RSA private key (PEM) to re-sign the manifest with; required for signed packages")
+	keyPassEnv := flag.String("key-passphrase-env", "", "Name of an environment variable holding the passphrase of an encrypted -escrow-priv or -sign-key; otherwise it is prompted for")
+	keyPassFD := flag.Int("key-passphrase-fd", -1, "Read the passphrase of an encrypted -escrow-priv or -sign-key from this file descriptor")
+	flag.Parse()
+
+	if *zipPath == "" || *outPath == "" || *escrowPriv == "" || len(pubs) == 0 {
+		fmt.Println("Usage: recover -zip encrypted_files.zip -escrow-priv escrow_private.pem -pub new_customer_public.pem -out recovered.zip [-sign-key vendor_private.pem]")
+		os.Exit(1)
+	}
+	if a, err1 := filepath.Abs(*zipPath); err1 == nil {
+		if b, err2 := filepath.Abs(*outPath); err2 == nil && a == b {
+			fmt.Fprintln(os.Stderr, "-out must differ from -zip")
+			os.Exit(1)
+		}
+	}
+
+	passphrase := envelope.KeyPassphrase(*keyPassEnv, *keyPassFD)
+	priv, err := envelope.ReadPrivateKeyFunc(*escrowPriv, passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reading escrow private key failed: %v\n", err)
+		os.Exit(1)
+	}
+	opts := envelope.RewrapOptions{RequireEscrow: true, Log: os.Stdout}
+	opts.Keep = func(r envelope.ManifestRecipient) bool {
+		return *keepOthers || r.Escrow || r.Share != 0
+	}
+	if opts.KeyUnwrapper, err = envelope.NewKeyUnwrapper(priv); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to use escrow private key: %v\n", err)
+		os.Exit(1)
+	}
+	for _, p := range pubs {
+		pub, err := envelope.ReadPublicKey(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read public key %s: %v\n", p, err)
+			os.Exit(1)
+		}
+		w, err := envelope.NewKeyWrapper(pub)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to use public key %s: %v\n", p, err)
+			os.Exit(1)
+		}
+		opts.Recipients = append(opts.Recipients, w)
+	}
+	if *signKeyPath != "" {
+		if opts.SigningKey, err = envelope.ReadRSAPrivateKeyFunc(*signKeyPath, passphrase); err != nil {
+			fmt.Fprintf(os.Stderr, "Reading signing key failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	in, err := os.Open(*zipPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open package: %v\n", err)
+		os.Exit(1)
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stat package: %v\n", err)
+		os.Exit(1)
+	}
+	out, err := os.Create(*outPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create output: %v\n", err)
+		os.Exit(1)
+	}
+	if err := envelope.Rewrap(context.Background(), out, in, fi.Size(), opts); err != nil {
+		out.Close()
+		os.Remove(*outPath)
+		fmt.Fprintf(os.Stderr, "❌ Recovery failed: %v\n", err)
+		os.Exit(1)
+	}
+	if err := out.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write output: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("✅ Recovered package written to %s; the ciphertext is unchanged\n", *outPath)
+	fmt.Println("⚠️ License tokens bound to the old customer key (-customer-pub) must be reissued for the new one.")
+}
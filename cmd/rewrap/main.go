@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"secure_packager/pkg/envelope"
+)
+
+// stringList collects the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func main() {
+	zipPath := flag.String("zip", "", "Package (encrypted_files.zip) to rewrap")
+	outPath := flag.String("out", "", "Path to write the rewrapped package to")
+	inPlace := flag.Bool("in-place", false, "Replace -zip with the rewrapped package instead of writing -out")
+	privPath := flag.String("priv", "", "Old private key (PEM, optionally encrypted) the package is currently wrapped for")
+	var pubs stringList
+	flag.Var(&pubs, "pub", "New public key (PEM) to wrap the data key for; repeatable")
+	recipientsPath := flag.String("recipients", "", "Optional file of concatenated PEM public keys to wrap the data key for, in addition to -pub")
+	keepOthers := flag.Bool("keep-others", true, "Keep the package's other recipients; only the -priv recipient is replaced. Escrow recipients and custodians are always kept")
+	signKeyPath := flag.String("sign-key", "", "RSA private key (PEM) to re-sign the manifest with, the vendor's or the customer's own; signed packages need it or -drop-signature")
+	dropSig := flag.Bool("drop-signature", false, "Write an unsigned copy of a signed package when there is no -sign-key; unpack -signer-pub or -require-signed then refuses it")
+	keyPassEnv := flag.String("key-passphrase-env", "", "Name of an environment variable holding the passphrase of an encrypted -priv or -sign-key; otherwise it is prompted for")
+	keyPassFD := flag.Int("key-passphrase-fd", -1, "Read the passphrase of an encrypted -priv or -sign-key from this file descriptor")
+	flag.Parse()
+
+	if *zipPath == "" || *privPath == "" || (len(pubs) == 0 && *recipientsPath == "") || (*outPath == "") == !*inPlace {
+		fmt.Println("Usage: rewrap -zip encrypted_files.zip -priv old_private.pem -pub new_public.pem [-pub ...] {-out rewrapped.zip | -in-place} [-sign-key signing_private.pem | -drop-signature]")
+		fmt.Println("Signed packages are re-signed with -sign-key; customers without the vendor signing key sign with their own key or use -drop-signature.")
+		os.Exit(1)
+	}
+	if *dropSig && *signKeyPath != "" {
+		fmt.Fprintln(os.Stderr, "-drop-signature cannot be combined with -sign-key")
+		os.Exit(1)
+	}
+	if *inPlace {
+		*outPath = *zipPath + ".rewrap"
+	} else if a, err1 := filepath.Abs(*zipPath); err1 == nil {
+		if b, err2 := filepath.Abs(*outPath); err2 == nil && a == b {
+			fmt.Fprintln(os.Stderr, "-out must differ from -zip; use -in-place to replace it")
+			os.Exit(1)
+		}
+	}
+
+	passphrase := envelope.KeyPassphrase(*keyPassEnv, *keyPassFD)
+	priv, err := envelope.ReadPrivateKeyFunc(*privPath, passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reading private key failed: %v\n", err)
+		os.Exit(1)
+	}
+	var opts envelope.RewrapOptions
+	if opts.KeyUnwrapper, err = envelope.NewKeyUnwrapper(priv); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to use private key: %v\n", err)
+		os.Exit(1)
+	}
+	oldKey := opts.KeyUnwrapper.KeyID()
+	opts.Keep = func(r envelope.ManifestRecipient) bool {
+		return r.KeyID != oldKey && (*keepOthers || r.Escrow || r.Share != 0)
+	}
+	opts.DropSignature = *dropSig
+	opts.Log = os.Stdout
+
+	var newPubs []crypto.PublicKey
+	for _, p := range pubs {
+		pub, err := envelope.ReadPublicKey(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read public key %s: %v\n", p, err)
+			os.Exit(1)
+		}
+		newPubs = append(newPubs, pub)
+	}
+	if *recipientsPath != "" {
+		more, err := envelope.ReadPublicKeys(*recipientsPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read recipients file: %v\n", err)
+			os.Exit(1)
+		}
+		newPubs = append(newPubs, more...)
+	}
+	for _, pub := range newPubs {
+		w, err := envelope.NewKeyWrapper(pub)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to use public key: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Recipients = append(opts.Recipients, w)
+	}
+	if *signKeyPath != "" {
+		if opts.SigningKey, err = envelope.ReadRSAPrivateKeyFunc(*signKeyPath, passphrase); err != nil {
+			fmt.Fprintf(os.Stderr, "Reading signing key failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	in, err := os.Open(*zipPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open package: %v\n", err)
+		os.Exit(1)
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stat package: %v\n", err)
+		os.Exit(1)
+	}
+	out, err := os.Create(*outPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create output: %v\n", err)
+		os.Exit(1)
+	}
+	if err := envelope.Rewrap(context.Background(), out, in, fi.Size(), opts); err != nil {
+		out.Close()
+		os.Remove(*outPath)
+		fmt.Fprintf(os.Stderr, "❌ Rewrap failed: %v\n", err)
+		os.Exit(1)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(*outPath)
+		fmt.Fprintf(os.Stderr, "Failed to write output: %v\n", err)
+		os.Exit(1)
+	}
+	if *inPlace {
+		// The rewrapped copy only replaces the original once it is complete
+		if err := os.Rename(*outPath, *zipPath); err != nil {
+			os.Remove(*outPath)
+			fmt.Fprintf(os.Stderr, "Failed to replace package: %v\n", err)
+			os.Exit(1)
+		}
+		*outPath = *zipPath
+	}
+	fmt.Printf("✅ Rewrapped package written to %s; the ciphertext is unchanged\n", *outPath)
+}
@@ -1,293 +1,282 @@
 package main
 
 import (
-	"archive/zip"
-	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/pem"
+	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/fernet/fernet-go"
+	"secure_packager/pkg/envelope"
 )
 
-func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	block, _ := pem.Decode(b)
-	if block == nil {
-		return nil, errors.New("invalid PEM")
-	}
-	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
-		return k, nil
-	}
-	keyAny, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
-	}
-	k, ok := keyAny.(*rsa.PrivateKey)
-	if !ok {
-		return nil, errors.New("PEM is not RSA private key")
-	}
-	return k, nil
-}
+// stringList collects the values of a repeated flag.
+type stringList []string
 
-func unzip(src, dest string) error {
-	r, err := zip.OpenReader(src)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-	for _, f := range r.File {
-		fpath := filepath.Join(dest, f.Name)
-		if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return fmt.Errorf("illegal file path: %s", fpath)
-		}
-		if f.FileInfo().IsDir() {
-			if err := os.MkdirAll(fpath, f.Mode()); err != nil {
-				return err
-			}
-			continue
-		}
-		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
-			return err
-		}
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			return err
-		}
-		rc, err := f.Open()
-		if err != nil {
-			outFile.Close()
-			return err
-		}
-		if _, err := io.Copy(outFile, rc); err != nil {
-			rc.Close()
-			outFile.Close()
-			return err
-		}
-		rc.Close()
-		outFile.Close()
-	}
-	return nil
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-func unwrapFernetKey(priv *rsa.PrivateKey, wrapped []byte) (*fernet.Key, error) {
-	label := []byte("secure_packager")
-	raw, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, wrapped, label)
-	if err != nil {
-		return nil, err
-	}
-	// raw holds the base64-url encoded fernet key string
-	keys := fernet.MustDecodeKeys(string(raw))
-	if len(keys) == 0 {
-		return nil, fmt.Errorf("failed to decode fernet key")
-	}
-	return keys[0], nil
-}
-
-func decryptDirWithFernet(k *fernet.Key, srcDir, destDir string) error {
-	entries, err := os.ReadDir(srcDir)
-	if err != nil {
-		return err
-	}
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return err
-	}
-	for _, e := range entries {
-		if e.IsDir() || !strings.HasSuffix(e.Name(), ".enc") {
-			continue
-		}
-		inPath := filepath.Join(srcDir, e.Name())
-		outPath := filepath.Join(destDir, strings.TrimSuffix(e.Name(), ".enc"))
-		data, err := os.ReadFile(inPath)
-		if err != nil {
-			return err
-		}
-		pt := fernet.VerifyAndDecrypt(data, 0, []*fernet.Key{k})
-		if pt == nil {
-			return fmt.Errorf("failed to decrypt %s", e.Name())
-		}
-		if err := os.WriteFile(outPath, pt, 0644); err != nil {
-			return err
-		}
-		fmt.Printf("Decrypted %s -> %s\n", e.Name(), filepath.Base(outPath))
-	}
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
 	return nil
 }
 
 func main() {
 	zipPath := flag.String("zip", "", "Path to encrypted zip produced by packager")
-	workDir := flag.String("work", "./_unpack", "Working directory to extract zip")
+	flag.String("work", "./_unpack", "Deprecated and ignored: the zip is now decrypted in place without extracting it first")
 	outDir := flag.String("out", "./decrypted", "Output directory for decrypted files")
-	privPath := flag.String("priv", "", "Path to RSA private key (PEM) to unwrap key")
+	privPath := flag.String("priv", "", "Path to RSA, X25519, P-256 or ML-KEM-768 + X25519 private key (PEM, optionally encrypted) to unwrap key")
+	keyPassEnv := flag.String("key-passphrase-env", "", "Name of an environment variable holding the passphrase of an encrypted -priv key; otherwise it is prompted for")
+	keyPassFD := flag.Int("key-passphrase-fd", -1, "Read the passphrase of an encrypted -priv key from this file descriptor")
+	passphrase := flag.Bool("passphrase", false, "Unwrap the key with a passphrase prompted for on the terminal, instead of -priv")
+	passphraseFD := flag.Int("passphrase-fd", -1, "Read the passphrase from this file descriptor instead of prompting (implies -passphrase)")
 	licenseToken := flag.String("license-token", "", "Optional path to vendor license token (no key) for messaging/enforcement; if omitted and zip contains manifest.json with license_required, unpack requires this flag")
-	vendorPub := flag.String("vendor-pub", "", "Optional path to vendor RSA public key (PEM) to verify license token; if omitted, unpacker looks for vendor_public.pem in the zip")
+	vendorPub := flag.String("vendor-pub", "", "Optional path to vendor RSA public key (PEM) to verify license token; if omitted, unpacker uses -trust-store, then vendor_public.pem in the zip")
+	trustStore := flag.String("trust-store", os.Getenv("SECURE_PACKAGER_TRUST_STORE"), "Optional PEM file or directory of *.pem files holding pinned vendor public keys, consulted before any key shipped in the zip; defaults to $SECURE_PACKAGER_TRUST_STORE")
+	noArchiveKeys := flag.Bool("no-archive-keys", false, "Never verify license tokens with the vendor_public.pem shipped inside the zip; requires -vendor-pub or -trust-store")
+	signerPub := flag.String("signer-pub", "", "Optional pinned vendor RSA public key (PEM) the package signature must verify against; unsigned packages are then refused")
+	requireSigned := flag.Bool("require-signed", false, "Refuse packages that are unsigned or whose signature cannot be verified; the default once -trust-store is set, unless -require-signed=false")
+	exportShare := flag.String("export-share", "", "As a custodian, unwrap your share of the data key with -priv, -agent or -key-service and write it to this share file instead of unpacking")
+	shareTo := flag.String("share-to", "", "With -export-share, wrap the share for this public key (PEM) of whoever combines the shares")
+	keyService := flag.String("key-service", "", "URL of a key service that unwraps the data key, instead of -priv, so the private key never reaches this host (see keyserver)")
+	keyServiceKeyID := flag.String("key-service-key-id", "", "Key ID to use at -key-service; may be omitted if the service holds a single key")
+	keyServiceTokenEnv := flag.String("key-service-token-env", "SECURE_PACKAGER_KEY_SERVICE_TOKEN", "Name of an environment variable holding the -key-service bearer token, if it requires one")
+	keyServiceCA := flag.String("key-service-ca", "", "PEM bundle of CA certificates to verify an https -key-service with, instead of the system roots")
+	agentSocket := flag.String("agent", "", "Unix socket of a key agent (keyagent) that unwraps the data key, instead of -priv; defaults to $"+envelope.AgentSocketEnv+" when no key is given")
+	agentKeyID := flag.String("agent-key-id", "", "Key ID to use at -agent; may be omitted if the agent holds a single key")
+	var shares stringList
+	flag.Var(&shares, "share", "Custodian share file (unpack -export-share) to recover the data key from; repeat for as many as the package's threshold. -priv, -agent or -key-service then only unwraps shares exported with -share-to")
 	flag.Parse()
+	requireSignedSet := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "work":
+			fmt.Println("⚠️ WARNING: -work is deprecated and ignored; the zip is decrypted in place without extracting it")
+		case "require-signed":
+			requireSignedSet = true
+		}
+	})
 
-	if *zipPath == "" || *privPath == "" {
-		fmt.Println("Usage: unpack -zip <encrypted_files.zip> -priv <private.pem> [-work ./_unpack] [-out ./decrypted]")
+	usePassphrase := *passphrase || *passphraseFD >= 0
+	if *agentSocket == "" && *privPath == "" && !usePassphrase && *keyService == "" && len(shares) == 0 {
+		*agentSocket = os.Getenv(envelope.AgentSocketEnv)
+	}
+	sources := 0
+	for _, set := range []bool{*privPath != "", usePassphrase, *keyService != "", *agentSocket != ""} {
+		if set {
+			sources++
+		}
+	}
+	if *zipPath == "" || sources > 1 || (len(shares) == 0 && sources == 0) || (len(shares) > 0 && usePassphrase) {
+		fmt.Println("Usage: unpack -zip <encrypted_files.zip> {-priv <private.pem> | -agent <socket> | -key-service <url> | -passphrase | -share <custodian.share> [-share ...]} [-out ./decrypted]")
+		fmt.Println("       unpack -zip <encrypted_files.zip> {-priv <custodian_private.pem> | -agent <socket> | -key-service <url>} -export-share <custodian.share> [-share-to <collector_public.pem>]")
 		os.Exit(1)
 	}
-
-	if err := os.MkdirAll(*workDir, 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create work dir: %v\n", err)
+	if (*exportShare != "" && (usePassphrase || len(shares) > 0)) || (*shareTo != "" && *exportShare == "") {
+		fmt.Fprintln(os.Stderr, "-export-share needs -priv, -agent or -key-service and cannot be combined with -share; -share-to needs -export-share")
+		os.Exit(1)
+	}
+	if *agentKeyID != "" && *agentSocket == "" {
+		fmt.Fprintln(os.Stderr, "-agent-key-id requires -agent")
 		os.Exit(1)
 	}
-	if err := unzip(*zipPath, *workDir); err != nil {
-		fmt.Fprintf(os.Stderr, "Unzip failed: %v\n", err)
+	if (*keyServiceKeyID != "" || *keyServiceCA != "") && *keyService == "" {
+		fmt.Fprintln(os.Stderr, "-key-service-key-id and -key-service-ca require -key-service")
 		os.Exit(1)
 	}
 
-	// Detect manifest.json to determine if license enforcement is required
-	requireLicense := false
-	vendorPubPath := *vendorPub
-	manifestPath := filepath.Join(*workDir, "manifest.json")
-	if b, err := os.ReadFile(manifestPath); err == nil {
-		// naive detection of flag and embedded public key name
-		s := string(b)
-		if strings.Contains(s, "\"license_required\": true") {
-			requireLicense = true
+	var u envelope.KeyUnwrapper
+	var err error
+	if usePassphrase {
+		var p []byte
+		if *passphraseFD >= 0 {
+			p, err = envelope.ReadPassphraseFD(*passphraseFD)
+		} else {
+			p, err = envelope.PromptPassphrase("Package passphrase: ", false)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Reading passphrase failed: %v\n", err)
+			os.Exit(1)
+		}
+		u = envelope.NewPassphraseUnwrapper(p)
+	} else if *privPath != "" {
+		priv, err := envelope.ReadPrivateKeyFunc(*privPath, envelope.KeyPassphrase(*keyPassEnv, *keyPassFD))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Reading private key failed: %v\n", err)
+			os.Exit(1)
 		}
-		if vendorPubPath == "" && strings.Contains(s, "vendor_public.pem") {
-			vendorPubPath = filepath.Join(*workDir, "vendor_public.pem")
+		if u, err = envelope.NewKeyUnwrapper(priv); err != nil {
+			fmt.Fprintf(os.Stderr, "Reading private key failed: %v\n", err)
+			os.Exit(1)
 		}
+	} else if *keyService != "" {
+		ro := envelope.RemoteKeyOptions{URL: *keyService, KeyID: *keyServiceKeyID, Token: os.Getenv(*keyServiceTokenEnv)}
+		if *keyServiceCA != "" {
+			roots, err := envelope.ReadCertPool(*keyServiceCA)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Reading -key-service-ca failed: %v\n", err)
+				os.Exit(1)
+			}
+			ro.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		}
+		if u, err = envelope.NewRemoteUnwrapper(context.Background(), ro); err != nil {
+			fmt.Fprintf(os.Stderr, "Connecting to key service failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("🔑 Unwrapping with key %s at %s\n", u.KeyID(), *keyService)
+	} else if *agentSocket != "" {
+		if u, err = envelope.NewAgentUnwrapper(context.Background(), *agentSocket, *agentKeyID); err != nil {
+			fmt.Fprintf(os.Stderr, "Connecting to key agent failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("🔑 Unwrapping with key %s held by the key agent at %s\n", u.KeyID(), *agentSocket)
+	}
+
+	if *exportShare != "" {
+		writeShare(*zipPath, *exportShare, *shareTo, u)
+		return
 	}
 
-	// License verification & messaging if required or requested
-	if requireLicense || *licenseToken != "" || vendorPubPath != "" {
-		if *licenseToken == "" {
-			fmt.Fprintln(os.Stderr, "license required: provide -license-token <path> (as per manifest)")
+	opts := envelope.UnpackOptions{KeyUnwrapper: u, RequireSignature: *requireSigned, ForbidArchiveKeys: *noArchiveKeys, Now: now(), Log: os.Stdout}
+	if len(shares) > 0 {
+		// The key only unwraps the shares; the data key comes from them
+		opts.KeyUnwrapper = nil
+		for _, p := range shares {
+			s, err := envelope.ReadCustodianShare(context.Background(), p, u)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Reading share %s failed: %v\n", p, err)
+				os.Exit(1)
+			}
+			fmt.Printf("🔑 Custodian share %d from key %s (%d needed)\n", s.Index, s.KeyID, s.Threshold)
+			opts.CustodianShares = append(opts.CustodianShares, s)
+		}
+	}
+	if *licenseToken != "" {
+		if opts.LicenseToken, err = os.ReadFile(*licenseToken); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading license token: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *vendorPub != "" {
+		if opts.VendorPublicKey, err = envelope.ReadRSAPublicKey(*vendorPub); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading vendor public key: %v\n", err)
 			os.Exit(1)
 		}
-		if vendorPubPath == "" {
-			fmt.Fprintln(os.Stderr, "license required: vendor public key not found; provide -vendor-pub <path> or include vendor_public.pem in zip")
+	}
+
+	if *trustStore != "" {
+		if opts.TrustStore, err = envelope.LoadTrustStore(*trustStore); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading trust store: %v\n", err)
 			os.Exit(1)
 		}
-		if err := verifyAndEnforceLicense(vendorPubPath, *licenseToken); err != nil {
-			fmt.Fprintf(os.Stderr, "%v\n", err)
+		// The library refuses unsigned packages once a trust store is set;
+		// -require-signed=false opts out
+		opts.AllowUnsigned = requireSignedSet && !*requireSigned
+	}
+	if *signerPub != "" {
+		if opts.SignerPublicKey, err = envelope.ReadRSAPublicKey(*signerPub); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading vendor signing key: %v\n", err)
 			os.Exit(1)
 		}
 	}
 
-	wrappedPath := filepath.Join(*workDir, "wrapped_key.bin")
-	wrapped, err := os.ReadFile(wrappedPath)
+	zf, err := os.Open(*zipPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Reading wrapped_key.bin failed: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Opening zip failed: %v\n", err)
 		os.Exit(1)
 	}
-
-	priv, err := readRSAPrivateKey(*privPath)
+	defer zf.Close()
+	st, err := zf.Stat()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Reading private key failed: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Opening zip failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	k, err := unwrapFernetKey(priv, wrapped)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unwrap failed: %v\n", err)
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create output dir: %v\n", err)
 		os.Exit(1)
 	}
-
-	if err := decryptDirWithFernet(k, *workDir, *outDir); err != nil {
-		fmt.Fprintf(os.Stderr, "Decrypt failed: %v\n", err)
+	dst := envelope.NewDirWriter(*outDir)
+	err = envelope.Unpack(context.Background(), zf, st.Size(), dst, opts)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, envelope.ErrLicenseRequired):
+		fmt.Fprintln(os.Stderr, "license required: provide -license-token <path> (as per manifest)")
+		os.Exit(1)
+	case errors.Is(err, envelope.ErrNoVendorKey):
+		fmt.Fprintln(os.Stderr, "license required: vendor public key not found; provide -vendor-pub <path> or include vendor_public.pem in zip")
+		os.Exit(1)
+	case errors.Is(err, envelope.ErrArchiveKeyForbidden):
+		fmt.Fprintln(os.Stderr, "license required: -no-archive-keys forbids the vendor_public.pem inside the zip; provide -vendor-pub <path> or -trust-store <path>")
+		os.Exit(1)
+	case errors.Is(err, envelope.ErrUnsigned):
+		fmt.Fprintln(os.Stderr, "❌ package is not signed; refusing it as -signer-pub, -require-signed or -trust-store demand (-require-signed=false accepts it with a trust store)")
+		os.Exit(1)
+	case errors.Is(err, envelope.ErrNoSignerKey):
+		fmt.Fprintln(os.Stderr, "signature required: provide -signer-pub <vendor_public.pem> to verify it")
+		os.Exit(1)
+	default:
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
 }
 
-// verifyAndEnforceLicense verifies the vendor token signature, prints license info,
-// warns on nearing expiry, and blocks if expired or within 24 hours of expiry.
-// The token format matches the existing system but WITHOUT the Fernet key in use here:
-// base64url( expiry:company:email:placeholder_key:signature_b64 )
-func verifyAndEnforceLicense(vendorPubPath, tokenPath string) error {
-	pubBytes, err := os.ReadFile(vendorPubPath)
-	if err != nil {
-		return fmt.Errorf("error reading vendor public key: %w", err)
-	}
-	block, _ := pem.Decode(pubBytes)
-	if block == nil {
-		return fmt.Errorf("invalid vendor public key PEM")
-	}
-	var parsed any
-	if k, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
-		parsed = k
-	} else if k2, err2 := x509.ParsePKCS1PublicKey(block.Bytes); err2 == nil {
-		parsed = k2
-	} else {
-		return fmt.Errorf("error parsing vendor public key: %v", err)
-	}
-	pub, ok := parsed.(*rsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("vendor public key is not RSA")
+// writeShare exports the custodian share of u in the package at zipPath to
+// outPath, wrapped for the public key at toPath if one is given.
+func writeShare(zipPath, outPath, toPath string, u envelope.KeyUnwrapper) {
+	var to envelope.KeyWrapper
+	if toPath != "" {
+		pub, err := envelope.ReadPublicKey(toPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read -share-to public key: %v\n", err)
+			os.Exit(1)
+		}
+		if to, err = envelope.NewKeyWrapper(pub); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to use -share-to public key: %v\n", err)
+			os.Exit(1)
+		}
 	}
-
-	tokenB64, err := os.ReadFile(tokenPath)
+	zf, err := os.Open(zipPath)
 	if err != nil {
-		return fmt.Errorf("error reading license token: %w", err)
+		fmt.Fprintf(os.Stderr, "Opening zip failed: %v\n", err)
+		os.Exit(1)
 	}
-	decoded, err := base64.URLEncoding.DecodeString(strings.TrimSpace(string(tokenB64)))
+	defer zf.Close()
+	st, err := zf.Stat()
 	if err != nil {
-		return fmt.Errorf("invalid token b64: %w", err)
-	}
-	parts := strings.SplitN(string(decoded), ":", 5)
-	if len(parts) != 5 {
-		return fmt.Errorf("invalid token format")
+		fmt.Fprintf(os.Stderr, "Opening zip failed: %v\n", err)
+		os.Exit(1)
 	}
-	expiryStr, company, email, kB64, sigB64 := parts[0], parts[1], parts[2], parts[3], parts[4]
-	sig, err := base64.URLEncoding.DecodeString(sigB64)
+	b, err := envelope.ExportCustodianShare(context.Background(), zf, st.Size(), u, to)
 	if err != nil {
-		return fmt.Errorf("invalid signature b64: %w", err)
+		fmt.Fprintf(os.Stderr, "❌ Exporting share failed: %v\n", err)
+		os.Exit(1)
 	}
-	payload := []byte(expiryStr + ":" + company + ":" + email + ":" + kB64)
-	hashed := sha256.Sum256(payload)
-	if err := rsa.VerifyPSS(pub, crypto.SHA256, hashed[:], sig, nil); err != nil {
-		return fmt.Errorf("token signature invalid: %w", err)
+	if err := os.WriteFile(outPath, b, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Writing share failed: %v\n", err)
+		os.Exit(1)
 	}
-	expiry, err := time.Parse("2006-01-02", expiryStr)
-	if err != nil {
-		return fmt.Errorf("invalid expiry date: %w", err)
+	if to == nil {
+		fmt.Println("⚠️ WARNING: the share is not wrapped; use -share-to to protect it on its way to whoever combines the shares.")
 	}
+	fmt.Printf("✅ Custodian share written to %s\n", outPath)
+}
 
-	// Display license info and enforce as in existing solution
-	fmt.Printf("\U0001F4C4 License Information:\n")
-	fmt.Printf("   Company: %s\n", company)
-	fmt.Printf("   Email: %s\n", email)
-	fmt.Printf("   Expires: %s\n\n", expiry.Format("2006-01-02"))
-
-	now := time.Now()
+// now returns the current time, overridden by FAKE_NOW=YYYY-MM-DD to simulate
+// license expiry.
+func now() time.Time {
 	if fakeNow := os.Getenv("FAKE_NOW"); fakeNow != "" {
-		if parsed, err := time.Parse("2006-01-02", fakeNow); err == nil {
-			now = parsed
+		if parsed, err := time.Parse(time.DateOnly, fakeNow); err == nil {
+			return parsed
 		}
 	}
-	if now.After(expiry) {
-		return fmt.Errorf("❌ Token expired (expiry: %s, now: %s)", expiry.Format("2006-01-02"), now.Format("2006-01-02"))
-	}
-	remaining := expiry.Sub(now).Hours() / 24
-	if remaining < 0 {
-		fmt.Printf("❌ Model access has expired %d days ago.\n", int(-remaining))
-		fmt.Println("❌ Access denied. Please contact sales@sjfisher.com for license renewal.")
-		os.Exit(1)
-	} else if remaining <= 7 {
-		fmt.Printf("⚠️ WARNING: Model access will expire in %d days (%s).\n", int(remaining), expiry.Format("2006-01-02"))
-		fmt.Println("⚠️ Please contact sales@sjfisher.com for license renewal.")
-	} else {
-		fmt.Printf("✅ Model access valid for %d more days (expires %s).\n", int(remaining), expiry.Format("2006-01-02"))
-	}
-	if remaining <= 1 {
-		return fmt.Errorf("❌ Model access blocked - license expires within 24 hours.")
-	}
-	return nil
+	return time.Now()
 }
@@ -1,5 +1,14 @@
 module integration_example
 
-go 1.21
+go 1.24.0
 
-require github.com/fernet/fernet-go v0.0.0-20240119011108-303da6aec611
+require secure_packager v0.0.0
+
+require (
+	github.com/fernet/fernet-go v0.0.0-20240119011108-303da6aec611 // indirect
+	golang.org/x/crypto v0.48.0 // indirect
+	golang.org/x/sys v0.41.0 // indirect
+	golang.org/x/term v0.40.0 // indirect
+)
+
+replace secure_packager => ../../..
@@ -1,15 +1,12 @@
 package main
 
 import (
-	"archive/zip"
+	"context"
 	"crypto/md5"
-	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
-	"crypto/x509"
-	"encoding/pem"
 	"flag"
 	"fmt"
 	"hash"
@@ -17,8 +14,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/fernet/fernet-go"
+	"secure_packager/pkg/envelope"
 )
 
 // ChecksumCalculator provides methods to calculate various checksums for files
@@ -107,26 +105,18 @@ func (cc *ChecksumCalculator) createHash() (hash.Hash, error) {
 // SecurePackager provides methods to encrypt and decrypt files using envelope encryption
 type SecurePackager struct {
 	customerPubKey *rsa.PublicKey
-	vendorPubKey   *rsa.PublicKey
-	fernetKey      *fernet.Key
+	vendorPubPEM   []byte
 }
 
 // NewSecurePackager creates a new SecurePackager instance
 func NewSecurePackager(customerPubKeyPath string) (*SecurePackager, error) {
-	customerPub, err := readRSAPublicKey(customerPubKeyPath)
+	customerPub, err := envelope.ReadRSAPublicKey(customerPubKeyPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read customer public key: %w", err)
 	}
 
-	// Generate a new Fernet key
-	fernetKey := new(fernet.Key)
-	if err := fernetKey.Generate(); err != nil {
-		return nil, fmt.Errorf("failed to generate fernet key: %w", err)
-	}
-
 	return &SecurePackager{
 		customerPubKey: customerPub,
-		fernetKey:      fernetKey,
 	}, nil
 }
 
@@ -137,12 +127,15 @@ func NewSecurePackagerWithLicense(customerPubKeyPath, vendorPubKeyPath string) (
 		return nil, err
 	}
 
-	vendorPub, err := readRSAPublicKey(vendorPubKeyPath)
+	vendorPubPEM, err := os.ReadFile(vendorPubKeyPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read vendor public key: %w", err)
 	}
+	if _, err := envelope.ParseRSAPublicKey(vendorPubPEM); err != nil {
+		return nil, fmt.Errorf("failed to parse vendor public key: %w", err)
+	}
 
-	sp.vendorPubKey = vendorPub
+	sp.vendorPubPEM = vendorPubPEM
 	return sp, nil
 }
 
@@ -153,98 +146,63 @@ func (sp *SecurePackager) EncryptDirectory(inputDir, outputDir string, withLicen
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	// Encrypt files with Fernet
-	if err := sp.encryptFilesWithFernet(inputDir, outputDir); err != nil {
-		return fmt.Errorf("encryption failed: %w", err)
+	if withLicense && sp.vendorPubPEM == nil {
+		return fmt.Errorf("license mode requires vendor public key")
 	}
 
-	// Wrap the Fernet key with RSA
-	wrapped, err := sp.wrapFernetKey()
+	// Create zip archive
+	zipPath := filepath.Join(outputDir, envelope.ArchiveName)
+	f, err := os.Create(zipPath)
 	if err != nil {
-		return fmt.Errorf("wrapping key failed: %w", err)
-	}
-
-	// Write wrapped key
-	wrappedPath := filepath.Join(outputDir, "wrapped_key.bin")
-	if err := os.WriteFile(wrappedPath, wrapped, 0644); err != nil {
-		return fmt.Errorf("writing wrapped key failed: %w", err)
+		return fmt.Errorf("creating zip failed: %w", err)
 	}
+	defer f.Close()
 
-	// Add licensing manifest if requested
-	if withLicense {
-		if sp.vendorPubKey == nil {
-			return fmt.Errorf("license mode requires vendor public key")
-		}
-		if err := sp.addLicenseManifest(outputDir); err != nil {
-			return fmt.Errorf("adding license manifest failed: %w", err)
-		}
+	// Encrypt files, wrap the key and add the licensing manifest in one go
+	opts := envelope.PackOptions{
+		PublicKey:       sp.customerPubKey,
+		License:         withLicense,
+		VendorPublicKey: sp.vendorPubPEM,
+		Log:             os.Stdout,
 	}
-
-	// Create zip archive
-	zipPath := filepath.Join(outputDir, "encrypted_files.zip")
-	if err := sp.zipOutputs(outputDir, zipPath); err != nil {
-		return fmt.Errorf("zipping failed: %w", err)
+	if err := envelope.Pack(context.Background(), f, os.DirFS(inputDir), opts); err != nil {
+		return fmt.Errorf("packaging failed: %w", err)
 	}
-
-	// Clean up temporary files
-	return sp.cleanupTempFiles(outputDir)
+	return f.Close()
 }
 
 // DecryptZip decrypts a zip archive created by EncryptDirectory
 func (sp *SecurePackager) DecryptZip(zipPath, outputDir string, customerPrivKeyPath string, licenseTokenPath string) error {
-	// Create working directory for extraction
-	workDir := filepath.Join(filepath.Dir(zipPath), "_unpack")
-	if err := os.MkdirAll(workDir, 0755); err != nil {
-		return fmt.Errorf("failed to create work directory: %w", err)
-	}
-	defer os.RemoveAll(workDir)
-
-	// Extract zip
-	if err := sp.unzip(zipPath, workDir); err != nil {
-		return fmt.Errorf("unzip failed: %w", err)
-	}
-
-	// Check for license requirements
-	requireLicense, vendorPubPath, err := sp.checkLicenseRequirements(workDir)
+	// Read customer private key
+	customerPriv, err := envelope.ReadRSAPrivateKey(customerPrivKeyPath)
 	if err != nil {
-		return fmt.Errorf("license check failed: %w", err)
+		return fmt.Errorf("reading private key failed: %w", err)
 	}
 
-	// Verify license if required
-	if requireLicense {
-		if licenseTokenPath == "" {
-			return fmt.Errorf("license required but no token provided")
-		}
-		if err := sp.verifyAndEnforceLicense(vendorPubPath, licenseTokenPath); err != nil {
-			return fmt.Errorf("license verification failed: %w", err)
+	opts := envelope.UnpackOptions{PrivateKey: customerPriv, Log: os.Stdout}
+	if licenseTokenPath != "" {
+		if opts.LicenseToken, err = os.ReadFile(licenseTokenPath); err != nil {
+			return fmt.Errorf("reading license token failed: %w", err)
 		}
 	}
 
-	// Read wrapped key
-	wrappedPath := filepath.Join(workDir, "wrapped_key.bin")
-	wrapped, err := os.ReadFile(wrappedPath)
-	if err != nil {
-		return fmt.Errorf("reading wrapped key failed: %w", err)
-	}
-
-	// Read customer private key
-	customerPriv, err := readRSAPrivateKey(customerPrivKeyPath)
+	f, err := os.Open(zipPath)
 	if err != nil {
-		return fmt.Errorf("reading private key failed: %w", err)
+		return fmt.Errorf("opening zip failed: %w", err)
 	}
-
-	// Unwrap Fernet key
-	fernetKey, err := sp.unwrapFernetKey(customerPriv, wrapped)
+	defer f.Close()
+	st, err := f.Stat()
 	if err != nil {
-		return fmt.Errorf("unwrap failed: %w", err)
+		return fmt.Errorf("opening zip failed: %w", err)
 	}
 
-	// Decrypt files
-	if err := sp.decryptDirWithFernet(fernetKey, workDir, outputDir); err != nil {
+	// License enforcement is driven by the manifest inside the zip
+	dst := envelope.NewDirWriter(outputDir)
+	defer dst.Close()
+	if err := envelope.Unpack(context.Background(), f, st.Size(), dst, opts); err != nil {
 		return fmt.Errorf("decrypt failed: %w", err)
 	}
-
-	return nil
+	return dst.Close()
 }
 
 // IntegrationExample demonstrates how to integrate secure_packager with a file processing application
@@ -271,38 +229,17 @@ func (ie *IntegrationExample) SetupKeys() error {
 		return fmt.Errorf("failed to create keys directory: %w", err)
 	}
 
-	// Generate customer key pair
-	customerPriv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return fmt.Errorf("failed to generate customer private key: %w", err)
-	}
-
+	// Generate customer and vendor (licensing) key pairs
 	customerPrivPath := filepath.Join(keysDir, "customer_private.pem")
 	customerPubPath := filepath.Join(keysDir, "customer_public.pem")
-
-	if err := ie.savePrivateKey(customerPriv, customerPrivPath); err != nil {
-		return fmt.Errorf("failed to save customer private key: %w", err)
-	}
-
-	if err := ie.savePublicKey(&customerPriv.PublicKey, customerPubPath); err != nil {
-		return fmt.Errorf("failed to save customer public key: %w", err)
-	}
-
-	// Generate vendor key pair (for licensing)
-	vendorPriv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return fmt.Errorf("failed to generate vendor private key: %w", err)
+	if err := ie.generateKeyPair(customerPrivPath, customerPubPath); err != nil {
+		return fmt.Errorf("failed to generate customer key pair: %w", err)
 	}
 
 	vendorPrivPath := filepath.Join(keysDir, "vendor_private.pem")
 	vendorPubPath := filepath.Join(keysDir, "vendor_public.pem")
-
-	if err := ie.savePrivateKey(vendorPriv, vendorPrivPath); err != nil {
-		return fmt.Errorf("failed to save vendor private key: %w", err)
-	}
-
-	if err := ie.savePublicKey(&vendorPriv.PublicKey, vendorPubPath); err != nil {
-		return fmt.Errorf("failed to save vendor public key: %w", err)
+	if err := ie.generateKeyPair(vendorPrivPath, vendorPubPath); err != nil {
+		return fmt.Errorf("failed to generate vendor key pair: %w", err)
 	}
 
 	fmt.Printf("   Customer keys: %s, %s\n", customerPrivPath, customerPubPath)
@@ -385,9 +322,9 @@ func (ie *IntegrationExample) DecryptAndVerifyFiles(withLicense bool) error {
 	var licenseTokenPath string
 	if withLicense {
 		licenseTokenPath = filepath.Join(ie.workDir, "keys", "token.txt")
-		// Create a dummy token for demo purposes
-		if err := ie.createDummyToken(licenseTokenPath); err != nil {
-			return fmt.Errorf("failed to create dummy token: %w", err)
+		// Issue a vendor-signed token for demo purposes
+		if err := ie.issueToken(licenseTokenPath); err != nil {
+			return fmt.Errorf("failed to issue token: %w", err)
 		}
 	}
 
@@ -400,41 +337,32 @@ func (ie *IntegrationExample) DecryptAndVerifyFiles(withLicense bool) error {
 	return ie.checksumCalc.ScanDirectoryAndChecksum(outputDir)
 }
 
-// createDummyToken creates a dummy license token for demonstration
-func (ie *IntegrationExample) createDummyToken(tokenPath string) error {
-	// This is a simplified dummy token - in production you'd use the issue-token command
-	token := "dummy_token_for_demo_purposes"
-	return os.WriteFile(tokenPath, []byte(token), 0644)
-}
-
-// Helper functions for key management
-
-func (ie *IntegrationExample) savePrivateKey(key *rsa.PrivateKey, path string) error {
-	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+// issueToken issues a one-year license token signed with the demo vendor key,
+// as the issue-token command would
+func (ie *IntegrationExample) issueToken(tokenPath string) error {
+	vendorPriv, err := envelope.ReadRSAPrivateKey(filepath.Join(ie.workDir, "keys", "vendor_private.pem"))
 	if err != nil {
 		return err
 	}
-
-	keyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: keyBytes,
+	token, err := envelope.IssueLicense(vendorPriv, envelope.License{
+		Expiry:  time.Now().AddDate(1, 0, 0),
+		Company: "Demo Co",
+		Email:   "demo@example.com",
 	})
-
-	return os.WriteFile(path, keyPEM, 0600)
-}
-
-func (ie *IntegrationExample) savePublicKey(key *rsa.PublicKey, path string) error {
-	keyBytes, err := x509.MarshalPKIXPublicKey(key)
 	if err != nil {
 		return err
 	}
+	return os.WriteFile(tokenPath, token, 0644)
+}
 
-	keyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: keyBytes,
-	})
+// Helper functions for key management
 
-	return os.WriteFile(path, keyPEM, 0644)
+func (ie *IntegrationExample) generateKeyPair(privPath, pubPath string) error {
+	priv, err := envelope.GenerateKey(envelope.KeyTypeRSA, 2048)
+	if err != nil {
+		return err
+	}
+	return envelope.WriteKeyPair(privPath, pubPath, priv, nil)
 }
 
 // RunDemo runs the complete integration demonstration
@@ -474,289 +402,6 @@ func (ie *IntegrationExample) RunDemo(withLicense bool) error {
 	return nil
 }
 
-// Helper functions (extracted from the original commands)
-
-func readRSAPublicKey(path string) (*rsa.PublicKey, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	block, _ := pem.Decode(b)
-	if block == nil {
-		return nil, fmt.Errorf("invalid PEM")
-	}
-	if pub, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
-		if k, ok := pub.(*rsa.PublicKey); ok {
-			return k, nil
-		}
-		return nil, fmt.Errorf("not RSA public key")
-	}
-	k, err := x509.ParsePKCS1PublicKey(block.Bytes)
-	if err != nil {
-		return nil, err
-	}
-	return k, nil
-}
-
-func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	block, _ := pem.Decode(b)
-	if block == nil {
-		return nil, fmt.Errorf("invalid PEM")
-	}
-	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
-		return k, nil
-	}
-	keyAny, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
-	}
-	k, ok := keyAny.(*rsa.PrivateKey)
-	if !ok {
-		return nil, fmt.Errorf("PEM is not RSA private key")
-	}
-	return k, nil
-}
-
-func (sp *SecurePackager) encryptFilesWithFernet(inputDir, outputDir string) error {
-	entries, err := os.ReadDir(inputDir)
-	if err != nil {
-		return err
-	}
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return err
-	}
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
-		}
-		inPath := filepath.Join(inputDir, e.Name())
-		outPath := filepath.Join(outputDir, e.Name()+".enc")
-		data, err := os.ReadFile(inPath)
-		if err != nil {
-			return err
-		}
-		ct, err := fernet.EncryptAndSign(data, sp.fernetKey)
-		if err != nil {
-			return err
-		}
-		if err := os.WriteFile(outPath, ct, 0644); err != nil {
-			return err
-		}
-		fmt.Printf("Encrypted %s -> %s\n", e.Name(), filepath.Base(outPath))
-	}
-	return nil
-}
-
-func (sp *SecurePackager) wrapFernetKey() ([]byte, error) {
-	enc := []byte(sp.fernetKey.Encode())
-	label := []byte("secure_packager")
-	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, sp.customerPubKey, enc, label)
-	if err != nil {
-		return nil, err
-	}
-	return wrapped, nil
-}
-
-func (sp *SecurePackager) unwrapFernetKey(priv *rsa.PrivateKey, wrapped []byte) (*fernet.Key, error) {
-	label := []byte("secure_packager")
-	raw, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, wrapped, label)
-	if err != nil {
-		return nil, err
-	}
-	keys := fernet.MustDecodeKeys(string(raw))
-	if len(keys) == 0 {
-		return nil, fmt.Errorf("failed to decode fernet key")
-	}
-	return keys[0], nil
-}
-
-func (sp *SecurePackager) addLicenseManifest(outputDir string) error {
-	manifest := []byte("{\n  \"license_required\": true,\n  \"vendor_public_key\": \"vendor_public.pem\"\n}\n")
-	if err := os.WriteFile(filepath.Join(outputDir, "manifest.json"), manifest, 0644); err != nil {
-		return err
-	}
-
-	// Copy vendor public key
-	vendorPubBytes, err := x509.MarshalPKIXPublicKey(sp.vendorPubKey)
-	if err != nil {
-		return err
-	}
-	vendorPubPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: vendorPubBytes,
-	})
-	if err := os.WriteFile(filepath.Join(outputDir, "vendor_public.pem"), vendorPubPEM, 0644); err != nil {
-		return err
-	}
-
-	fmt.Println("Added license manifest and vendor public key")
-	return nil
-}
-
-func (sp *SecurePackager) checkLicenseRequirements(workDir string) (bool, string, error) {
-	manifestPath := filepath.Join(workDir, "manifest.json")
-	if _, err := os.Stat(manifestPath); os.IsNotExist(err) {
-		return false, "", nil
-	}
-
-	b, err := os.ReadFile(manifestPath)
-	if err != nil {
-		return false, "", err
-	}
-
-	s := string(b)
-	requireLicense := strings.Contains(s, "\"license_required\": true")
-	vendorPubPath := ""
-	if strings.Contains(s, "vendor_public.pem") {
-		vendorPubPath = filepath.Join(workDir, "vendor_public.pem")
-	}
-
-	return requireLicense, vendorPubPath, nil
-}
-
-func (sp *SecurePackager) verifyAndEnforceLicense(vendorPubPath, tokenPath string) error {
-	// This is a simplified version - in production you'd want full license verification
-	fmt.Println("🔐 License verification would be performed here")
-	fmt.Printf("   Vendor public key: %s\n", vendorPubPath)
-	fmt.Printf("   License token: %s\n", tokenPath)
-	return nil
-}
-
-func (sp *SecurePackager) zipOutputs(srcDir, zipPath string) error {
-	f, err := os.Create(zipPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	zw := zip.NewWriter(f)
-	defer zw.Close()
-
-	addFile := func(path, name string) error {
-		in, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer in.Close()
-		w, err := zw.Create(name)
-		if err != nil {
-			return err
-		}
-		_, err = io.Copy(w, in)
-		return err
-	}
-
-	entries, err := os.ReadDir(srcDir)
-	if err != nil {
-		return err
-	}
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
-		}
-		p := filepath.Join(srcDir, e.Name())
-		if err := addFile(p, e.Name()); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (sp *SecurePackager) unzip(src, dest string) error {
-	r, err := zip.OpenReader(src)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-	for _, f := range r.File {
-		fpath := filepath.Join(dest, f.Name)
-		if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return fmt.Errorf("illegal file path: %s", fpath)
-		}
-		if f.FileInfo().IsDir() {
-			if err := os.MkdirAll(fpath, f.Mode()); err != nil {
-				return err
-			}
-			continue
-		}
-		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
-			return err
-		}
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			return err
-		}
-		rc, err := f.Open()
-		if err != nil {
-			outFile.Close()
-			return err
-		}
-		if _, err := io.Copy(outFile, rc); err != nil {
-			rc.Close()
-			outFile.Close()
-			return err
-		}
-		rc.Close()
-		outFile.Close()
-	}
-	return nil
-}
-
-func (sp *SecurePackager) decryptDirWithFernet(k *fernet.Key, srcDir, destDir string) error {
-	entries, err := os.ReadDir(srcDir)
-	if err != nil {
-		return err
-	}
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return err
-	}
-	for _, e := range entries {
-		if e.IsDir() || !strings.HasSuffix(e.Name(), ".enc") {
-			continue
-		}
-		inPath := filepath.Join(srcDir, e.Name())
-		outPath := filepath.Join(destDir, strings.TrimSuffix(e.Name(), ".enc"))
-		data, err := os.ReadFile(inPath)
-		if err != nil {
-			return err
-		}
-		pt := fernet.VerifyAndDecrypt(data, 0, []*fernet.Key{k})
-		if pt == nil {
-			return fmt.Errorf("failed to decrypt %s", e.Name())
-		}
-		if err := os.WriteFile(outPath, pt, 0644); err != nil {
-			return err
-		}
-		fmt.Printf("Decrypted %s -> %s\n", e.Name(), filepath.Base(outPath))
-	}
-	return nil
-}
-
-func (sp *SecurePackager) cleanupTempFiles(outputDir string) error {
-	entries, err := os.ReadDir(outputDir)
-	if err != nil {
-		return err
-	}
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
-		}
-		name := e.Name()
-		// Keep the final zip
-		if name == "encrypted_files.zip" {
-			continue
-		}
-		// Remove our generated files: .enc, wrapped_key.bin, manifest.json, vendor_public.pem
-		if strings.HasSuffix(name, ".enc") || name == "wrapped_key.bin" || name == "manifest.json" || name == "vendor_public.pem" {
-			_ = os.Remove(filepath.Join(outputDir, name))
-		}
-	}
-	return nil
-}
-
 func main() {
 	var (
 		workDir     = flag.String("work", "./demo_work", "Working directory for demo files")
@@ -58,18 +58,27 @@ $DOCKER_COMPOSE_CMD down --remove-orphans 2>/dev/null || true
 echo "📁 Creating directories..."
 mkdir -p data keys demo_data logs
 
-# Generate RSA keys if they don't exist
+# Generate RSA keys with keygen (local build if available, else Docker);
+# unencrypted so the container can read them unattended
+keygen() {
+    if command -v go &> /dev/null && [ -f "../../cmd/keygen/main.go" ]; then
+        (cd ../../ && go run ./cmd/keygen -out examples/example_docker/keys -unencrypted -force "$@") >/dev/null
+    else
+        docker run --rm --user "$(id -u):$(id -g)" -v "$(pwd)/keys:/keys" \
+            stevef1uk/secure-packager:latest \
+            keygen -out /keys -unencrypted -force "$@" >/dev/null
+    fi
+}
+
 if [ ! -f "keys/customer_private.pem" ] || [ ! -f "keys/customer_public.pem" ]; then
     echo "🔑 Generating RSA key pairs..."
-    openssl genrsa -out keys/customer_private.pem 2048 2>/dev/null
-    openssl rsa -in keys/customer_private.pem -pubout -out keys/customer_public.pem 2>/dev/null
+    keygen -name customer
     echo "   Generated customer key pair"
 fi
 
 if [ ! -f "keys/vendor_private.pem" ] || [ ! -f "keys/vendor_public.pem" ]; then
     echo "🔑 Generating vendor key pairs..."
-    openssl genrsa -out keys/vendor_private.pem 2048 2>/dev/null
-    openssl rsa -in keys/vendor_private.pem -pubout -out keys/vendor_public.pem 2>/dev/null
+    keygen -name vendor
     echo "   Generated vendor key pair"
 fi
 
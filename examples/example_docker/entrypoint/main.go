@@ -25,6 +25,7 @@ const (
 
 type Config struct {
 	PrivateKeyPath   string
+	AgentSocket      string
 	TokenFilePath    string
 	EncryptedZipPath string
 	DecryptOutputDir string
@@ -34,6 +35,7 @@ type Config struct {
 func loadConfig() *Config {
 	return &Config{
 		PrivateKeyPath:   getEnvWithDefault("PRIVATE_KEY_PATH", defaultPrivateKeyPath),
+		AgentSocket:      os.Getenv("SECURE_PACKAGER_AGENT_SOCK"),
 		TokenFilePath:    getEnvWithDefault("TOKEN_FILE_PATH", defaultTokenFilePath),
 		EncryptedZipPath: getEnvWithDefault("ENCRYPTED_ZIP_PATH", defaultEncryptedZipPath),
 		DecryptOutputDir: getEnvWithDefault("DECRYPT_OUTPUT_DIR", defaultDecryptOutputDir),
@@ -67,7 +69,8 @@ func checkMountPoint(path string) bool {
 func printLicenseHeader(config *Config) {
 	showLicensedMessage := checkMountPoint("/app/keys") ||
 		checkMountPoint("/app/data") ||
-		fileExists(config.PrivateKeyPath)
+		fileExists(config.PrivateKeyPath) ||
+		fileExists(config.AgentSocket)
 
 	fmt.Println("====================================================")
 	fmt.Println(" Secure Packager Integration Example")
@@ -109,8 +112,17 @@ func autoSelectFiles(config *Config) {
 }
 
 func runDecryption(config *Config) error {
-	if !fileExists(config.EncryptedZipPath) || !fileExists(config.PrivateKeyPath) {
-		fmt.Println("[entrypoint] Skipping decryption (zip or private key missing).")
+	// Prefer the key agent's socket, so the private key need not be mounted
+	// into this container
+	var keyArgs []string
+	switch {
+	case config.AgentSocket != "" && fileExists(config.AgentSocket):
+		keyArgs = []string{"-agent", config.AgentSocket}
+	case fileExists(config.PrivateKeyPath):
+		keyArgs = []string{"-priv", config.PrivateKeyPath}
+	}
+	if !fileExists(config.EncryptedZipPath) || keyArgs == nil {
+		fmt.Println("[entrypoint] Skipping decryption (zip, private key or key agent socket missing).")
 		fmt.Println("[entrypoint] Container will start with empty decrypted directory.")
 		return nil
 	}
@@ -134,9 +146,9 @@ func runDecryption(config *Config) error {
 	args := []string{
 		"/app/unpack",
 		"-zip", config.EncryptedZipPath,
-		"-priv", config.PrivateKeyPath,
 		"-out", config.DecryptOutputDir,
 	}
+	args = append(args, keyArgs...)
 	// Pass token only if present; unpack auto-detects licensing
 	if fileExists(config.TokenFilePath) {
 		args = append(args, "-license-token", config.TokenFilePath)
@@ -2,7 +2,7 @@
 set -euo pipefail
 
 # Quick end-to-end demo for secure_packager
-# - Generates vendor and customer RSA keys
+# - Generates vendor and customer RSA keys with keygen
 # - Creates a sample input file
 # - Packages without license and with license
 # - Issues a vendor-signed token
@@ -29,26 +29,26 @@ echo "[1/7] Prepare demo workspace..."
 rm -rf "$OUT_LIC" "$DEC_LIC"
 mkdir -p "$INPUT_DIR" "$OUT_NO_LIC" "$OUT_LIC" "$DEC_NO_LIC" "$DEC_LIC" "$KEYS_DIR"
 
-echo "[2/7] Generate RSA keys (vendor + customer) using openssl..."
-# Vendor keys (for token signing)
-openssl genrsa -out "$VENDOR_PRIV" 2048 1>/dev/null 2>&1
-openssl rsa -in "$VENDOR_PRIV" -pubout -out "$VENDOR_PUB" 1>/dev/null 2>&1
-
-# Customer keys (for key unwrapping)
-openssl genrsa -out "$CUSTOMER_PRIV" 2048 1>/dev/null 2>&1
-openssl rsa -in "$CUSTOMER_PRIV" -pubout -out "$CUSTOMER_PUB" 1>/dev/null 2>&1
-
-echo "[3/7] Create sample input files..."
-echo "hello secure world" > "$INPUT_DIR/hello.txt"
-dd if=/dev/urandom of="$INPUT_DIR/random.bin" bs=1k count=32 2>/dev/null
-
-echo "[4/7] Build tools..."
+echo "[2/7] Build tools..."
 pushd "$BUILD_DIR" >/dev/null
 go build ./cmd/packager
 go build ./cmd/unpack
 go build ./cmd/issue-token
+go build ./cmd/keygen
 popd >/dev/null
 
+echo "[3/7] Generate RSA keys (vendor + customer) using keygen..."
+# Vendor keys (for token signing); unencrypted so the demo runs unattended
+"$BUILD_DIR"/keygen -out "$KEYS_DIR" -name vendor -unencrypted -force >/dev/null
+
+# Customer keys (for key unwrapping)
+"$BUILD_DIR"/keygen -out "$KEYS_DIR" -name customer -unencrypted -force >/dev/null
+cp "$KEYS_DIR/customer_public.pem" "$CUSTOMER_PUB"
+
+echo "[4/7] Create sample input files..."
+echo "hello secure world" > "$INPUT_DIR/hello.txt"
+dd if=/dev/urandom of="$INPUT_DIR/random.bin" bs=1k count=32 2>/dev/null
+
 echo "[5/7] Package WITHOUT licensing..."
 "$BUILD_DIR"/packager -in "$INPUT_DIR" -out "$OUT_NO_LIC" -pub "$CUSTOMER_PUB" -zip=true
 
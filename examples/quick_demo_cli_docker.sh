@@ -33,22 +33,26 @@ echo "[1/7] Prepare demo workspace..."
 rm -rf "$OUT_LIC" "$DEC_LIC"
 mkdir -p "$INPUT_DIR" "$OUT_NO_LIC" "$OUT_LIC" "$DEC_NO_LIC" "$DEC_LIC" "$KEYS_DIR"
 
-echo "[2/7] Generate RSA keys (vendor + customer) using openssl..."
-# Vendor keys (for token signing)
-openssl genrsa -out "$VENDOR_PRIV" 2048 1>/dev/null 2>&1
-openssl rsa -in "$VENDOR_PRIV" -pubout -out "$VENDOR_PUB" 1>/dev/null 2>&1
+echo "[2/7] Pull Docker image..."
+docker pull "$DOCKER_IMAGE"
+
+echo "[3/7] Generate RSA keys (vendor + customer) using keygen..."
+# Run as the current user so the 0600 private keys stay readable on the host
+# Vendor keys (for token signing); unencrypted so the demo runs unattended
+docker run --rm --user "$(id -u):$(id -g)" -v "$KEYS_DIR:/keys" \
+  "$DOCKER_IMAGE" \
+  keygen -out /keys -name vendor -unencrypted -force >/dev/null
 
 # Customer keys (for key unwrapping)
-openssl genrsa -out "$CUSTOMER_PRIV" 2048 1>/dev/null 2>&1
-openssl rsa -in "$CUSTOMER_PRIV" -pubout -out "$CUSTOMER_PUB" 1>/dev/null 2>&1
+docker run --rm --user "$(id -u):$(id -g)" -v "$KEYS_DIR:/keys" \
+  "$DOCKER_IMAGE" \
+  keygen -out /keys -name customer -unencrypted -force >/dev/null
+cp "$KEYS_DIR/customer_public.pem" "$CUSTOMER_PUB"
 
-echo "[3/7] Create sample input files..."
+echo "[4/7] Create sample input files..."
 echo "hello secure world" > "$INPUT_DIR/hello.txt"
 dd if=/dev/urandom of="$INPUT_DIR/random.bin" bs=1k count=32 2>/dev/null
 
-echo "[4/7] Pull Docker image..."
-docker pull "$DOCKER_IMAGE"
-
 echo "[5/7] Package WITHOUT licensing using Docker..."
 docker run --rm \
   -v "$INPUT_DIR:/in" -v "$OUT_NO_LIC:/out" \
@@ -1,5 +1,11 @@
 module secure_packager
 
-go 1.21
+go 1.24.0
 
-require github.com/fernet/fernet-go v0.0.0-20240119011108-303da6aec611
+require (
+	github.com/fernet/fernet-go v0.0.0-20240119011108-303da6aec611
+	golang.org/x/crypto v0.48.0
+	golang.org/x/term v0.40.0
+)
+
+require golang.org/x/sys v0.41.0 // indirect
@@ -0,0 +1,114 @@
+package envelope
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"slices"
+)
+
+// AgentSocketEnv names the environment variable holding the key agent's socket
+// path, which unpack falls back to when given no key, like SSH_AUTH_SOCK.
+const AgentSocketEnv = "SECURE_PACKAGER_AGENT_SOCK"
+
+// AgentOptions configures ListenKeyAgent.
+type AgentOptions struct {
+	// AllowUIDs and AllowGIDs admit peers running as these users or with
+	// these primary groups. Peers running as the agent's own user are always
+	// admitted.
+	AllowUIDs []int
+	AllowGIDs []int
+	// Log receives a line for every refused connection; nil discards them.
+	Log io.Writer
+}
+
+// agentListener only hands out connections from admitted peers.
+type agentListener struct {
+	*net.UnixListener
+	opts AgentOptions
+	uid  int
+}
+
+// peerAddr describes a socket peer by its credentials, so that the key
+// service log names who asked for an unwrap.
+type peerAddr string
+
+func (a peerAddr) Network() string { return "unix" }
+func (a peerAddr) String() string  { return string(a) }
+
+// agentConn is an admitted connection.
+type agentConn struct {
+	*net.UnixConn
+	peer peerAddr
+}
+
+func (c agentConn) RemoteAddr() net.Addr { return c.peer }
+
+// ListenKeyAgent listens on the Unix socket at path for a key agent: serve
+// NewKeyServiceHandler on it to unwrap data keys for unpack on the same host
+// without the private key being readable by it. Every connection is checked
+// with the kernel's peer credentials (SO_PEERCRED, Linux only) against
+// opts. The socket is only accessible to the agent's own user unless other
+// users or groups are allowed; a stale socket left at path is replaced.
+func ListenKeyAgent(path string, opts AgentOptions) (net.Listener, error) {
+	if !peerCredentialsSupported {
+		return nil, errors.New("the key agent needs peer credentials, which are only supported on Linux")
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("a key agent is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// Peer credentials are the access check; the mode only keeps others
+	// from connecting at all when no one else is allowed
+	mode := fs.FileMode(0600)
+	if len(opts.AllowUIDs)+len(opts.AllowGIDs) > 0 {
+		mode = 0666
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &agentListener{UnixListener: l, opts: opts, uid: os.Geteuid()}, nil
+}
+
+func (l *agentListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		uid, gid, pid, err := peerCredentials(c)
+		switch {
+		case err != nil:
+			logf(l.opts.Log, "Refused connection: reading peer credentials: %v\n", err)
+		case uid != l.uid && !slices.Contains(l.opts.AllowUIDs, uid) && !slices.Contains(l.opts.AllowGIDs, gid):
+			logf(l.opts.Log, "Refused connection from uid %d gid %d (pid %d)\n", uid, gid, pid)
+		default:
+			return agentConn{c, peerAddr(fmt.Sprintf("uid %d pid %d", uid, pid))}, nil
+		}
+		c.Close()
+	}
+}
+
+// NewAgentUnwrapper returns a KeyUnwrapper that has data keys unwrapped by the
+// key agent listening on socket. keyID may be empty if the agent holds a
+// single key.
+func NewAgentUnwrapper(ctx context.Context, socket, keyID string) (KeyUnwrapper, error) {
+	return NewRemoteUnwrapper(ctx, RemoteKeyOptions{Socket: socket, KeyID: keyID})
+}
@@ -0,0 +1,174 @@
+//go:build linux
+
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a log the agent and the test can share.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startAgent serves priv on a socket in a temporary directory, treating
+// ownUID as the agent's own user, and returns the socket path.
+func startAgent(t *testing.T, priv crypto.PrivateKey, ownUID int, opts AgentOptions) string {
+	t.Helper()
+	h, err := NewKeyServiceHandler([]crypto.PrivateKey{priv}, KeyServiceOptions{Log: opts.Log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := ListenKeyAgent(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*agentListener).uid = ownUID
+	srv := &http.Server{Handler: h}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return path
+}
+
+func TestKeyAgent(t *testing.T) {
+	priv, info := newServiceKey(t, KeyTypeX25519)
+	pub, err := ParsePublicKey([]byte(info.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewKeyWrapper(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zb := packTest(t, PackOptions{Recipients: []KeyWrapper{w}})
+	ctx := context.Background()
+	uid, gid := os.Geteuid(), os.Getegid()
+
+	tests := []struct {
+		name     string
+		ownUID   int
+		opts     AgentOptions
+		admitted bool
+		mode     fs.FileMode
+	}{
+		{"own user", uid, AgentOptions{}, true, 0600},
+		{"other user", uid + 1, AgentOptions{}, false, 0600},
+		{"other user, allowed uid", uid + 1, AgentOptions{AllowUIDs: []int{uid + 2, uid}}, true, 0666},
+		{"other user, other uid allowed", uid + 1, AgentOptions{AllowUIDs: []int{uid + 2}}, false, 0666},
+		{"other user, allowed gid", uid + 1, AgentOptions{AllowGIDs: []int{gid}}, true, 0666},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			log := new(syncBuffer)
+			tc.opts.Log = log
+			sock := startAgent(t, priv, tc.ownUID, tc.opts)
+			if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != tc.mode {
+				t.Errorf("socket mode %v, want %v (%v)", fi.Mode().Perm(), tc.mode, err)
+			}
+			u, err := NewAgentUnwrapper(ctx, sock, "")
+			if !tc.admitted {
+				if err == nil {
+					t.Fatal("refused peer got an answer")
+				}
+				if !strings.Contains(log.String(), "Refused connection from uid") {
+					t.Errorf("refusal not logged: %q", log.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			unpackTest(t, zb, UnpackOptions{KeyUnwrapper: u})
+			if !strings.Contains(log.String(), "Unwrapped a key for uid") {
+				t.Errorf("unwrap not logged with the peer: %q", log.String())
+			}
+		})
+	}
+}
+
+func TestKeyAgentRequests(t *testing.T) {
+	priv, info := newServiceKey(t, KeyTypeX25519)
+	sock := startAgent(t, priv, os.Geteuid(), AgentOptions{})
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"malformed JSON", `{"key_wrap":`, http.StatusBadRequest},
+		{"unknown field", `{"key_wrap":"` + info.KeyWrap + `","wrapped_key":"","extra":1}`, http.StatusBadRequest},
+		{"trailing data", `{"key_wrap":"` + info.KeyWrap + `","wrapped_key":""} {}`, http.StatusBadRequest},
+		{"oversized", `{"key_wrap":"` + info.KeyWrap + `","wrapped_key":"` + strings.Repeat("A", maxKeyServiceBody) + `"}`, http.StatusBadRequest},
+		{"wrong key wrap", `{"key_wrap":"` + KeyWrapRSAOAEP + `","wrapped_key":"AAAA"}`, http.StatusBadRequest},
+		{"wrapped key not base64", `{"key_wrap":"` + info.KeyWrap + `","wrapped_key":"!!"}`, http.StatusBadRequest},
+		{"wrapped key garbage", `{"key_wrap":"` + info.KeyWrap + `","wrapped_key":"AAAA"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := client.Post("http://localhost/v1/keys/"+info.KeyID+"/unwrap", "application/json", strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tc.status)
+			}
+		})
+	}
+}
+
+func TestListenKeyAgentPath(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenKeyAgent(file, AgentOptions{}); err == nil {
+		t.Error("listened over a regular file")
+	}
+
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := ListenKeyAgent(sock, AgentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenKeyAgent(sock, AgentOptions{}); err == nil {
+		t.Error("listened over a live agent")
+	}
+	// A stale socket is replaced
+	l.(*agentListener).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = ListenKeyAgent(sock, AgentOptions{}); err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	l.Close()
+}
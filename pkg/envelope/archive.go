@@ -0,0 +1,501 @@
+package envelope
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/fernet/fernet-go"
+)
+
+// ErrNotSeekable is returned by Archive.Open for payloads that cannot be read
+// at random offsets, i.e. chunked payloads stored compressed in the zip.
+var ErrNotSeekable = errors.New("payload entry is compressed and cannot be read at random offsets")
+
+// Archive is an opened package whose licensing has been enforced and whose
+// data key has been unwrapped, so that individual files can be decrypted on
+// demand.
+type Archive struct {
+	r        io.ReaderAt
+	zr       *zip.Reader
+	key      *fernet.Key
+	suite    string
+	manifest *Manifest
+	names    []string
+	dirs     []string
+	payloads map[string]*zip.File
+	files    map[string]*ManifestFile
+}
+
+// OpenArchive reads the zip package from r, enforces licensing and unwraps
+// the data key as described by opts.
+func OpenArchive(ctx context.Context, r io.ReaderAt, size int64, opts UnpackOptions) (*Archive, error) {
+	u := opts.KeyUnwrapper
+	if u == nil && len(opts.CustodianShares) == 0 {
+		if opts.PrivateKey == nil {
+			return nil, errors.New("no customer private key")
+		}
+		var err error
+		if u, err = NewKeyUnwrapper(opts.PrivateKey); err != nil {
+			return nil, err
+		}
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{r: r, zr: zr, suite: SuiteFernet, payloads: make(map[string]*zip.File)}
+	entries := make(map[string]*zip.File, len(zr.File))
+	var payloadEntries []*zip.File
+	for _, f := range zr.File {
+		entries[f.Name] = f
+		switch {
+		case strings.HasSuffix(f.Name, "/"):
+			dir := strings.TrimSuffix(f.Name, "/")
+			if !fs.ValidPath(dir) || dir == "." {
+				return nil, fmt.Errorf("illegal file path: %s", f.Name)
+			}
+			a.dirs = append(a.dirs, dir)
+		case strings.HasSuffix(f.Name, PayloadSuffix):
+			payloadEntries = append(payloadEntries, f)
+		}
+	}
+
+	var mb []byte
+	if f, ok := entries[ManifestName]; ok {
+		if mb, err = readZipFile(f); err != nil {
+			return nil, err
+		}
+	}
+	if err := verifySignature(entries, mb, opts); err != nil {
+		return nil, err
+	}
+	if mb != nil {
+		if a.manifest, err = ParseManifest(mb); err != nil {
+			return nil, err
+		}
+		if a.manifest.CipherSuite != "" {
+			a.suite = a.manifest.CipherSuite
+		}
+	}
+	if p, ok := u.(passphraseUnwrapper); ok {
+		if u, err = p.bind(a.manifest); err != nil {
+			return nil, err
+		}
+	}
+
+	var raw []byte
+	var lic *License
+	if len(opts.CustodianShares) > 0 {
+		// Shares are not bound to one customer key
+		if lic, err = a.checkLicense(entries, "", opts); err != nil {
+			return nil, err
+		}
+		if raw, err = a.joinCustodianShares(opts.CustodianShares); err != nil {
+			return nil, err
+		}
+	} else {
+		if lic, err = a.checkLicense(entries, u.KeyID(), opts); err != nil {
+			return nil, err
+		}
+		wrapped, err := a.wrappedKey(entries, u)
+		if err != nil {
+			return nil, err
+		}
+		if raw, err = u.UnwrapKey(ctx, wrapped); err != nil {
+			return nil, fmt.Errorf("unwrap failed: %w", err)
+		}
+	}
+	if len(raw) != len(fernet.Key{}) {
+		return nil, fmt.Errorf("unwrap failed: invalid key length %d", len(raw))
+	}
+	a.key = (*fernet.Key)(raw)
+	shared := a.manifest != nil && a.manifest.License != nil && a.manifest.License.KeyShare != ""
+	if shared {
+		// The wrapped key is only half of the data key; the license token
+		// carries the other half
+		if lic == nil || lic.KeyShare == nil || lic.PackageID == "" {
+			return nil, ErrNoKeyShare
+		}
+		if a.key, err = joinKey(a.key, lic.KeyShare); err != nil {
+			return nil, err
+		}
+	}
+	if a.manifest != nil && a.manifest.Index != nil {
+		if err := a.readIndex(entries); err != nil {
+			if shared {
+				return nil, fmt.Errorf("%w: %w", ErrWrongKeyShare, err)
+			}
+			return nil, err
+		}
+	}
+	if err := a.indexPayloads(entries, payloadEntries); err != nil {
+		return nil, err
+	}
+	if shared && len(a.names) > 0 {
+		// A wrong share still joins into a key; check it up front rather
+		// than failing file by file
+		if _, err := a.Open(a.names[0]); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrWrongKeyShare, err)
+		}
+	}
+	return a, nil
+}
+
+// wrappedKey returns the data key wrapped for u, checked against the hash
+// the manifest records for it.
+func (a *Archive) wrappedKey(entries map[string]*zip.File, u KeyUnwrapper) ([]byte, error) {
+	name, want, alg := WrappedKeyName, "", KeyWrapRSAOAEP
+	if a.manifest != nil {
+		want = a.manifest.WrappedKeySHA256
+	}
+	if a.manifest != nil && len(a.manifest.Recipients) > 0 {
+		var ids []string
+		for _, r := range a.manifest.Recipients {
+			if r.KeyID == u.KeyID() && r.Share != 0 {
+				return nil, fmt.Errorf("key %s only holds custodian share %d; unpack with %d exported shares",
+					r.KeyID, r.Share, a.manifest.Threshold)
+			}
+			if r.KeyID == u.KeyID() {
+				name, want, alg = r.Entry, r.SHA256, r.KeyWrap
+				break
+			}
+			ids = append(ids, r.KeyID)
+		}
+		if len(ids) == len(a.manifest.Recipients) {
+			return nil, fmt.Errorf("package is not wrapped for private key %s (recipients: %s)",
+				u.KeyID(), strings.Join(ids, ", "))
+		}
+	}
+	if alg != u.Algorithm() {
+		return nil, fmt.Errorf("%s is wrapped with %s, but the private key is for %s", name, alg, u.Algorithm())
+	}
+	wf, ok := entries[name]
+	if !ok {
+		return nil, fmt.Errorf("package has no %s", name)
+	}
+	wrapped, err := readZipFile(wf)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(wrapped)
+	if err := checkSHA256(name, sum[:], want); err != nil {
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// verifySignature applies the signature policy in opts to the package,
+// before anything else in it is trusted. The signature covers the exact
+// manifest bytes; the hashes they record are checked as entries are read.
+func verifySignature(entries map[string]*zip.File, manifest []byte, opts UnpackOptions) error {
+	sf, signed := entries[SignatureName]
+	pinned := opts.SignerPublicKey != nil || opts.TrustStore != nil
+	switch {
+	case !signed && (opts.SignerPublicKey != nil || opts.RequireSignature):
+		return ErrUnsigned
+	case !signed && opts.TrustStore != nil && !opts.AllowUnsigned:
+		return ErrUnsigned
+	case !signed:
+		return nil
+	case !pinned && opts.RequireSignature:
+		return ErrNoSignerKey
+	case !pinned:
+		logf(opts.Log, "⚠️ WARNING: signature not checked, as no vendor signing key is pinned.\n")
+		logf(opts.Log, "⚠️ A stripped or swapped signature would go unnoticed.\n")
+		return nil
+	}
+	if manifest == nil {
+		return fmt.Errorf("package has %s but no %s", SignatureName, ManifestName)
+	}
+	m, err := ParseManifest(manifest)
+	if err != nil {
+		return err
+	}
+	if m.Signer == nil || (m.WrappedKeySHA256 == "" && len(m.Recipients) == 0) {
+		return errors.New("❌ signed manifest does not name its signer or cover the wrapped key")
+	}
+	pub := opts.SignerPublicKey
+	if pub == nil {
+		var ok bool
+		if pub, ok = opts.TrustStore.Lookup(m.Signer.KeyID); !ok {
+			return fmt.Errorf("❌ package is signed by vendor key %s, which is not in the trust store",
+				m.Signer.KeyID)
+		}
+	}
+	sig, err := readZipFile(sf)
+	if err != nil {
+		return err
+	}
+	if err := verifyManifest(pub, manifest, sig); err != nil {
+		return fmt.Errorf("❌ package signature invalid: %w", err)
+	}
+	logf(opts.Log, "✅ Package signature verified (vendor key %s)\n", m.Signer.KeyID)
+	return nil
+}
+
+// checkLicense verifies and enforces the license token, including its package
+// and customer binding, when the manifest requires one or the caller supplied
+// one, and returns the license (nil when no token was checked). The token is
+// checked against the explicit vendor key, else the trust store, and only
+// then, unless forbidden, against the vendor key shipped in the package.
+func (a *Archive) checkLicense(entries map[string]*zip.File, customerKey string,
+	opts UnpackOptions) (*License, error) {
+	var lp LicensePolicy
+	if a.manifest != nil && a.manifest.License != nil {
+		lp = *a.manifest.License
+	}
+	if !lp.Required && opts.LicenseToken == nil && opts.VendorPublicKey == nil {
+		return nil, nil
+	}
+	if opts.LicenseToken == nil {
+		return nil, ErrLicenseRequired
+	}
+
+	var lic *License
+	var err error
+	switch {
+	case opts.VendorPublicKey != nil:
+		if lic, err = VerifyLicense(opts.LicenseToken, opts.VendorPublicKey); err != nil {
+			return nil, err
+		}
+	case opts.TrustStore != nil:
+		var k *TrustedKey
+		if lic, k, err = opts.TrustStore.verifyLicense(opts.LicenseToken); err == nil {
+			logf(opts.Log, "\U0001F511 License signed by trusted vendor key %s (%s)\n", k.ID, k.Source)
+		}
+	}
+	if lic == nil {
+		vf, ok := entries[lp.VendorPublicKey]
+		switch {
+		case !ok && err != nil:
+			return nil, err
+		case !ok:
+			return nil, ErrNoVendorKey
+		case opts.ForbidArchiveKeys && err != nil:
+			return nil, err
+		case opts.ForbidArchiveKeys:
+			return nil, ErrArchiveKeyForbidden
+		}
+		if lic, err = a.verifyWithArchiveKey(vf, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	var packageID string
+	if a.manifest != nil {
+		packageID = a.manifest.PackageID
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if err := lic.Enforce(now, opts.Log); err != nil {
+		return nil, err
+	}
+	if err := lic.CheckBinding(packageID, customerKey); err != nil {
+		return nil, err
+	}
+	return lic, nil
+}
+
+// verifyWithArchiveKey verifies the license token with the vendor key shipped
+// in the package. Whoever built the package could also have minted the
+// token, so the key's fingerprint is shown for the user to check.
+func (a *Archive) verifyWithArchiveKey(vf *zip.File, opts UnpackOptions) (*License, error) {
+	pemBytes, err := readZipFile(vf)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ParseRSAPublicKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing vendor public key: %w", err)
+	}
+	kid, err := KeyFingerprint(pub)
+	if err != nil {
+		return nil, err
+	}
+	logf(opts.Log, "⚠️ WARNING: verifying the license with the %s shipped in the package.\n", vf.Name)
+	logf(opts.Log, "⚠️ Its fingerprint is %s; check it with your vendor.\n", kid)
+	return VerifyLicense(opts.LicenseToken, pub)
+}
+
+// indexPayloads maps file names to payload entries. With a versioned manifest
+// the file list comes from its inventory, and every payload entry must be
+// accounted for; older packages are indexed from the entry names alone.
+func (a *Archive) indexPayloads(entries map[string]*zip.File, payloadEntries []*zip.File) error {
+	if a.manifest == nil || a.manifest.FormatVersion == 0 {
+		for _, f := range payloadEntries {
+			name := strings.TrimSuffix(f.Name, PayloadSuffix)
+			if !fs.ValidPath(name) || strings.Contains(name, "\\") {
+				return fmt.Errorf("illegal file path: %s", f.Name)
+			}
+			a.names = append(a.names, name)
+			a.payloads[name] = f
+		}
+		return nil
+	}
+	a.files = make(map[string]*ManifestFile, len(a.manifest.Files))
+	listed := make(map[string]bool, len(a.manifest.Files))
+	for i := range a.manifest.Files {
+		mf := &a.manifest.Files[i]
+		f, ok := entries[mf.Entry]
+		if !ok {
+			return fmt.Errorf("package is missing %s listed in the manifest", mf.Entry)
+		}
+		a.names = append(a.names, mf.Name)
+		a.payloads[mf.Name] = f
+		a.files[mf.Name] = mf
+		listed[mf.Entry] = true
+	}
+	for _, f := range payloadEntries {
+		if !listed[f.Name] {
+			return fmt.Errorf("payload entry %s is not listed in the manifest", f.Name)
+		}
+	}
+	return nil
+}
+
+// Manifest returns the package manifest, or nil for packages made before
+// manifests were always written. Version 0 manifests only carry a license
+// policy.
+func (a *Archive) Manifest() *Manifest {
+	return a.manifest
+}
+
+// Names returns the slash-separated relative paths of the packaged files in
+// archive order.
+func (a *Archive) Names() []string {
+	return append([]string(nil), a.names...)
+}
+
+// Open returns a reader that decrypts the named file on demand: only the
+// chunks covering the bytes actually read are fetched and authenticated, and
+// no plaintext is written anywhere. The returned SectionReader implements
+// io.ReaderAt and io.ReadSeeker and is safe for concurrent ReadAt calls.
+//
+// The size is checked against the manifest, but the plaintext and ciphertext
+// SHA-256 are not, since the file is never read as a whole. Every chunk is
+// still authenticated with the data key, which a signed manifest binds
+// through the wrapped key hash.
+//
+// Payloads written by versions that predate the chunked format are decrypted
+// into memory as a whole.
+func (a *Archive) Open(name string) (*io.SectionReader, error) {
+	f, ok := a.payloads[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	off, err := f.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+	if f.Method == zip.Store {
+		raw := io.NewSectionReader(a.r, off, int64(f.UncompressedSize64))
+		magic := make([]byte, len(streamMagic))
+		if _, err := raw.ReadAt(magic, 0); err == nil && string(magic) == streamMagic {
+			sr, err := NewSuiteDecryptReaderAt(raw, raw.Size(), a.suite, a.key)
+			if err != nil {
+				return nil, err
+			}
+			mf := a.files[name]
+			if mf == nil {
+				return sr, nil
+			}
+			if sr.Size() != mf.paddedSize() {
+				return nil, fmt.Errorf("%s: size %d does not match manifest (%d)", name, sr.Size(), mf.paddedSize())
+			}
+			// Leave out the padding of packages in privacy mode
+			return io.NewSectionReader(sr, 0, mf.Size), nil
+		}
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	br := bufio.NewReader(rc)
+	if magic, _ := br.Peek(len(streamMagic)); string(magic) == streamMagic {
+		return nil, ErrNotSeekable
+	}
+	pr, err := newPayloadReader(br, a.suite, a.key)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := io.ReadAll(pr)
+	if err != nil {
+		return nil, err
+	}
+	if mf := a.files[name]; mf != nil && mf.PaddedSize > 0 {
+		if int64(len(pt)) != mf.PaddedSize {
+			return nil, fmt.Errorf("%s: padded size %d does not match manifest (%d)", name, len(pt), mf.PaddedSize)
+		}
+		pt = pt[:mf.Size]
+	}
+	if err := a.files[name].check(int64(len(pt)), sha256.Sum256(pt)); err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(bytes.NewReader(pt), 0, int64(len(pt))), nil
+}
+
+// decrypt streams the named file into dst.
+func (a *Archive) decrypt(ctx context.Context, dst EntryWriter, name string) error {
+	rc, err := a.payloads[name].Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	ch := sha256.New()
+	pr, err := newPayloadReader(ctxReader{ctx, io.TeeReader(rc, ch)}, a.suite, a.key)
+	if err != nil {
+		return err
+	}
+	w, err := dst.Create(name)
+	if err != nil {
+		return err
+	}
+	mf := a.files[name]
+	var body io.Reader = pr
+	if mf != nil && mf.PaddedSize > 0 {
+		body = io.LimitReader(pr, mf.Size)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), body)
+	if err != nil {
+		return err
+	}
+	if mf != nil && mf.PaddedSize > 0 {
+		// Read the padding too, so the whole stream is authenticated
+		p, err := io.Copy(io.Discard, pr)
+		if err != nil {
+			return err
+		}
+		if n+p != mf.PaddedSize {
+			return fmt.Errorf("%s: padded size %d does not match manifest (%d)", name, n+p, mf.PaddedSize)
+		}
+	}
+	if err := mf.check(n, [sha256.Size]byte(h.Sum(nil))); err != nil {
+		return err
+	}
+	if mf != nil {
+		return checkSHA256(mf.Entry, ch.Sum(nil), mf.CiphertextSHA256)
+	}
+	return nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
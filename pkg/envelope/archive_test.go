@@ -0,0 +1,100 @@
+package envelope
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"testing/fstest"
+)
+
+// openTestArchive opens the package zb and its big.bin.
+func openTestArchive(t *testing.T, zb []byte, u KeyUnwrapper) *io.SectionReader {
+	t.Helper()
+	a, err := OpenArchive(context.Background(), bytes.NewReader(zb), int64(len(zb)), UnpackOptions{KeyUnwrapper: u})
+	if err != nil {
+		t.Fatalf("OpenArchive: %v", err)
+	}
+	sr, err := a.Open("big.bin")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return sr
+}
+
+func TestArchiveReadAt(t *testing.T) {
+	data := make([]byte, 3*testChunkSize+10)
+	rand.Read(data)
+	src := fstest.MapFS{"big.bin": {Data: data}}
+	n := int64(len(data))
+	reads := []struct {
+		name   string
+		off, n int64
+	}{
+		{"first chunk", 0, testChunkSize},
+		{"across a boundary", testChunkSize - 4, 8},
+		{"second chunk", testChunkSize, testChunkSize},
+		{"across two boundaries", testChunkSize - 1, testChunkSize + 2},
+		{"last partial chunk", 3 * testChunkSize, 10},
+		{"running past the end", n - 5, 20},
+		{"at the end", n, 1},
+		{"past the end", n + 100, 1},
+	}
+	for _, suite := range testSuites {
+		w, u := newTestKey(t, KeyTypeX25519)
+		var buf bytes.Buffer
+		opts := PackOptions{Recipients: []KeyWrapper{w}, CipherSuite: suite, ChunkSize: testChunkSize}
+		if err := Pack(context.Background(), &buf, src, opts); err != nil {
+			t.Fatal(err)
+		}
+		sr := openTestArchive(t, buf.Bytes(), u)
+		if sr.Size() != n {
+			t.Fatalf("%s: size %d, want %d", suite, sr.Size(), n)
+		}
+		for _, tc := range reads {
+			t.Run(suite+"/"+tc.name, func(t *testing.T) {
+				p := make([]byte, tc.n)
+				got, err := sr.ReadAt(p, tc.off)
+				want := min(max(n-tc.off, 0), tc.n)
+				if int64(got) != want {
+					t.Fatalf("read %d bytes, want %d (%v)", got, want, err)
+				}
+				if want < tc.n && err != io.EOF {
+					t.Errorf("short read: %v, want io.EOF", err)
+				} else if want == tc.n && err != nil {
+					t.Error(err)
+				}
+				if want > 0 && !bytes.Equal(p[:got], data[tc.off:tc.off+want]) {
+					t.Error("plaintext mismatch")
+				}
+			})
+		}
+
+		// Tamper with the second chunk: the others still read, as Open
+		// checks no hash, but reads touching it fail authentication
+		zb := bytes.Clone(buf.Bytes())
+		zr, err := zip.NewReader(bytes.NewReader(zb), int64(len(zb)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			if f.Name == "big.bin"+PayloadSuffix {
+				off, err := f.DataOffset()
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, chunks := splitChunks(t, zb[off:off+int64(f.CompressedSize64)])
+				zb[off+int64(streamHeaderLen+len(chunks[0])+len(chunks[1])-1)] ^= 1
+			}
+		}
+		sr = openTestArchive(t, zb, u)
+		if _, err := sr.ReadAt(make([]byte, 8), 2*testChunkSize); err != nil {
+			t.Errorf("%s: untouched chunk: %v", suite, err)
+		}
+		if _, err := sr.ReadAt(make([]byte, 8), testChunkSize-4); err == nil {
+			t.Errorf("%s: tampered chunk read: %v", suite, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// RecipientCertificate identifies the X.509 certificate a recipient's public
+// key was taken from. It is recorded in the manifest for auditing; unpack
+// still matches recipients by key ID.
+type RecipientCertificate struct {
+	Subject string `json:"subject"`
+	Issuer  string `json:"issuer"`
+	// Serial is the certificate serial number in hex.
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+func (c *RecipientCertificate) validate() error {
+	if c.Subject == "" || c.Issuer == "" || c.NotAfter.IsZero() {
+		return errors.New("incomplete recipient certificate")
+	}
+	if n, ok := new(big.Int).SetString(c.Serial, 16); !ok || n.Sign() < 0 {
+		return errors.New("invalid recipient certificate serial")
+	}
+	return nil
+}
+
+// CertificateOptions configure how recipient certificates are validated.
+type CertificateOptions struct {
+	// Roots are the trusted CA certificates. Required.
+	Roots *x509.CertPool
+	// Intermediates are extra certificates that may complete the chain.
+	Intermediates *x509.CertPool
+	// CRLs are revocation lists; a certificate in the chain is rejected if
+	// a CRL signed by its issuer lists it. A CRL past its next update, or
+	// one that names the issuer but is not signed by it, is an error rather
+	// than being silently ignored.
+	CRLs []*x509.RevocationList
+	// Now is the validation time; zero means the current time.
+	Now time.Time
+}
+
+// ParseCertificates parses every PEM CERTIFICATE block in data.
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return certs, nil
+}
+
+// ReadCertificates reads every PEM certificate in the file at path.
+func ReadCertificates(path string) ([]*x509.Certificate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCertificates(b)
+}
+
+// ReadCertPool reads a bundle of PEM certificates into a pool.
+func ReadCertPool(path string) (*x509.CertPool, error) {
+	certs, err := ReadCertificates(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, c := range certs {
+		pool.AddCert(c)
+	}
+	return pool, nil
+}
+
+// ReadCRL reads a certificate revocation list in PEM (X509 CRL) or DER form.
+func ReadCRL(path string) (*x509.RevocationList, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("unexpected PEM block %q in CRL file", block.Type)
+		}
+		b = block.Bytes
+	}
+	return x509.ParseRevocationList(b)
+}
+
+// VerifyRecipientCertificate checks that cert chains to one of opts.Roots,
+// that every certificate in the chain is within its validity period at
+// opts.Now, and that none is revoked by opts.CRLs. If cert restricts its key
+// usage, it must allow key encipherment or key agreement.
+func VerifyRecipientCertificate(cert *x509.Certificate, opts CertificateOptions) error {
+	if opts.Roots == nil {
+		return errors.New("no root certificates to verify against")
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&(x509.KeyUsageKeyEncipherment|x509.KeyUsageKeyAgreement) == 0 {
+		return fmt.Errorf("certificate %s is not for key encipherment or key agreement", cert.Subject)
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: opts.Intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate %s: %w", cert.Subject, err)
+	}
+	for _, chain := range chains {
+		if err = checkRevocation(chain, opts.CRLs, now); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkRevocation checks each certificate of chain, leaf first, against the
+// CRLs signed by its issuer.
+func checkRevocation(chain []*x509.Certificate, crls []*x509.RevocationList, now time.Time) error {
+	for i := 0; i+1 < len(chain); i++ {
+		c, issuer := chain[i], chain[i+1]
+		for _, crl := range crls {
+			if err := crl.CheckSignatureFrom(issuer); err != nil {
+				// CRLs of other CAs do not apply, but one that names
+				// this issuer must be signed by it
+				if bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+					return fmt.Errorf("CRL for %s is not signed by it: %w", issuer.Subject, err)
+				}
+				continue
+			}
+			if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+				return fmt.Errorf("CRL from %s expired on %s; fetch a current one", issuer.Subject, crl.NextUpdate.Format(time.DateOnly))
+			}
+			for _, e := range crl.RevokedCertificateEntries {
+				if e.SerialNumber.Cmp(c.SerialNumber) == 0 {
+					return fmt.Errorf("certificate %s (serial %x) was revoked on %s", c.Subject, c.SerialNumber, e.RevocationTime.Format(time.DateOnly))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// certWrapper wraps for the public key of a validated certificate and records
+// the certificate with the recipient.
+type certWrapper struct {
+	KeyWrapper
+	cert *RecipientCertificate
+}
+
+// NewCertificateWrapper validates cert with VerifyRecipientCertificate and
+// returns a KeyWrapper for its public key. The manifest records the
+// certificate's subject, issuer, serial number and expiry with the recipient.
+func NewCertificateWrapper(cert *x509.Certificate, opts CertificateOptions) (KeyWrapper, error) {
+	if err := VerifyRecipientCertificate(cert, opts); err != nil {
+		return nil, err
+	}
+	w, err := NewKeyWrapper(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return certWrapper{w, &RecipientCertificate{
+		Subject:  cert.Subject.String(),
+		Issuer:   cert.Issuer.String(),
+		Serial:   fmt.Sprintf("%x", cert.SerialNumber),
+		NotAfter: cert.NotAfter.UTC(),
+	}}, nil
+}
@@ -0,0 +1,149 @@
+package envelope
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+var certNow = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             certNow.AddDate(-1, 0, 0),
+		NotAfter:              certNow.AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert, key}
+}
+
+// issue returns a leaf for a fresh P-256 key, valid from notBefore for a
+// year.
+func (ca testCA) issue(t *testing.T, serial int64, notBefore time.Time, usage x509.KeyUsage) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "customer", Organization: []string{"Acme"}},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.AddDate(1, 0, 0),
+		KeyUsage:     usage,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// crl returns a CRL signed by ca that revokes serials and is due for update
+// at nextUpdate.
+func (ca testCA) crl(t *testing.T, nextUpdate time.Time, serials ...int64) *x509.RevocationList {
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: certNow.AddDate(0, 0, -1),
+		NextUpdate: nextUpdate,
+	}
+	for _, s := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: big.NewInt(s), RevocationTime: certNow.AddDate(0, 0, -1)})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crl
+}
+
+func TestVerifyRecipientCertificate(t *testing.T) {
+	ca := newTestCA(t, "Vendor CA")
+	other := newTestCA(t, "Other CA")
+	// impostor has the name of ca but a key of its own
+	impostor := newTestCA(t, "Vendor CA")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	usage := x509.KeyUsageKeyAgreement
+	valid := ca.issue(t, 10, certNow.AddDate(0, -1, 0), usage)
+	week := certNow.AddDate(0, 0, 7)
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		opts CertificateOptions
+		want string // error substring; empty for success
+	}{
+		{"valid", valid, CertificateOptions{Roots: roots}, ""},
+		{"valid, key encipherment", ca.issue(t, 11, certNow.AddDate(0, -1, 0), x509.KeyUsageKeyEncipherment), CertificateOptions{Roots: roots}, ""},
+		{"signing only", ca.issue(t, 12, certNow.AddDate(0, -1, 0), x509.KeyUsageDigitalSignature), CertificateOptions{Roots: roots}, "not for key encipherment"},
+		{"expired", ca.issue(t, 13, certNow.AddDate(-2, 0, 0), usage), CertificateOptions{Roots: roots}, "expired"},
+		{"not yet valid", ca.issue(t, 14, certNow.AddDate(0, 1, 0), usage), CertificateOptions{Roots: roots}, "not yet valid"},
+		{"other CA", other.issue(t, 10, certNow.AddDate(0, -1, 0), usage), CertificateOptions{Roots: roots}, "unknown authority"},
+		{"no roots", valid, CertificateOptions{}, "no root certificates"},
+		{"revoked", valid, CertificateOptions{Roots: roots, CRLs: []*x509.RevocationList{ca.crl(t, week, 9, 10)}}, "revoked"},
+		{"other serial revoked", valid, CertificateOptions{Roots: roots, CRLs: []*x509.RevocationList{ca.crl(t, week, 9)}}, ""},
+		{"revoked by other CA", valid, CertificateOptions{Roots: roots, CRLs: []*x509.RevocationList{other.crl(t, week, 10)}}, ""},
+		{"CRL from impostor", valid, CertificateOptions{Roots: roots, CRLs: []*x509.RevocationList{impostor.crl(t, week)}}, "not signed by it"},
+		{"CRL expired", valid, CertificateOptions{Roots: roots, CRLs: []*x509.RevocationList{ca.crl(t, certNow.AddDate(0, 0, -1))}}, "expired"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Now = certNow
+			err := VerifyRecipientCertificate(tc.cert, tc.opts)
+			switch {
+			case tc.want == "" && err != nil:
+				t.Errorf("rejected: %v", err)
+			case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+
+	w, err := NewCertificateWrapper(valid, CertificateOptions{Roots: roots, Now: certNow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := manifestOf(t, packTest(t, PackOptions{Recipients: []KeyWrapper{w}})).Recipients[0].Certificate
+	if c == nil || c.Serial != "a" || c.Issuer != "CN=Vendor CA" || !c.NotAfter.Equal(valid.NotAfter) {
+		t.Errorf("manifest records certificate %+v", c)
+	}
+}
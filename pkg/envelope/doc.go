@@ -0,0 +1,14 @@
+// Package envelope implements secure_packager's envelope encryption.
+//
+// Files are encrypted with a freshly generated data key, using Fernet or an
+// AEAD cipher suite (see NewEncryptWriter for the chunked payload format),
+// that key is wrapped with the customer's RSA public key (RSA-OAEP SHA-256,
+// label "secure_packager"), and the ciphertexts, the wrapped key and the
+// optional licensing manifest are written out as the entries of a zip
+// archive. Only the holder of the matching RSA private key can unwrap the key
+// and decrypt.
+//
+// The packager, unpack and issue-token commands are thin wrappers over Pack,
+// Unpack, VerifyLicense and IssueLicense; services can import this package
+// instead of shelling out to them.
+package envelope
@@ -0,0 +1,143 @@
+package envelope
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Names of the entries that make up a package.
+const (
+	ArchiveName    = "encrypted_files.zip"
+	WrappedKeyName = "wrapped_key.bin"
+	WrappedKeysDir = "wrapped_keys/"
+	ManifestName   = "manifest.json"
+	SignatureName  = "manifest.sig"
+	VendorKeyName  = "vendor_public.pem"
+	KeyShareName   = "license_share.bin"
+	IndexName      = "index.bin"
+	PayloadSuffix  = ".enc"
+)
+
+// EntryWriter receives the named entries of a package, one at a time. Each
+// call to Create finishes the previous entry. Names are slash-separated
+// relative paths; a name ending in a slash denotes a directory and receives
+// no data. *zip.Writer satisfies it, but see ZipEntryWriter.
+type EntryWriter interface {
+	Create(name string) (io.Writer, error)
+}
+
+type zipEntryWriter struct {
+	zw *zip.Writer
+}
+
+// ZipEntryWriter adapts zw for packing. Unlike zw.Create, it stores payload
+// entries uncompressed so that Archive.Open can read them at random offsets;
+// other entries are deflated as usual.
+func ZipEntryWriter(zw *zip.Writer) EntryWriter {
+	return zipEntryWriter{zw}
+}
+
+func (z zipEntryWriter) Create(name string) (io.Writer, error) {
+	fh := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	if strings.HasSuffix(name, PayloadSuffix) {
+		fh.Method = zip.Store
+	}
+	return z.zw.CreateHeader(fh)
+}
+
+// DirWriter is an EntryWriter that writes each entry as a file below a root
+// directory, refusing names that would escape it.
+type DirWriter struct {
+	root string
+	cur  *os.File
+}
+
+// NewDirWriter returns a DirWriter rooted at dir.
+func NewDirWriter(dir string) *DirWriter {
+	return &DirWriter{root: dir}
+}
+
+// Create closes the previous entry and creates the file for name, or the
+// directory if name ends in a slash. Names that are not local, or that would
+// be written through a symlink below the root, are rejected.
+func (d *DirWriter) Create(name string) (io.Writer, error) {
+	if err := d.Close(); err != nil {
+		return nil, err
+	}
+	isDir := strings.HasSuffix(name, "/")
+	rel := filepath.FromSlash(strings.TrimSuffix(name, "/"))
+	if !filepath.IsLocal(rel) {
+		return nil, fmt.Errorf("illegal file path: %s", name)
+	}
+	p := filepath.Join(d.root, rel)
+	dir := p
+	if !isDir {
+		dir = filepath.Dir(p)
+	}
+	if err := d.checkNoSymlinks(rel); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if isDir {
+		return io.Discard, nil
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d.cur = f
+	return f, nil
+}
+
+// checkNoSymlinks makes sure no existing component of rel below the root is a
+// symlink that could redirect the write outside of it.
+func (d *DirWriter) checkNoSymlinks(rel string) error {
+	p := d.root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("illegal file path: %s passes through a symlink", filepath.ToSlash(rel))
+		}
+	}
+	return nil
+}
+
+// Close closes the entry currently being written, if any.
+func (d *DirWriter) Close() error {
+	if d.cur == nil {
+		return nil
+	}
+	err := d.cur.Close()
+	d.cur = nil
+	return err
+}
+
+func writeEntry(dst EntryWriter, name string, data []byte) error {
+	w, err := dst.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func logf(w io.Writer, format string, args ...any) {
+	if w != nil {
+		fmt.Fprintf(w, format, args...)
+	}
+}
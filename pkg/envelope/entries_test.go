@@ -0,0 +1,81 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestUnpackRecreatesTree(t *testing.T) {
+	w, u := newTestKey(t, KeyTypeX25519)
+	src := fstest.MapFS{
+		"a.txt":           {Data: []byte("hello\n")},
+		"dir/sub/c.txt":   {Data: []byte("deep\n")},
+		"empty":           {Mode: os.ModeDir | 0755},
+		"skip/secret.txt": {Data: []byte("excluded\n")},
+	}
+	var buf bytes.Buffer
+	opts := PackOptions{Recipients: []KeyWrapper{w}, Exclude: func(name string) bool { return name == "skip" }}
+	if err := Pack(context.Background(), &buf, src, opts); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	dw := NewDirWriter(out)
+	if err := Unpack(context.Background(), bytes.NewReader(buf.Bytes()), int64(buf.Len()), dw, UnpackOptions{KeyUnwrapper: u}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "dir/sub/c.txt"} {
+		got, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil || !bytes.Equal(got, src[name].Data) {
+			t.Errorf("%s: %q, %v", name, got, err)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(out, "empty")); err != nil || !fi.IsDir() {
+		t.Errorf("empty directory not recreated: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "skip")); !os.IsNotExist(err) {
+		t.Errorf("excluded directory unpacked: %v", err)
+	}
+}
+
+func TestDirWriterRejectsUnsafePaths(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	out := filepath.Join(root, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(out, "link")); err != nil {
+		t.Fatal(err)
+	}
+	dw := NewDirWriter(out)
+	defer dw.Close()
+	for _, name := range []string{
+		"../x",
+		"a/../../x",
+		"/etc/x",
+		filepath.Join(outside, "x"),
+		"link/x",
+		"link/sub/x",
+		"link/",
+	} {
+		if _, err := dw.Create(name); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	if entries, err := os.ReadDir(outside); err != nil || len(entries) != 0 {
+		t.Errorf("written through the symlink: %v, %v", entries, err)
+	}
+	if entries, err := os.ReadDir(root); err != nil || len(entries) != 1 {
+		t.Errorf("written next to the output directory: %v, %v", entries, err)
+	}
+	if _, err := dw.Create("dir/ok.txt"); err != nil {
+		t.Errorf("safe path refused: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// testFiles is the tree the package tests pack.
+var testFiles = fstest.MapFS{
+	"a.txt":         {Data: []byte("hello\n")},
+	"dir/b.bin":     {Data: bytes.Repeat([]byte{0xa5}, 3*1024+7)},
+	"dir/sub/c.txt": {Data: []byte("deep\n")},
+}
+
+// memWriter collects unpacked entries in memory.
+type memWriter map[string]*bytes.Buffer
+
+func (m memWriter) Create(name string) (io.Writer, error) {
+	b := new(bytes.Buffer)
+	if !strings.HasSuffix(name, "/") {
+		m[name] = b
+	}
+	return b, nil
+}
+
+// newTestKey generates a key pair of the given type and returns its wrapper
+// and unwrapper.
+func newTestKey(t *testing.T, keyType string) (KeyWrapper, KeyUnwrapper) {
+	t.Helper()
+	priv, err := GenerateKey(keyType, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := PublicKeyOf(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewKeyWrapper(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewKeyUnwrapper(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, u
+}
+
+// packTest packs testFiles with opts and returns the zip.
+func packTest(t *testing.T, opts PackOptions) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Pack(context.Background(), &buf, testFiles, opts); err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// unpackTest unpacks zb with opts and checks that it holds testFiles.
+func unpackTest(t *testing.T, zb []byte, opts UnpackOptions) {
+	t.Helper()
+	dst := memWriter{}
+	if err := Unpack(context.Background(), bytes.NewReader(zb), int64(len(zb)), dst, opts); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if len(dst) != len(testFiles) {
+		t.Fatalf("unpacked %d files, want %d", len(dst), len(testFiles))
+	}
+	for name, f := range testFiles {
+		if got := dst[name]; got == nil || !bytes.Equal(got.Bytes(), f.Data) {
+			t.Errorf("%s does not round-trip", name)
+		}
+	}
+}
+
+// TestRecipients checks, for every cipher suite, that every recipient of a
+// package can unpack it and that any other key is refused with an error
+// naming it.
+func TestRecipients(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+	}{
+		{"one RSA", []string{KeyTypeRSA}},
+		{"three RSA", []string{KeyTypeRSA, KeyTypeRSA, KeyTypeRSA}},
+		{"one X25519", []string{KeyTypeX25519}},
+		{"one P-256", []string{KeyTypeP256}},
+		{"two X25519", []string{KeyTypeX25519, KeyTypeX25519}},
+		{"two P-256", []string{KeyTypeP256, KeyTypeP256}},
+		{"mixed", []string{KeyTypeX25519, KeyTypeRSA, KeyTypeP256}},
+	}
+	for _, tc := range tests {
+		var ws []KeyWrapper
+		var us []KeyUnwrapper
+		for _, kt := range tc.keys {
+			w, u := newTestKey(t, kt)
+			ws, us = append(ws, w), append(us, u)
+		}
+		_, outsider := newTestKey(t, tc.keys[0])
+		for _, suite := range testSuites {
+			t.Run(tc.name+"/"+suite, func(t *testing.T) {
+				zb := packTest(t, PackOptions{Recipients: ws, CipherSuite: suite})
+				if n := len(manifestOf(t, zb).Recipients); n != len(ws) {
+					t.Fatalf("manifest lists %d recipients, want %d", n, len(ws))
+				}
+				for _, u := range us {
+					unpackTest(t, zb, UnpackOptions{KeyUnwrapper: u})
+				}
+
+				err := Unpack(context.Background(), bytes.NewReader(zb), int64(len(zb)), memWriter{}, UnpackOptions{KeyUnwrapper: outsider})
+				if err == nil || !strings.Contains(err.Error(), "not wrapped for private key "+outsider.KeyID()) {
+					t.Errorf("outsider key: got %v", err)
+				}
+			})
+		}
+	}
+}
+
+// TestCiphertextBitFlip checks that every cipher suite authenticates
+// payloads: a single flipped ciphertext bit fails unpacking.
+func TestCiphertextBitFlip(t *testing.T) {
+	w, u := newTestKey(t, KeyTypeX25519)
+	for _, suite := range testSuites {
+		t.Run(suite, func(t *testing.T) {
+			zb := packTest(t, PackOptions{Recipients: []KeyWrapper{w}, CipherSuite: suite})
+			zb = editEntry(t, zb, "a.txt"+PayloadSuffix, func(b []byte) []byte {
+				b[streamHeaderLen+4+8] ^= 0x10
+				return b
+			})
+			err := Unpack(context.Background(), bytes.NewReader(zb), int64(len(zb)), memWriter{}, UnpackOptions{KeyUnwrapper: u})
+			if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+				t.Errorf("got %v, want an authentication failure", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package envelope
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// KeyWrapMLKEM768X25519 is the hybrid post-quantum key-wrap algorithm. The
+// data key is sealed, as for the ECDH-ES algorithms, under a key encryption
+// key derived with HKDF-SHA256 from both an ML-KEM-768 shared secret and an
+// X25519 shared secret, so it stays protected unless both are broken. The
+// wrapped key is the ML-KEM ciphertext, the ephemeral X25519 public key and
+// the sealed data key, in that order.
+const KeyWrapMLKEM768X25519 = "MLKEM768-X25519-HKDF-SHA256"
+
+// PEM block types of hybrid keys, which have no standard PKIX or PKCS#8
+// encoding yet. The public key is the ML-KEM-768 encapsulation key followed
+// by the X25519 public key; the private key is the 64-byte ML-KEM seed
+// followed by the X25519 private key.
+const (
+	hybridPublicPEMType  = "MLKEM768-X25519 PUBLIC KEY"
+	hybridPrivatePEMType = "MLKEM768-X25519 PRIVATE KEY"
+)
+
+const (
+	hybridPublicKeySize  = mlkem.EncapsulationKeySize768 + 32
+	hybridPrivateKeySize = mlkem.SeedSize + 32
+)
+
+// HybridPublicKey is an ML-KEM-768 + X25519 recipient key.
+type HybridPublicKey struct {
+	mlkem *mlkem.EncapsulationKey768
+	x     *ecdh.PublicKey
+}
+
+// HybridPrivateKey is the private half of a HybridPublicKey.
+type HybridPrivateKey struct {
+	mlkem *mlkem.DecapsulationKey768
+	x     *ecdh.PrivateKey
+}
+
+// GenerateHybridKey generates a new ML-KEM-768 + X25519 key pair.
+func GenerateHybridKey() (*HybridPrivateKey, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	x, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &HybridPrivateKey{dk, x}, nil
+}
+
+// NewHybridPublicKey parses the raw encoding of a hybrid public key.
+func NewHybridPublicKey(b []byte) (*HybridPublicKey, error) {
+	if len(b) != hybridPublicKeySize {
+		return nil, fmt.Errorf("invalid hybrid public key length %d", len(b))
+	}
+	ek, err := mlkem.NewEncapsulationKey768(b[:mlkem.EncapsulationKeySize768])
+	if err != nil {
+		return nil, err
+	}
+	x, err := ecdh.X25519().NewPublicKey(b[mlkem.EncapsulationKeySize768:])
+	if err != nil {
+		return nil, err
+	}
+	return &HybridPublicKey{ek, x}, nil
+}
+
+// NewHybridPrivateKey parses the raw encoding of a hybrid private key.
+func NewHybridPrivateKey(b []byte) (*HybridPrivateKey, error) {
+	if len(b) != hybridPrivateKeySize {
+		return nil, fmt.Errorf("invalid hybrid private key length %d", len(b))
+	}
+	dk, err := mlkem.NewDecapsulationKey768(b[:mlkem.SeedSize])
+	if err != nil {
+		return nil, err
+	}
+	x, err := ecdh.X25519().NewPrivateKey(b[mlkem.SeedSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &HybridPrivateKey{dk, x}, nil
+}
+
+// Bytes returns the raw encoding of the public key.
+func (k *HybridPublicKey) Bytes() []byte {
+	return append(k.mlkem.Bytes(), k.x.Bytes()...)
+}
+
+// Bytes returns the raw encoding of the private key.
+func (k *HybridPrivateKey) Bytes() []byte {
+	return append(k.mlkem.Bytes(), k.x.Bytes()...)
+}
+
+// Public returns the public half of the key.
+func (k *HybridPrivateKey) Public() *HybridPublicKey {
+	return &HybridPublicKey{k.mlkem.EncapsulationKey(), k.x.PublicKey()}
+}
+
+// fingerprint is the KeyFingerprint of a hybrid key: the hex SHA-256 of its
+// raw encoding, as there is no SubjectPublicKeyInfo for it.
+func (k *HybridPublicKey) fingerprint() string {
+	sum := sha256.Sum256(k.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+type hybridWrapper struct {
+	pub *HybridPublicKey
+}
+
+func (w hybridWrapper) Algorithm() string { return KeyWrapMLKEM768X25519 }
+func (w hybridWrapper) KeyID() string     { return w.pub.fingerprint() }
+
+func (w hybridWrapper) WrapKey(key []byte) ([]byte, error) {
+	ssM, ctM := w.pub.mlkem.Encapsulate()
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return w.seal(key, ssM, ctM, eph)
+}
+
+// seal wraps key given the ML-KEM encapsulation and the ephemeral X25519
+// key, which WrapKey draws at random.
+func (w hybridWrapper) seal(key, ssM, ctM []byte, eph *ecdh.PrivateKey) ([]byte, error) {
+	ssX, err := eph.ECDH(w.pub.x)
+	if err != nil {
+		return nil, err
+	}
+	epk := eph.PublicKey().Bytes()
+	aead, err := hybridKEK(ssM, ssX, ctM, epk, w.pub.x.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	out := append(append([]byte(nil), ctM...), epk...)
+	return aead.Seal(out, make([]byte, aead.NonceSize()), key, []byte(KeyWrapMLKEM768X25519)), nil
+}
+
+type hybridUnwrapper struct {
+	priv *HybridPrivateKey
+	kid  string
+}
+
+func (u hybridUnwrapper) Algorithm() string { return KeyWrapMLKEM768X25519 }
+func (u hybridUnwrapper) KeyID() string     { return u.kid }
+
+func (u hybridUnwrapper) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < mlkem.CiphertextSize768+32 {
+		return nil, errors.New("wrapped key too short")
+	}
+	ctM := wrapped[:mlkem.CiphertextSize768]
+	epk := wrapped[mlkem.CiphertextSize768 : mlkem.CiphertextSize768+32]
+	ssM, err := u.priv.mlkem.Decapsulate(ctM)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().NewPublicKey(epk)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	ssX, err := u.priv.x.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := hybridKEK(ssM, ssX, ctM, epk, u.priv.x.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), wrapped[mlkem.CiphertextSize768+32:], []byte(KeyWrapMLKEM768X25519))
+}
+
+// hybridKEK combines both shared secrets into the key encryption key. The
+// salt binds the ML-KEM ciphertext and both X25519 public keys, so neither
+// component can be swapped out independently.
+func hybridKEK(ssM, ssX, ctM, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	secret := append(append([]byte(nil), ssM...), ssX...)
+	salt := append(append(append([]byte(nil), ctM...), ephemeral...), recipient...)
+	return deriveKEK(KeyWrapMLKEM768X25519, secret, salt)
+}
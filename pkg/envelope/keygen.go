@@ -0,0 +1,89 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"os"
+)
+
+// Key types accepted by GenerateKey. Ed25519 keys can sign key requests but
+// cannot be package recipients.
+const (
+	KeyTypeRSA            = "rsa"
+	KeyTypeP256           = "p256"
+	KeyTypeX25519         = "x25519"
+	KeyTypeEd25519        = "ed25519"
+	KeyTypeMLKEM768X25519 = "mlkem768-x25519"
+)
+
+// GenerateKey generates a private key of the given type. bits is the RSA
+// modulus size, 2048, 3072 or 4096, and is ignored for other types.
+func GenerateKey(keyType string, bits int) (crypto.PrivateKey, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		if bits != 2048 && bits != 3072 && bits != 4096 {
+			return nil, fmt.Errorf("unsupported RSA key size %d (use 2048, 3072 or 4096)", bits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case KeyTypeP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeX25519:
+		return ecdh.X25519().GenerateKey(rand.Reader)
+	case KeyTypeEd25519:
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		return k, err
+	case KeyTypeMLKEM768X25519:
+		return GenerateHybridKey()
+	}
+	return nil, fmt.Errorf("unsupported key type %q", keyType)
+}
+
+// PublicKeyOf returns the public half of priv.
+func PublicKeyOf(priv crypto.PrivateKey) (crypto.PublicKey, error) {
+	switch k := priv.(type) {
+	case *HybridPrivateKey:
+		return k.Public(), nil
+	case *ecdh.PrivateKey:
+		return k.PublicKey(), nil
+	case crypto.Signer:
+		return k.Public(), nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", priv)
+}
+
+// WriteKeyPair writes priv to privPath, readable by its owner only, and its
+// public key to pubPath, as PEM. With a passphrase the private key is
+// encrypted (see MarshalEncryptedPrivateKeyPEM).
+func WriteKeyPair(privPath, pubPath string, priv crypto.PrivateKey, passphrase []byte) error {
+	pub, err := PublicKeyOf(priv)
+	if err != nil {
+		return err
+	}
+	pubPEM, err := MarshalPublicKeyPEM(pub)
+	if err != nil {
+		return err
+	}
+	var privPEM []byte
+	if passphrase != nil {
+		privPEM, err = MarshalEncryptedPrivateKeyPEM(priv, passphrase)
+	} else {
+		privPEM, err = MarshalPrivateKeyPEM(priv)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(privPath, privPEM, 0o600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file
+	if err := os.Chmod(privPath, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(pubPath, pubPEM, 0o644)
+}
@@ -0,0 +1,227 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// A key request is how a customer sends a public key to the vendor: a JWS
+// compact token, like version 2 license tokens, whose claims carry the public
+// key and the customer's details and which is signed by the matching private
+// key, proving the sender holds it. The header kid is the KeyFingerprint of
+// the public key; the algorithm is PS256 for RSA and ES256 for P-256 keys.
+// X25519 and hybrid keys cannot sign, and Ed25519 keys are signing-only and
+// cannot be recipients, so neither can make key requests.
+//
+// A valid signature shows that whoever made the request held the private key;
+// a vendor-issued nonce in the request ties it to the customer the nonce was
+// sent to, so a public key swapped in transit is detected.
+const keyRequestType = "secure-packager-key-request+jwt"
+
+// KeyRequest is the content of a key request.
+type KeyRequest struct {
+	PublicKey crypto.PublicKey
+	KeyID     string
+	Company   string
+	Email     string
+	// Nonce is a challenge issued by the vendor, or a random value.
+	Nonce    string
+	IssuedAt time.Time
+}
+
+type keyRequestClaims struct {
+	// PublicKey is the base64url PKIX DER of the public key.
+	PublicKey string `json:"public_key"`
+	Company   string `json:"company"`
+	Email     string `json:"email"`
+	Nonce     string `json:"nonce"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+// NewNonce returns a random base64url nonce for key requests.
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b64(b), nil
+}
+
+// CreateKeyRequest returns a key request for the public key of priv, signed
+// with priv. IssuedAt defaults to the current time and Nonce to NewNonce.
+func CreateKeyRequest(priv crypto.PrivateKey, r KeyRequest) ([]byte, error) {
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%T keys cannot sign a key request", priv)
+	}
+	alg, err := keyRequestAlg(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	kid, err := KeyFingerprint(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	if r.IssuedAt.IsZero() {
+		r.IssuedAt = time.Now()
+	}
+	if r.Nonce == "" {
+		if r.Nonce, err = NewNonce(); err != nil {
+			return nil, err
+		}
+	}
+	hb, err := json.Marshal(tokenHeader{Alg: alg, Typ: keyRequestType, Kid: kid})
+	if err != nil {
+		return nil, err
+	}
+	cb, err := json.Marshal(keyRequestClaims{
+		PublicKey: b64(der),
+		Company:   r.Company,
+		Email:     r.Email,
+		Nonce:     r.Nonce,
+		IssuedAt:  r.IssuedAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	signingInput := b64(hb) + "." + b64(cb)
+	var sig []byte
+	switch k := signer.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signingInput))
+		sig, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, sum[:], pss256)
+	case *ecdsa.PrivateKey:
+		// JWS ES256 signatures are r || s, not ASN.1
+		sum := sha256.Sum256([]byte(signingInput))
+		var er, es *big.Int
+		if er, es, err = ecdsa.Sign(rand.Reader, k, sum[:]); err == nil {
+			sig = make([]byte, 64)
+			er.FillBytes(sig[:32])
+			es.FillBytes(sig[32:])
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(signingInput + "." + b64(sig)), nil
+}
+
+func keyRequestAlg(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return tokenAlg, nil
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return "ES256", nil
+		}
+	case ed25519.PublicKey:
+		return "", errors.New("signing-only key: Ed25519 keys cannot be package recipients, so key requests need an RSA or P-256 key")
+	}
+	return "", errors.New("key requests need an RSA or P-256 key")
+}
+
+// ReadKeyRequest reads and verifies the key request in the file at path.
+func ReadKeyRequest(path string) (*KeyRequest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return VerifyKeyRequest(b)
+}
+
+// VerifyKeyRequest checks that token is a key request signed by the private
+// key matching the public key it carries, and returns its content. It does not
+// check the nonce: compare Nonce with the challenge that was sent to the
+// customer.
+func VerifyKeyRequest(token []byte) (*KeyRequest, error) {
+	parts := strings.Split(strings.TrimSpace(string(token)), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid key request: not a JWS compact token")
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key request header b64: %w", err)
+	}
+	var h tokenHeader
+	if err := decodeStrict(hb, &h); err != nil {
+		return nil, fmt.Errorf("invalid key request header: %w", err)
+	}
+	if h.Typ != keyRequestType {
+		return nil, fmt.Errorf("not a key request (typ %q)", h.Typ)
+	}
+	cb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key request claims b64: %w", err)
+	}
+	var c keyRequestClaims
+	if err := decodeStrict(cb, &c); err != nil {
+		return nil, fmt.Errorf("invalid key request claims: %w", err)
+	}
+	if c.Company == "" || c.Email == "" || c.Nonce == "" || c.IssuedAt == 0 {
+		return nil, errors.New("key request is missing company, email, nonce or iat")
+	}
+	der, err := base64.RawURLEncoding.DecodeString(c.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key request public_key b64: %w", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key request public_key: %w", err)
+	}
+	alg, err := keyRequestAlg(pub)
+	if err != nil {
+		return nil, err
+	}
+	if h.Alg != alg {
+		return nil, fmt.Errorf("key request alg %q does not match its %T key", h.Alg, pub)
+	}
+	kid, err := KeyFingerprint(pub)
+	if err != nil {
+		return nil, err
+	}
+	if h.Kid != kid {
+		return nil, fmt.Errorf("key request kid %s does not match its public key %s", h.Kid, kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key request signature b64: %w", err)
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+	sum := sha256.Sum256(signingInput)
+	valid := false
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPSS(k, crypto.SHA256, sum[:], sig, pss256) == nil
+	case *ecdsa.PublicKey:
+		valid = len(sig) == 64 && ecdsa.Verify(k, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	if !valid {
+		return nil, errors.New("key request signature invalid: the sender does not hold the private key")
+	}
+	return &KeyRequest{
+		PublicKey: pub,
+		KeyID:     kid,
+		Company:   c.Company,
+		Email:     c.Email,
+		Nonce:     c.Nonce,
+		IssuedAt:  time.Unix(c.IssuedAt, 0).UTC(),
+	}, nil
+}
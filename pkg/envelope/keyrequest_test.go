@@ -0,0 +1,68 @@
+package envelope
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestKeyRequestRoundTrip(t *testing.T) {
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeP256} {
+		t.Run(keyType, func(t *testing.T) {
+			priv, err := GenerateKey(keyType, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := CreateKeyRequest(priv, KeyRequest{Company: "Acme", Email: "ops@acme.com", Nonce: "challenge"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := VerifyKeyRequest(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Nonce != "challenge" || req.Company != "Acme" {
+				t.Errorf("request %+v", req)
+			}
+			if _, err := NewKeyWrapper(req.PublicKey); err != nil {
+				t.Errorf("key from the request is no recipient: %v", err)
+			}
+			token[len(token)-5] ^= 1
+			if _, err := VerifyKeyRequest(token); err == nil {
+				t.Error("tampered key request accepted")
+			}
+		})
+	}
+}
+
+// TestKeyRequestRejectsEd25519 checks that Ed25519 keys, which cannot be
+// recipients, can neither make nor pass off a key request.
+func TestKeyRequestRejectsEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateKeyRequest(priv, KeyRequest{Company: "Acme", Email: "ops@acme.com"}); err == nil {
+		t.Error("Ed25519 key request created")
+	}
+
+	// A request signed EdDSA by hand, as older releases made them
+	kid, err := KeyFingerprint(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb, _ := json.Marshal(tokenHeader{Alg: "EdDSA", Typ: keyRequestType, Kid: kid})
+	cb, _ := json.Marshal(keyRequestClaims{PublicKey: b64(der), Company: "Acme", Email: "ops@acme.com", Nonce: "n", IssuedAt: 1})
+	input := b64(hb) + "." + b64(cb)
+	token := input + "." + b64(ed25519.Sign(priv, []byte(input)))
+	if _, err := VerifyKeyRequest([]byte(token)); err == nil || !strings.Contains(err.Error(), "signing-only") {
+		t.Errorf("Ed25519 key request: %v", err)
+	}
+}
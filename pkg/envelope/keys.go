@@ -0,0 +1,338 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strings"
+)
+
+// ParseRSAPublicKey parses a PEM encoded RSA public key in PKIX or PKCS#1 form.
+func ParseRSAPublicKey(pemBytes []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	if pub, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if k, ok := pub.(*rsa.PublicKey); ok {
+			return k, nil
+		}
+		return nil, errors.New("not RSA public key")
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+// ParseRSAPublicKeys parses every PEM encoded public key in pemBytes, such as
+// a trust store bundle. Text outside the PEM blocks is ignored, so keys can
+// be annotated.
+func ParseRSAPublicKeys(pemBytes []byte) ([]*rsa.PublicKey, error) {
+	var keys []*rsa.PublicKey
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if !strings.HasSuffix(block.Type, "PUBLIC KEY") {
+			continue
+		}
+		pub, err := ParseRSAPublicKey(pem.EncodeToMemory(block))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM public keys found")
+	}
+	return keys, nil
+}
+
+// ReadRSAPublicKey reads a PEM encoded RSA public key from path.
+func ReadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRSAPublicKey(b)
+}
+
+// ParseRSAPrivateKey parses a PEM encoded RSA private key in PKCS#1 or PKCS#8
+// form.
+func ParseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	if err := checkUnencrypted(block); err != nil {
+		return nil, err
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	keyAny, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	k, ok := keyAny.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("PEM is not RSA private key")
+	}
+	return k, nil
+}
+
+// ReadRSAPrivateKey reads a PEM encoded RSA private key from path.
+func ReadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRSAPrivateKey(b)
+}
+
+// KeyFingerprint returns the hex SHA-256 of the PKIX (SubjectPublicKeyInfo)
+// DER encoding of pub, or of the raw encoding of a hybrid key. It identifies
+// keys in manifests and tokens.
+func KeyFingerprint(pub crypto.PublicKey) (string, error) {
+	if k, ok := pub.(*HybridPublicKey); ok {
+		return k.fingerprint(), nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ParsePublicKey parses a PEM encoded public key of any type the package
+// can wrap keys for: RSA (PKIX or PKCS#1), X25519, P-256 or hybrid
+// ML-KEM-768 + X25519. RSA keys are returned as *rsa.PublicKey, hybrid keys
+// as *HybridPublicKey and others as *ecdh.PublicKey.
+func ParsePublicKey(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	if block.Type == hybridPublicPEMType {
+		return NewHybridPublicKey(block.Bytes)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		if k, err1 := x509.ParsePKCS1PublicKey(block.Bytes); err1 == nil {
+			return k, nil
+		}
+		return nil, err
+	}
+	if k, ok := pub.(*ecdsa.PublicKey); ok {
+		return k.ECDH()
+	}
+	return pub, nil
+}
+
+// ParsePublicKeys parses every PEM encoded public key in pemBytes, such as a
+// recipients file. Text outside the PEM blocks is ignored, so keys can be
+// annotated.
+func ParsePublicKeys(pemBytes []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if !strings.HasSuffix(block.Type, "PUBLIC KEY") {
+			continue
+		}
+		pub, err := ParsePublicKey(pem.EncodeToMemory(block))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM public keys found")
+	}
+	return keys, nil
+}
+
+// ReadPublicKey reads a PEM encoded public key of any supported type from
+// path.
+func ReadPublicKey(path string) (crypto.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(b)
+}
+
+// ReadPublicKeys reads every PEM encoded public key in the file at path.
+func ReadPublicKeys(path string) ([]crypto.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKeys(b)
+}
+
+// ParsePrivateKey parses a PEM encoded private key in PKCS#1, PKCS#8 or SEC 1
+// (EC) form, or a hybrid ML-KEM-768 + X25519 key. RSA keys are returned as
+// *rsa.PrivateKey, X25519 and NIST curve keys as *ecdh.PrivateKey and hybrid
+// keys as *HybridPrivateKey. Encrypted keys yield ErrEncryptedKey; see
+// ParseEncryptedPrivateKey.
+func ParsePrivateKey(pemBytes []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	if err := checkUnencrypted(block); err != nil {
+		return nil, err
+	}
+	return parsePrivateKeyBlock(block)
+}
+
+// ParseEncryptedPrivateKey is like ParsePrivateKey, but decrypts keys
+// encrypted with PKCS#8 PBES2 ("ENCRYPTED PRIVATE KEY") using passphrase.
+// Unencrypted keys are returned as they are.
+func ParseEncryptedPrivateKey(pemBytes, passphrase []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	if !isEncryptedPEM(block) {
+		return ParsePrivateKey(pemBytes)
+	}
+	der, err := decryptPKCS8(block.Bytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKeyBlock(&pem.Block{Type: strings.TrimPrefix(block.Type, "ENCRYPTED "), Bytes: der})
+}
+
+func isEncryptedPEM(block *pem.Block) bool {
+	return strings.HasPrefix(block.Type, "ENCRYPTED ")
+}
+
+// checkUnencrypted reports encrypted keys, including the legacy OpenSSL
+// "Proc-Type: 4,ENCRYPTED" form, which is not supported.
+func checkUnencrypted(block *pem.Block) error {
+	if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+		return errors.New("legacy PEM encryption is not supported; convert the key with openssl pkcs8 -topk8 -v2 aes-256-cbc")
+	}
+	if isEncryptedPEM(block) {
+		return ErrEncryptedKey
+	}
+	return nil
+}
+
+func parsePrivateKeyBlock(block *pem.Block) (crypto.PrivateKey, error) {
+	if block.Type == hybridPrivatePEMType {
+		return NewHybridPrivateKey(block.Bytes)
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k.ECDH()
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if ek, ok := k.(*ecdsa.PrivateKey); ok {
+		return ek.ECDH()
+	}
+	return k, nil
+}
+
+// ReadPrivateKey reads a PEM encoded private key of any supported type from
+// path.
+func ReadPrivateKey(path string) (crypto.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(b)
+}
+
+// ReadPrivateKeyFunc is like ReadPrivateKey, but if the key is encrypted it
+// calls passphrase for the passphrase to decrypt it with.
+func ReadPrivateKeyFunc(path string, passphrase func() ([]byte, error)) (crypto.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ParsePrivateKey(b)
+	if !errors.Is(err, ErrEncryptedKey) {
+		return k, err
+	}
+	p, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	return ParseEncryptedPrivateKey(b, p)
+}
+
+// ReadRSAPrivateKeyFunc is ReadPrivateKeyFunc for RSA keys.
+func ReadRSAPrivateKeyFunc(path string, passphrase func() ([]byte, error)) (*rsa.PrivateKey, error) {
+	k, err := ReadPrivateKeyFunc(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("PEM is not RSA private key")
+	}
+	return rk, nil
+}
+
+// MarshalPublicKeyPEM encodes pub as PEM, in PKIX form except for hybrid
+// keys.
+func MarshalPublicKeyPEM(pub crypto.PublicKey) ([]byte, error) {
+	if k, ok := pub.(*HybridPublicKey); ok {
+		return pem.EncodeToMemory(&pem.Block{Type: hybridPublicPEMType, Bytes: k.Bytes()}), nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// MarshalPrivateKeyPEM encodes priv as PEM, in PKCS#8 form except for hybrid
+// keys.
+func MarshalPrivateKeyPEM(priv crypto.PrivateKey) ([]byte, error) {
+	if k, ok := priv.(*HybridPrivateKey); ok {
+		return pem.EncodeToMemory(&pem.Block{Type: hybridPrivatePEMType, Bytes: k.Bytes()}), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// MarshalEncryptedPrivateKeyPEM is like MarshalPrivateKeyPEM, but encrypts
+// the key with passphrase using PKCS#8 PBES2 (PBKDF2-HMAC-SHA256,
+// AES-256-CBC), which OpenSSL can read for non-hybrid keys.
+func MarshalEncryptedPrivateKeyPEM(priv crypto.PrivateKey, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	plain, err := MarshalPrivateKeyPEM(priv)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(plain)
+	der, err := encryptPKCS8(block.Bytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED " + block.Type, Bytes: der}), nil
+}
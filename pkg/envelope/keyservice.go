@@ -0,0 +1,325 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The key service protocol lets unpack have data keys unwrapped by a service
+// that holds the private key, e.g. in front of a KMS or HSM, so the key never
+// reaches the decrypting host. It is JSON over HTTPS; binary values are
+// unpadded base64url:
+//
+//	GET  /v1/keys               -> {"keys": [KeyInfo, ...]}
+//	GET  /v1/keys/{key_id}      -> KeyInfo
+//	POST /v1/keys/{key_id}/unwrap
+//	     {"key_wrap": "...", "wrapped_key": "..."} -> {"key": "..."}
+//
+// KeyInfo is {"key_id": "...", "key_wrap": "...", "public_key": "<PEM>"}, with
+// key_id the KeyFingerprint of public_key. Errors are non-2xx responses with
+// a body of {"error": "..."}. When the service requires it, requests carry
+// "Authorization: Bearer <token>".
+
+// maxKeyServiceBody bounds key service requests and responses.
+const maxKeyServiceBody = 1 << 20
+
+// KeyInfo describes a key held by a key service.
+type KeyInfo struct {
+	KeyID     string `json:"key_id"`
+	KeyWrap   string `json:"key_wrap"`
+	PublicKey string `json:"public_key"`
+}
+
+type keyList struct {
+	Keys []KeyInfo `json:"keys"`
+}
+
+type unwrapRequest struct {
+	KeyWrap    string `json:"key_wrap"`
+	WrappedKey string `json:"wrapped_key"`
+}
+
+type unwrapResponse struct {
+	Key string `json:"key"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// RemoteKeyOptions configures NewRemoteUnwrapper.
+type RemoteKeyOptions struct {
+	// URL is the key service's base URL. Plain http is only accepted for
+	// loopback addresses.
+	URL string
+	// Socket, if set, is the Unix socket of a key agent (see ListenKeyAgent)
+	// to send requests over instead of URL.
+	Socket string
+	// KeyID selects the service's key; it may be empty if the service holds
+	// a single key.
+	KeyID string
+	// Token, if set, is sent as a bearer token.
+	Token string
+	// HTTPClient sends the requests; nil uses http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// remoteUnwrapper has data keys unwrapped by a key service.
+type remoteUnwrapper struct {
+	base   *url.URL
+	info   KeyInfo
+	token  string
+	client *http.Client
+}
+
+// NewRemoteUnwrapper returns a KeyUnwrapper that sends wrapped keys to the key
+// service at opts.URL. It looks the key up first and checks that the public
+// key the service reports matches its key ID and key-wrap algorithm.
+func NewRemoteUnwrapper(ctx context.Context, opts RemoteKeyOptions) (KeyUnwrapper, error) {
+	if opts.Socket != "" {
+		if opts.URL != "" {
+			return nil, errors.New("both a key service URL and a socket given")
+		}
+		var d net.Dialer
+		opts.URL = "http://localhost"
+		opts.HTTPClient = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, "unix", opts.Socket)
+			},
+		}}
+	}
+	base, err := url.Parse(strings.TrimSuffix(opts.URL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key service URL: %w", err)
+	}
+	switch base.Scheme {
+	case "https":
+	case "http":
+		if h := base.Hostname(); h != "localhost" && !net.ParseIP(h).IsLoopback() {
+			return nil, fmt.Errorf("key service %s must use https unless it is on a loopback address", base.Host)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key service URL scheme %q", base.Scheme)
+	}
+	u := &remoteUnwrapper{base: base, token: opts.Token, client: opts.HTTPClient}
+	if u.client == nil {
+		u.client = http.DefaultClient
+	}
+
+	if opts.KeyID == "" {
+		var list keyList
+		if err := u.call(ctx, http.MethodGet, "/v1/keys", nil, &list); err != nil {
+			return nil, err
+		}
+		if len(list.Keys) != 1 {
+			ids := make([]string, len(list.Keys))
+			for i, k := range list.Keys {
+				ids[i] = k.KeyID
+			}
+			return nil, fmt.Errorf("key service holds %d keys; choose one by key ID (%s)", len(ids), strings.Join(ids, ", "))
+		}
+		u.info = list.Keys[0]
+	} else if err := u.call(ctx, http.MethodGet, "/v1/keys/"+url.PathEscape(opts.KeyID), nil, &u.info); err != nil {
+		return nil, err
+	}
+
+	pub, err := ParsePublicKey([]byte(u.info.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("key service public key: %w", err)
+	}
+	w, err := NewKeyWrapper(pub)
+	if err != nil {
+		return nil, fmt.Errorf("key service public key: %w", err)
+	}
+	if w.KeyID() != u.info.KeyID || (opts.KeyID != "" && opts.KeyID != u.info.KeyID) {
+		return nil, fmt.Errorf("key service reported key %s for public key %s", u.info.KeyID, w.KeyID())
+	}
+	if w.Algorithm() != u.info.KeyWrap {
+		return nil, fmt.Errorf("key service reported %s for a %s key", u.info.KeyWrap, w.Algorithm())
+	}
+	return u, nil
+}
+
+func (u *remoteUnwrapper) Algorithm() string { return u.info.KeyWrap }
+func (u *remoteUnwrapper) KeyID() string     { return u.info.KeyID }
+
+func (u *remoteUnwrapper) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	req := unwrapRequest{KeyWrap: u.info.KeyWrap, WrappedKey: base64.RawURLEncoding.EncodeToString(wrapped)}
+	var resp unwrapResponse
+	if err := u.call(ctx, http.MethodPost, "/v1/keys/"+url.PathEscape(u.info.KeyID)+"/unwrap", req, &resp); err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(resp.Key)
+}
+
+// call sends a key service request and decodes its JSON response into out.
+func (u *remoteUnwrapper) call(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.base.String()+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if u.token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.token)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("key service: %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxKeyServiceBody+1))
+	if err != nil {
+		return fmt.Errorf("key service: %w", err)
+	}
+	if len(b) > maxKeyServiceBody {
+		return fmt.Errorf("key service: response larger than %d bytes", maxKeyServiceBody)
+	}
+	if resp.StatusCode/100 != 2 {
+		var e errorResponse
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return fmt.Errorf("key service: %s (%s)", e.Error, resp.Status)
+		}
+		return fmt.Errorf("key service: %s", resp.Status)
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("key service: invalid response: %w", err)
+	}
+	return nil
+}
+
+// KeyServiceOptions configures NewKeyServiceHandler.
+type KeyServiceOptions struct {
+	// Token, if set, must be presented by clients as a bearer token.
+	Token string
+	// Log receives a line for every unwrap; nil discards them.
+	Log io.Writer
+}
+
+// keyService serves the key service protocol for locally held keys.
+type keyService struct {
+	keys  map[string]KeyUnwrapper
+	infos []KeyInfo
+	opts  KeyServiceOptions
+}
+
+// NewKeyServiceHandler serves the key service protocol for the given private
+// keys: as a local stand-in for a KMS-backed service, for development and
+// tests of remote unwrapping, or as a key agent on a socket from
+// ListenKeyAgent.
+func NewKeyServiceHandler(keys []crypto.PrivateKey, opts KeyServiceOptions) (http.Handler, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys to serve")
+	}
+	s := &keyService{keys: make(map[string]KeyUnwrapper), opts: opts}
+	for _, k := range keys {
+		u, err := NewKeyUnwrapper(k)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := PublicKeyOf(k)
+		if err != nil {
+			return nil, err
+		}
+		pemBytes, err := MarshalPublicKeyPEM(pub)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := s.keys[u.KeyID()]; dup {
+			return nil, fmt.Errorf("key %s given twice", u.KeyID())
+		}
+		s.keys[u.KeyID()] = u
+		s.infos = append(s.infos, KeyInfo{KeyID: u.KeyID(), KeyWrap: u.Algorithm(), PublicKey: string(pemBytes)})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, keyList{s.infos})
+	})
+	mux.HandleFunc("GET /v1/keys/{kid}", func(w http.ResponseWriter, r *http.Request) {
+		for _, info := range s.infos {
+			if info.KeyID == r.PathValue("kid") {
+				writeJSON(w, http.StatusOK, info)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, errorResponse{"unknown key " + r.PathValue("kid")})
+	})
+	mux.HandleFunc("POST /v1/keys/{kid}/unwrap", s.unwrap)
+	return s.authorize(mux), nil
+}
+
+// authorize rejects requests without the configured bearer token.
+func (s *keyService) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.Token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(s.opts.Token)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, errorResponse{"missing or invalid bearer token"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *keyService) unwrap(w http.ResponseWriter, r *http.Request) {
+	kid := r.PathValue("kid")
+	u, ok := s.keys[kid]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, errorResponse{"unknown key " + kid})
+		return
+	}
+	var req unwrapRequest
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxKeyServiceBody))
+	if err == nil {
+		err = decodeStrict(b, &req)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{"invalid request: " + err.Error()})
+		return
+	}
+	if req.KeyWrap != u.Algorithm() {
+		writeJSON(w, http.StatusBadRequest, errorResponse{fmt.Sprintf("key %s is for %s, not %s", kid, u.Algorithm(), req.KeyWrap)})
+		return
+	}
+	wrapped, err := base64.RawURLEncoding.DecodeString(req.WrappedKey)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{"invalid wrapped_key"})
+		return
+	}
+	key, err := u.UnwrapKey(r.Context(), wrapped)
+	if err != nil {
+		logf(s.opts.Log, "Unwrap for key %s from %s failed: %v\n", kid, r.RemoteAddr, err)
+		writeJSON(w, http.StatusUnprocessableEntity, errorResponse{"unwrap failed"})
+		return
+	}
+	logf(s.opts.Log, "Unwrapped a key for %s with key %s\n", r.RemoteAddr, kid)
+	writeJSON(w, http.StatusOK, unwrapResponse{base64.RawURLEncoding.EncodeToString(key)})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,145 @@
+package envelope
+
+import (
+	"context"
+	"crypto"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newServiceKey(t *testing.T, keyType string) (crypto.PrivateKey, KeyInfo) {
+	t.Helper()
+	priv, err := GenerateKey(keyType, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := PublicKeyOf(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewKeyWrapper(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes, err := MarshalPublicKeyPEM(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, KeyInfo{KeyID: w.KeyID(), KeyWrap: w.Algorithm(), PublicKey: string(pemBytes)}
+}
+
+func TestKeyServiceRoundTrip(t *testing.T) {
+	k1, info1 := newServiceKey(t, KeyTypeX25519)
+	k2, info2 := newServiceKey(t, KeyTypeRSA)
+	h, err := NewKeyServiceHandler([]crypto.PrivateKey{k1, k2}, KeyServiceOptions{Token: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	ctx := context.Background()
+
+	for _, info := range []KeyInfo{info1, info2} {
+		u, err := NewRemoteUnwrapper(ctx, RemoteKeyOptions{URL: srv.URL + "/", KeyID: info.KeyID, Token: "s3cret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := ParsePublicKey([]byte(info.PublicKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := NewKeyWrapper(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpackTest(t, packTest(t, PackOptions{Recipients: []KeyWrapper{w}}), UnpackOptions{KeyUnwrapper: u})
+	}
+
+	for name, opts := range map[string]RemoteKeyOptions{
+		"several keys, none chosen": {URL: srv.URL, Token: "s3cret"},
+		"unknown key":               {URL: srv.URL, KeyID: strings.Repeat("0", 64), Token: "s3cret"},
+		"wrong token":               {URL: srv.URL, KeyID: info1.KeyID, Token: "guess"},
+		"no token":                  {URL: srv.URL, KeyID: info1.KeyID},
+		"plain http off loopback":   {URL: "http://keys.example.com", KeyID: info1.KeyID},
+		"socket and URL":            {URL: srv.URL, Socket: "/tmp/agent.sock"},
+	} {
+		if _, err := NewRemoteUnwrapper(ctx, opts); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	if _, err := NewKeyServiceHandler([]crypto.PrivateKey{k1, k1}, KeyServiceOptions{}); err == nil {
+		t.Error("key served twice")
+	}
+}
+
+// TestRemoteUnwrapperResponses checks that misbehaving key services are
+// refused.
+func TestRemoteUnwrapperResponses(t *testing.T) {
+	_, info := newServiceKey(t, KeyTypeX25519)
+	_, other := newServiceKey(t, KeyTypeX25519)
+	_, p256 := newServiceKey(t, KeyTypeP256)
+	respond := func(status int, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}
+	}
+	keyInfo := func(info KeyInfo) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, info)
+		}
+	}
+	swapped := info
+	swapped.KeyID = other.KeyID
+	mislabeled := info
+	mislabeled.KeyWrap = p256.KeyWrap
+
+	tests := []struct {
+		name string
+		h    http.Handler
+		want string // error substring
+	}{
+		{"error status with message", respond(http.StatusForbidden, `{"error":"not yours"}`), "not yours (403 Forbidden)"},
+		{"error status", respond(http.StatusBadGateway, "<html>upstream down</html>"), "502 Bad Gateway"},
+		{"malformed JSON", respond(http.StatusOK, `{"key_id":`), "invalid response"},
+		{"oversized response", respond(http.StatusOK, `{"key_id":"`+strings.Repeat("a", maxKeyServiceBody)+`"}`), "larger than"},
+		{"key ID mismatch", keyInfo(swapped), "reported key " + other.KeyID},
+		{"key wrap mismatch", keyInfo(mislabeled), "reported " + p256.KeyWrap + " for a " + info.KeyWrap},
+		{"no public key", keyInfo(KeyInfo{KeyID: info.KeyID, KeyWrap: info.KeyWrap}), "public key"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.h)
+			defer srv.Close()
+			_, err := NewRemoteUnwrapper(context.Background(), RemoteKeyOptions{URL: srv.URL, KeyID: info.KeyID})
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+
+	t.Run("other key selected", func(t *testing.T) {
+		srv := httptest.NewServer(keyInfo(info))
+		defer srv.Close()
+		if _, err := NewRemoteUnwrapper(context.Background(), RemoteKeyOptions{URL: srv.URL, KeyID: other.KeyID}); err == nil {
+			t.Error("service answered with another key")
+		}
+	})
+	t.Run("malformed unwrap response", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.Handle("GET /v1/keys/{kid}", keyInfo(info))
+		mux.Handle("POST /v1/keys/{kid}/unwrap", respond(http.StatusOK, `{"key":"not base64!"}`))
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+		u, err := NewRemoteUnwrapper(context.Background(), RemoteKeyOptions{URL: srv.URL, KeyID: info.KeyID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := u.UnwrapKey(context.Background(), []byte("wrapped")); err == nil {
+			t.Error("malformed key accepted")
+		}
+	})
+}
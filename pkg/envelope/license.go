@@ -0,0 +1,194 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// licensePlaceholderKey fills the key slot of the token format unless the
+// token carries a license key share, which takes its place as unpadded
+// base64url. Binding attributes follow as ";pkg=<package ID>" and
+// ";cust=<customer key fingerprint>"; releases that predate bindings ignore
+// the slot and accept such tokens unbound.
+const licensePlaceholderKey = "NOFERNET"
+
+// License is the information carried by a vendor license token.
+type License struct {
+	// Version is the token format: 1 for legacy colon-delimited tokens, 2
+	// for structured tokens (see IssueLicense).
+	Version int
+	// KeyID is the KeyFingerprint of the vendor key that signed a version 2
+	// token.
+	KeyID   string
+	Expiry  time.Time
+	Company string
+	Email   string
+	// IssuedAt, NotBefore, Subject and Entitlements are only carried by
+	// version 2 tokens.
+	IssuedAt     time.Time
+	NotBefore    time.Time
+	Subject      string
+	Entitlements map[string]any
+	// PackageID, if set, restricts the license to the package whose manifest
+	// has this package_id.
+	PackageID string
+	// CustomerKey, if set, restricts the license to the customer whose
+	// public key has this KeyFingerprint.
+	CustomerKey string
+	// KeyShare is the license key share of the package the token is bound
+	// to, for packages made with PackOptions.LicenseKeyShare.
+	KeyShare []byte
+}
+
+// IssueLegacyLicense signs l with the vendor private key and returns a
+// version 1 token, for unpackers that predate version 2 tokens. The format is
+// base64url( expiry:company:email:placeholder_key:signature_b64 ) where the
+// signature is RSA-PSS SHA-256 over everything before it. Only Expiry (as a
+// date), Company, Email, PackageID, CustomerKey and KeyShare are encoded, and
+// none of them may contain a colon.
+func IssueLegacyLicense(priv *rsa.PrivateKey, l License) ([]byte, error) {
+	slot := licensePlaceholderKey
+	if l.KeyShare != nil {
+		slot = base64.RawURLEncoding.EncodeToString(l.KeyShare)
+	}
+	if l.PackageID != "" {
+		slot += ";pkg=" + l.PackageID
+	}
+	if l.CustomerKey != "" {
+		slot += ";cust=" + l.CustomerKey
+	}
+	for _, f := range []string{l.Company, l.Email, slot} {
+		if strings.Contains(f, ":") {
+			return nil, fmt.Errorf("token fields may not contain ':' (%q)", f)
+		}
+	}
+	payload := fmt.Sprintf("%s:%s:%s:%s", l.Expiry.Format(time.DateOnly), l.Company, l.Email, slot)
+	sum := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPSS(rand.Reader, priv, crypto.SHA256, sum[:], nil)
+	if err != nil {
+		return nil, err
+	}
+	token := payload + ":" + base64.URLEncoding.EncodeToString(sig)
+	return []byte(base64.URLEncoding.EncodeToString([]byte(token))), nil
+}
+
+// VerifyLicense checks the token's signature against the vendor public key
+// and returns the license it carries. Both token versions are accepted. It
+// does not check validity dates; see Enforce.
+func VerifyLicense(token []byte, vendorPub *rsa.PublicKey) (*License, error) {
+	t := strings.TrimSpace(string(token))
+	if isTokenV2(t) {
+		return verifyTokenV2(t, vendorPub)
+	}
+	return verifyLegacyToken(t, vendorPub)
+}
+
+func verifyLegacyToken(token string, vendorPub *rsa.PublicKey) (*License, error) {
+	decoded, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token b64: %w", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 5)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("invalid token format")
+	}
+	expiryStr, company, email, kB64, sigB64 := parts[0], parts[1], parts[2], parts[3], parts[4]
+	sig, err := base64.URLEncoding.DecodeString(sigB64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature b64: %w", err)
+	}
+	payload := []byte(expiryStr + ":" + company + ":" + email + ":" + kB64)
+	hashed := sha256.Sum256(payload)
+	if err := rsa.VerifyPSS(vendorPub, crypto.SHA256, hashed[:], sig, nil); err != nil {
+		return nil, fmt.Errorf("token signature invalid: %w", err)
+	}
+	expiry, err := time.Parse(time.DateOnly, expiryStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry date: %w", err)
+	}
+	l := &License{Version: 1, Expiry: expiry, Company: company, Email: email}
+	attrs := strings.Split(kB64, ";")
+	if attrs[0] != licensePlaceholderKey {
+		if l.KeyShare, err = base64.RawURLEncoding.DecodeString(attrs[0]); err != nil || len(l.KeyShare) != KeyShareSize {
+			return nil, fmt.Errorf("invalid token key slot")
+		}
+	}
+	for _, attr := range attrs[1:] {
+		k, v, _ := strings.Cut(attr, "=")
+		switch {
+		case k == "pkg" && l.PackageID == "" && v != "":
+			l.PackageID = v
+		case k == "cust" && l.CustomerKey == "" && v != "":
+			l.CustomerKey = v
+		default:
+			// Fail closed on bindings this release does not understand
+			return nil, fmt.Errorf("unsupported token binding %q", attr)
+		}
+	}
+	return l, nil
+}
+
+// CheckBinding returns an error unless the license may be used for the
+// package with the given ID by the customer whose public key has the given
+// fingerprint. Unbound licenses fit every package and customer.
+func (l *License) CheckBinding(packageID, customerKey string) error {
+	if l.PackageID != "" && l.PackageID != packageID {
+		if packageID == "" {
+			packageID = "a package without an ID"
+		}
+		return fmt.Errorf("❌ License is bound to package %s, not %s", l.PackageID, packageID)
+	}
+	if l.CustomerKey != "" && l.CustomerKey != customerKey {
+		return fmt.Errorf("❌ License is bound to customer key %s, not %s", l.CustomerKey, customerKey)
+	}
+	return nil
+}
+
+// Enforce prints the license information to w, warns when expiry is near,
+// and returns an error if the license is not yet valid, has expired or
+// expires within 24 hours.
+func (l *License) Enforce(now time.Time, w io.Writer) error {
+	logf(w, "\U0001F4C4 License Information:\n")
+	logf(w, "   Company: %s\n", l.Company)
+	logf(w, "   Email: %s\n", l.Email)
+	logf(w, "   Expires: %s\n", l.Expiry.Format(time.DateOnly))
+	if l.PackageID != "" {
+		logf(w, "   Package: %s\n", l.PackageID)
+	}
+	if l.CustomerKey != "" {
+		logf(w, "   Customer key: %s\n", l.CustomerKey)
+	}
+	if l.Subject != "" {
+		logf(w, "   Subject: %s\n", l.Subject)
+	}
+	if len(l.Entitlements) > 0 {
+		logf(w, "   Entitlements: %s\n", formatEntitlements(l.Entitlements))
+	}
+	logf(w, "\n")
+
+	if !l.NotBefore.IsZero() && now.Before(l.NotBefore) {
+		return fmt.Errorf("❌ Token not valid before %s (now: %s)", l.NotBefore.Format(time.RFC3339), now.Format(time.RFC3339))
+	}
+
+	if now.After(l.Expiry) {
+		return fmt.Errorf("❌ Token expired (expiry: %s, now: %s)", l.Expiry.Format(time.DateOnly), now.Format(time.DateOnly))
+	}
+	remaining := l.Expiry.Sub(now).Hours() / 24
+	if remaining <= 7 {
+		logf(w, "⚠️ WARNING: Model access will expire in %d days (%s).\n", int(remaining), l.Expiry.Format(time.DateOnly))
+		logf(w, "⚠️ Please contact sales@sjfisher.com for license renewal.\n")
+	} else {
+		logf(w, "✅ Model access valid for %d more days (expires %s).\n", int(remaining), l.Expiry.Format(time.DateOnly))
+	}
+	if remaining <= 1 {
+		return fmt.Errorf("❌ Model access blocked - license expires within 24 hours.")
+	}
+	return nil
+}
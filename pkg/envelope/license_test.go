@@ -0,0 +1,85 @@
+package envelope
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issuers issue both token versions.
+var issuers = map[string]func(*rsa.PrivateKey, License) ([]byte, error){
+	"legacy": IssueLegacyLicense,
+	"v2":     IssueLicense,
+}
+
+// manifestOf returns the manifest of the zip package zb.
+func manifestOf(t *testing.T, zb []byte) *Manifest {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(zb), int64(len(zb)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if f.Name == ManifestName {
+			b, err := readZipFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := ParseManifest(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return m
+		}
+	}
+	t.Fatal("package has no manifest")
+	return nil
+}
+
+// TestLicenseBinding checks that tokens bound to a package or customer key
+// only open that package for that customer.
+func TestLicenseBinding(t *testing.T) {
+	vendor, vendorPEM := newVendorKey(t)
+	w, u := newTestKey(t, KeyTypeX25519)
+	zb := packTest(t, PackOptions{Recipients: []KeyWrapper{w}, License: true, VendorPublicKey: vendorPEM})
+	pkg := manifestOf(t, zb).PackageID
+	other := packTest(t, PackOptions{Recipients: []KeyWrapper{w}, License: true, VendorPublicKey: vendorPEM})
+	otherPkg := manifestOf(t, other).PackageID
+	_, u2 := newTestKey(t, KeyTypeX25519)
+
+	tests := []struct {
+		name      string
+		pkg, cust string
+		want      string // error substring; empty for success
+	}{
+		{"unbound", "", "", ""},
+		{"this package", pkg, "", ""},
+		{"other package", otherPkg, "", "bound to package"},
+		{"this customer", "", u.KeyID(), ""},
+		{"other customer", "", u2.KeyID(), "bound to customer key"},
+		{"this package and customer", pkg, u.KeyID(), ""},
+		{"this package, other customer", pkg, u2.KeyID(), "bound to customer key"},
+	}
+	for version, issue := range issuers {
+		for _, tc := range tests {
+			t.Run(version+"/"+tc.name, func(t *testing.T) {
+				tok, err := issue(vendor, License{Expiry: time.Now().Add(30 * 24 * time.Hour), Company: "Acme", Email: "ops@example.com", PackageID: tc.pkg, CustomerKey: tc.cust})
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts := UnpackOptions{KeyUnwrapper: u, LicenseToken: tok}
+				err = Unpack(context.Background(), bytes.NewReader(zb), int64(len(zb)), memWriter{}, opts)
+				switch {
+				case tc.want == "" && err != nil:
+					t.Errorf("refused: %v", err)
+				case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+					t.Errorf("got %v, want an error containing %q", err, tc.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// ManifestVersion is the manifest format_version written by this package.
+// Manifests with any other version are rejected, except for the unversioned
+// licensing manifest written by earlier releases.
+const ManifestVersion = 1
+
+// Algorithm identifiers recorded in the manifest. The cipher suite selects
+// how payload chunks are sealed; see the chunked payload format.
+const (
+	SuiteFernet            = "FERNET"
+	SuiteAES256GCM         = "AES-256-GCM"
+	SuiteXChaCha20Poly1305 = "XCHACHA20-POLY1305"
+	KeyWrapRSAOAEP         = "RSA-OAEP-SHA256"
+)
+
+// Version is the secure_packager release recorded in manifests. Release
+// builds set it with -ldflags "-X secure_packager/pkg/envelope.Version=...".
+var Version = "dev"
+
+// Manifest describes a package: how it was encrypted, what it contains and
+// which licensing policy applies. It is stored as manifest.json.
+type Manifest struct {
+	FormatVersion int       `json:"format_version"`
+	PackageID     string    `json:"package_id"`
+	CreatedAt     time.Time `json:"created_at"`
+	ToolVersion   string    `json:"tool_version"`
+	CipherSuite   string    `json:"cipher_suite"`
+	ChunkSize     int       `json:"chunk_size"`
+	// KeyWrap and WrappedKeySHA256 describe the single wrapped_key.bin of
+	// packages made before Recipients was introduced.
+	KeyWrap          string `json:"key_wrap,omitempty"`
+	WrappedKeySHA256 string `json:"wrapped_key_sha256,omitempty"`
+	// Recipients lists the data key wrapped for each recipient.
+	Recipients []ManifestRecipient `json:"recipients,omitempty"`
+	// Threshold, if set, is how many of the custodian recipients' shares
+	// are needed to recover the data key.
+	Threshold int            `json:"threshold,omitempty"`
+	Files     []ManifestFile `json:"files"`
+	// Index, if set, holds the file inventory encrypted with the data key,
+	// and Files is empty: the package is in privacy mode (see
+	// PackOptions.Private).
+	Index   *ManifestIndex `json:"index,omitempty"`
+	License *LicensePolicy `json:"license,omitempty"`
+	// Signer identifies the vendor key manifest.sig was made with.
+	Signer *SignerInfo `json:"signer,omitempty"`
+}
+
+// ManifestFile is the inventory record of one packaged file.
+type ManifestFile struct {
+	// Name is the file's original slash-separated path relative to the
+	// packaged directory.
+	Name string `json:"name"`
+	// Entry is the archive entry holding its encrypted payload.
+	Entry string `json:"entry"`
+	// Size and SHA256 (hex) describe the plaintext.
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// CiphertextSHA256 is the hex SHA-256 of the payload entry.
+	CiphertextSHA256 string `json:"ciphertext_sha256,omitempty"`
+	// PaddedSize, if set, is the length of the zero-padded plaintext the
+	// payload holds; the file is its first Size bytes.
+	PaddedSize int64 `json:"padded_size,omitempty"`
+}
+
+// paddedSize returns the length of the plaintext the payload holds.
+func (mf *ManifestFile) paddedSize() int64 {
+	if mf.PaddedSize != 0 {
+		return mf.PaddedSize
+	}
+	return mf.Size
+}
+
+// ManifestIndex locates the encrypted file inventory of a package in privacy
+// mode. Its hash lets a signature over the manifest cover the inventory.
+type ManifestIndex struct {
+	Entry  string `json:"entry"`
+	SHA256 string `json:"sha256"`
+}
+
+// packageIndex is the plaintext of the encrypted index: the inventory that
+// the manifest of other packages holds, and the packaged directories.
+type packageIndex struct {
+	Files []ManifestFile `json:"files"`
+	Dirs  []string       `json:"dirs,omitempty"`
+}
+
+// ManifestRecipient records the data key wrapped for one recipient. Its hash
+// lets a signature over the manifest cover the wrapped key.
+type ManifestRecipient struct {
+	KeyWrap string `json:"key_wrap"`
+	// KeyID is the KeyFingerprint of the recipient's public key, or for
+	// passphrase recipients the SHA-256 of the KDF salt.
+	KeyID string `json:"key_id"`
+	// Entry is the archive entry holding the wrapped key.
+	Entry  string `json:"entry"`
+	SHA256 string `json:"sha256"`
+	// KDF holds the key-derivation parameters of a passphrase recipient.
+	KDF *KDFParams `json:"kdf,omitempty"`
+	// Certificate identifies the certificate the public key was taken from,
+	// for recipients given as X.509 certificates.
+	Certificate *RecipientCertificate `json:"certificate,omitempty"`
+	// Escrow flags the vendor's recovery key, which can rewrap the data key
+	// for a customer who lost theirs (see Rewrap).
+	Escrow bool `json:"escrow,omitempty"`
+	// Share, if set, marks a custodian: the entry holds the Shamir share of
+	// the data key evaluated at Share rather than the key itself.
+	Share int `json:"share,omitempty"`
+}
+
+// LicensePolicy tells unpack whether a vendor license token is required.
+type LicensePolicy struct {
+	Required bool `json:"required"`
+	// VendorPublicKey names the archive entry holding the vendor public key
+	// tokens are verified with, if one is shipped.
+	VendorPublicKey string `json:"vendor_public_key,omitempty"`
+	// KeyShare, if set, names the archive entry holding the license key
+	// share wrapped for the vendor. The customer's wrapped key then only
+	// yields the data key combined with the share carried in a license token.
+	KeyShare string `json:"key_share,omitempty"`
+}
+
+// legacyManifest is the unversioned manifest earlier releases wrote for
+// licensed packages.
+type legacyManifest struct {
+	LicenseRequired bool   `json:"license_required"`
+	VendorPublicKey string `json:"vendor_public_key"`
+}
+
+// newPackageID returns a random UUID (version 4).
+func newPackageID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Marshal encodes m as indented JSON.
+func (m *Manifest) Marshal() ([]byte, error) {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// ParseManifest decodes and validates a manifest. Unknown fields and unknown
+// format versions are errors. The unversioned licensing manifest of earlier
+// releases is accepted and returned with FormatVersion 0 and no file list.
+func ParseManifest(b []byte) (*Manifest, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(b, &probe); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if _, ok := probe["format_version"]; !ok {
+		var lm legacyManifest
+		if err := decodeStrict(b, &lm); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %w", err)
+		}
+		return &Manifest{License: &LicensePolicy{Required: lm.LicenseRequired, VendorPublicKey: lm.VendorPublicKey}}, nil
+	}
+	var v int
+	if err := json.Unmarshal(probe["format_version"], &v); err != nil {
+		return nil, fmt.Errorf("invalid manifest: format_version: %w", err)
+	}
+	if v != ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest format_version %d (this build understands %d); upgrade secure_packager to unpack this package", v, ManifestVersion)
+	}
+	m := new(Manifest)
+	if err := decodeStrict(b, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return m, nil
+}
+
+func decodeStrict(b []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("trailing data after JSON object")
+	}
+	return nil
+}
+
+func (m *Manifest) validate() error {
+	if m.PackageID == "" {
+		return errors.New("missing package_id")
+	}
+	if !isSuite(m.CipherSuite) {
+		return fmt.Errorf("unsupported cipher_suite %q", m.CipherSuite)
+	}
+	if m.ChunkSize <= 0 || m.ChunkSize > MaxChunkSize {
+		return fmt.Errorf("invalid chunk_size %d", m.ChunkSize)
+	}
+	if len(m.Recipients) == 0 {
+		if m.KeyWrap != KeyWrapRSAOAEP {
+			return fmt.Errorf("unsupported key_wrap %q", m.KeyWrap)
+		}
+		if m.WrappedKeySHA256 != "" && !isSHA256Hex(m.WrappedKeySHA256) {
+			return errors.New("invalid wrapped_key_sha256")
+		}
+	} else if m.KeyWrap != "" || m.WrappedKeySHA256 != "" {
+		return errors.New("key_wrap and wrapped_key_sha256 are replaced by recipients")
+	}
+	kids := make(map[string]bool, len(m.Recipients))
+	keyEntries := make(map[string]bool, len(m.Recipients))
+	passphrases, escrow := 0, ""
+	shares := make(map[int]bool)
+	for _, r := range m.Recipients {
+		switch r.KeyWrap {
+		case KeyWrapRSAOAEP, KeyWrapX25519, KeyWrapP256, KeyWrapMLKEM768X25519:
+			if r.KDF != nil {
+				return fmt.Errorf("unexpected kdf for recipient %s", r.KeyID)
+			}
+		case KeyWrapArgon2id, KeyWrapScrypt:
+			if r.KDF == nil {
+				return fmt.Errorf("missing kdf for recipient %s", r.KeyID)
+			}
+			if err := r.KDF.validate(r.KeyWrap); err != nil {
+				return err
+			}
+			if passphrases++; passphrases > 1 {
+				return errors.New("more than one passphrase recipient")
+			}
+		default:
+			return fmt.Errorf("unsupported key_wrap %q", r.KeyWrap)
+		}
+		if r.Escrow && isPassphraseWrap(r.KeyWrap) {
+			return fmt.Errorf("passphrase recipient %s cannot be an escrow key", r.KeyID)
+		}
+		if r.Escrow {
+			escrow = r.KeyID
+		}
+		if r.Share != 0 {
+			if r.Share < 0 || r.Share > MaxCustodians || shares[r.Share] {
+				return fmt.Errorf("invalid share %d for recipient %s", r.Share, r.KeyID)
+			}
+			if r.Escrow || isPassphraseWrap(r.KeyWrap) {
+				return fmt.Errorf("recipient %s cannot be a custodian", r.KeyID)
+			}
+			shares[r.Share] = true
+		}
+		if r.Certificate != nil {
+			if isPassphraseWrap(r.KeyWrap) {
+				return fmt.Errorf("unexpected certificate for recipient %s", r.KeyID)
+			}
+			if err := r.Certificate.validate(); err != nil {
+				return err
+			}
+		}
+		if !isSHA256Hex(r.KeyID) || !isSHA256Hex(r.SHA256) {
+			return fmt.Errorf("invalid key_id or sha256 for recipient entry %s", r.Entry)
+		}
+		if !fs.ValidPath(r.Entry) || strings.HasSuffix(r.Entry, PayloadSuffix) {
+			return fmt.Errorf("illegal recipient entry: %s", r.Entry)
+		}
+		if kids[r.KeyID] || keyEntries[r.Entry] {
+			return fmt.Errorf("duplicate recipient: %s", r.KeyID)
+		}
+		kids[r.KeyID], keyEntries[r.Entry] = true, true
+	}
+	if (m.Threshold != 0 || len(shares) > 0) && (m.Threshold < 2 || m.Threshold > len(shares)) {
+		return fmt.Errorf("invalid threshold %d for %d custodian shares", m.Threshold, len(shares))
+	}
+	if len(shares) > 0 && escrow != "" {
+		return fmt.Errorf("escrow recipient %s could recover the data key without the custodians", escrow)
+	}
+	if m.Signer != nil && (m.Signer.Algorithm != SigRSAPSS || !isSHA256Hex(m.Signer.KeyID)) {
+		return fmt.Errorf("unsupported signer %q", m.Signer.Algorithm)
+	}
+	if m.Index != nil {
+		if len(m.Files) > 0 {
+			return errors.New("files are listed both in the manifest and in the encrypted index")
+		}
+		if !fs.ValidPath(m.Index.Entry) || strings.HasSuffix(m.Index.Entry, PayloadSuffix) || !isSHA256Hex(m.Index.SHA256) {
+			return fmt.Errorf("invalid index entry %s", m.Index.Entry)
+		}
+	}
+	return validateFiles(m.Files)
+}
+
+// validateFiles checks a file inventory, from the manifest or the encrypted
+// index.
+func validateFiles(files []ManifestFile) error {
+	names := make(map[string]bool, len(files))
+	entries := make(map[string]bool, len(files))
+	for _, f := range files {
+		if !fs.ValidPath(f.Name) || f.Name == "." || strings.Contains(f.Name, "\\") {
+			return fmt.Errorf("illegal file path: %s", f.Name)
+		}
+		if !strings.HasSuffix(f.Entry, PayloadSuffix) || !fs.ValidPath(f.Entry) {
+			return fmt.Errorf("illegal payload entry: %s", f.Entry)
+		}
+		if names[f.Name] || entries[f.Entry] {
+			return fmt.Errorf("duplicate file: %s", f.Name)
+		}
+		if f.Size < 0 || (f.PaddedSize != 0 && f.PaddedSize < f.Size) || !isSHA256Hex(f.SHA256) || (f.CiphertextSHA256 != "" && !isSHA256Hex(f.CiphertextSHA256)) {
+			return fmt.Errorf("invalid size or sha256 for %s", f.Name)
+		}
+		names[f.Name], entries[f.Entry] = true, true
+	}
+	return nil
+}
+
+func isSuite(s string) bool {
+	return s == SuiteFernet || s == SuiteAES256GCM || s == SuiteXChaCha20Poly1305
+}
+
+func isSHA256Hex(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size && s == strings.ToLower(s)
+}
+
+// checkSHA256 reports whether sum matches the hex digest want; an empty want
+// is not checked.
+func checkSHA256(what string, sum []byte, want string) error {
+	if want != "" && hex.EncodeToString(sum) != want {
+		return fmt.Errorf("%s: SHA-256 does not match manifest", what)
+	}
+	return nil
+}
+
+// check compares a decrypted file's size and digest with the inventory
+// record; a nil record (no manifest) accepts anything.
+func (mf *ManifestFile) check(size int64, sum [sha256.Size]byte) error {
+	if mf == nil {
+		return nil
+	}
+	if size != mf.Size {
+		return fmt.Errorf("%s: size %d does not match manifest (%d)", mf.Name, size, mf.Size)
+	}
+	return checkSHA256(mf.Name, sum[:], mf.SHA256)
+}
@@ -0,0 +1,108 @@
+package envelope
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testSHA256 = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+// manifestJSON returns a valid manifest, decoded generically and changed by
+// edit, as JSON.
+func manifestJSON(t *testing.T, edit func(m map[string]any)) []byte {
+	t.Helper()
+	m := &Manifest{
+		FormatVersion: ManifestVersion,
+		PackageID:     "2f0c5f8e-8c55-4c1e-9a51-2b7f3f1f6d0a",
+		CipherSuite:   SuiteFernet,
+		ChunkSize:     DefaultChunkSize,
+		Recipients: []ManifestRecipient{
+			{KeyWrap: KeyWrapRSAOAEP, KeyID: testSHA256, Entry: WrappedKeyName, SHA256: testSHA256},
+		},
+		Files: []ManifestFile{{Name: "dir/a.txt", Entry: "dir/a.txt" + PayloadSuffix, Size: 4, SHA256: testSHA256}},
+	}
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g map[string]any
+	if err := json.Unmarshal(b, &g); err != nil {
+		t.Fatal(err)
+	}
+	if edit != nil {
+		edit(g)
+	}
+	if b, err = json.Marshal(g); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func file0(m map[string]any) map[string]any {
+	return m["files"].([]any)[0].(map[string]any)
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(m map[string]any)
+		want string // error substring; empty for success
+	}{
+		{"valid", nil, ""},
+		{"unknown field", func(m map[string]any) { m["extra"] = 1 }, "unknown field"},
+		{"unknown file field", func(m map[string]any) { file0(m)["mode"] = 0644 }, "unknown field"},
+		{"newer format_version", func(m map[string]any) { m["format_version"] = ManifestVersion + 1 }, "unsupported manifest format_version"},
+		{"format_version not a number", func(m map[string]any) { m["format_version"] = "2" }, "format_version"},
+		{"missing package_id", func(m map[string]any) { delete(m, "package_id") }, "missing package_id"},
+		{"unknown cipher_suite", func(m map[string]any) { m["cipher_suite"] = "rot13" }, "unsupported cipher_suite"},
+		{"duplicate file path", func(m map[string]any) {
+			f := map[string]any{}
+			for k, v := range file0(m) {
+				f[k] = v
+			}
+			f["entry"] = "other" + PayloadSuffix
+			m["files"] = append(m["files"].([]any), f)
+		}, "duplicate file"},
+		{"parent path", func(m map[string]any) { file0(m)["name"] = "../a.txt" }, "illegal file path"},
+		{"absolute path", func(m map[string]any) { file0(m)["name"] = "/etc/passwd" }, "illegal file path"},
+		{"backslash path", func(m map[string]any) { file0(m)["name"] = `dir\a.txt` }, "illegal file path"},
+		{"illegal payload entry", func(m map[string]any) { file0(m)["entry"] = "../a.txt" + PayloadSuffix }, "illegal payload entry"},
+		{"short sha256", func(m map[string]any) { file0(m)["sha256"] = "9f86d081" }, "invalid size or sha256"},
+		{"sha256 not hex", func(m map[string]any) { file0(m)["sha256"] = strings.Repeat("zz", 32) }, "invalid size or sha256"},
+		{"negative size", func(m map[string]any) { file0(m)["size"] = -1 }, "invalid size or sha256"},
+		{"bad recipient sha256", func(m map[string]any) {
+			m["recipients"].([]any)[0].(map[string]any)["sha256"] = "00"
+		}, "invalid key_id or sha256"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := ParseManifest(manifestJSON(t, tc.edit))
+			switch {
+			case tc.want == "" && err != nil:
+				t.Fatalf("valid manifest rejected: %v", err)
+			case tc.want == "" && (m.FormatVersion != ManifestVersion || len(m.Files) != 1):
+				t.Errorf("parsed %+v", m)
+			case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+
+	if _, err := ParseManifest(append(manifestJSON(t, nil), "{}"...)); err == nil {
+		t.Error("trailing data accepted")
+	}
+}
+
+func TestParseLegacyManifest(t *testing.T) {
+	m, err := ParseManifest([]byte(`{"license_required": true, "vendor_public_key": "vendor_public.pem"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.FormatVersion != 0 || m.Files != nil || m.License == nil || !m.License.Required || m.License.VendorPublicKey != "vendor_public.pem" {
+		t.Errorf("legacy manifest parsed as %+v", m)
+	}
+	if _, err := ParseManifest([]byte(`{"license_required": true, "files": []}`)); err == nil {
+		t.Error("legacy manifest with an unknown field accepted")
+	}
+}
@@ -0,0 +1,369 @@
+package envelope
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/fernet/fernet-go"
+)
+
+// PackOptions configures Pack and PackTo.
+type PackOptions struct {
+	// PublicKey is the customer's RSA public key the data key is wrapped for.
+	PublicKey *rsa.PublicKey
+	// Recipients are further key wrappers the data key is wrapped with, so
+	// that several customers or teams, with RSA or elliptic-curve keys, can
+	// unpack the same package. See NewKeyWrapper, NewPassphraseWrapper for a
+	// passphrase recipient, and NewEscrowWrapper for a vendor escrow key.
+	Recipients []KeyWrapper
+	// Custodians split the data key so that no one of them can decrypt
+	// alone: each gets a Shamir share, and Threshold of the shares recover
+	// the key (see ExportCustodianShare). Recipients still get the whole key.
+	Custodians []KeyWrapper
+	Threshold  int
+	// License marks the package as requiring a vendor license token at unpack
+	// time. VendorPublicKey must then hold the vendor's PEM public key, which
+	// is shipped inside the package so tokens can be verified.
+	License         bool
+	VendorPublicKey []byte
+	// LicenseKeyShare makes the license token a decryption factor: the data
+	// key is split so that the customer's wrapped key only recovers it
+	// combined with a key share, which is wrapped for the vendor and handed
+	// to the customer inside a license token (see ReadKeyShare). Requires
+	// License.
+	LicenseKeyShare bool
+	// SigningKey, if set, is the vendor private key manifest.json is signed
+	// with. The manifest records the hash of the wrapped key and of every
+	// payload entry, so the signature covers the whole package.
+	SigningKey *rsa.PrivateKey
+	// CipherSuite seals the payload chunks: SuiteFernet (the default, readable
+	// by every release), SuiteAES256GCM or SuiteXChaCha20Poly1305. The AEAD
+	// suites store raw binary chunks, avoiding Fernet's base64 expansion.
+	CipherSuite string
+	// ChunkSize is the plaintext size of each encrypted chunk; zero selects
+	// DefaultChunkSize.
+	ChunkSize int
+	// Private hides file names and sizes: payload entries get random names,
+	// the file inventory is encrypted into an index entry instead of being
+	// listed in the manifest, and files are padded to size buckets. Packages
+	// made this way need a release that understands the index to unpack.
+	Private bool
+	// Exclude, if set, reports input paths (slash-separated, relative to src)
+	// that must not be packaged; excluding a directory skips its whole tree.
+	Exclude func(name string) bool
+	// Log receives progress messages; nil discards them.
+	Log io.Writer
+}
+
+// Pack encrypts every regular file in the tree rooted at src and writes the
+// resulting package to w as a zip archive, keeping each file's relative path.
+// Files are streamed, so memory use does not depend on their size.
+func Pack(ctx context.Context, w io.Writer, src fs.FS, opts PackOptions) error {
+	zw := zip.NewWriter(w)
+	if err := PackTo(ctx, ZipEntryWriter(zw), src, opts); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// PackTo is like Pack but hands the package entries to dst instead of zipping
+// them.
+func PackTo(ctx context.Context, dst EntryWriter, src fs.FS, opts PackOptions) error {
+	recipients := opts.Recipients
+	if opts.PublicKey != nil {
+		w, err := NewKeyWrapper(opts.PublicKey)
+		if err != nil {
+			return err
+		}
+		recipients = append([]KeyWrapper{w}, recipients...)
+	}
+	if len(recipients)+len(opts.Custodians) == 0 {
+		return errors.New("no customer public key")
+	}
+	n := len(opts.Custodians)
+	if (n > 0 || opts.Threshold != 0) && (opts.Threshold < 2 || opts.Threshold > n || n > MaxCustodians) {
+		return fmt.Errorf("invalid threshold %d of %d custodians", opts.Threshold, n)
+	}
+	for _, w := range recipients {
+		if _, ok := w.(escrowWrapper); ok && n > 0 {
+			return fmt.Errorf("escrow recipient %s could recover the data key without the custodians",
+				w.KeyID())
+		}
+	}
+	if opts.License && len(opts.VendorPublicKey) == 0 {
+		return errors.New("license mode requires a vendor public key")
+	}
+	if opts.LicenseKeyShare && !opts.License {
+		return errors.New("license key share requires license mode")
+	}
+	suite := opts.CipherSuite
+	if suite == "" {
+		suite = SuiteFernet
+	}
+	if !isSuite(suite) {
+		return fmt.Errorf("unsupported cipher suite %q", suite)
+	}
+
+	k := new(fernet.Key)
+	if err := k.Generate(); err != nil {
+		return fmt.Errorf("generating fernet key: %w", err)
+	}
+	id, err := newPackageID()
+	if err != nil {
+		return err
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	m := &Manifest{
+		FormatVersion: ManifestVersion,
+		PackageID:     id,
+		CreatedAt:     time.Now().UTC().Truncate(time.Second),
+		ToolVersion:   Version,
+		CipherSuite:   suite,
+		ChunkSize:     chunkSize,
+		Files:         []ManifestFile{},
+	}
+
+	var dirs []string
+	err = fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if opts.Exclude != nil && opts.Exclude(name) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			// Follow links to files, but not to directories, which could loop
+			fi, err := fs.Stat(src, name)
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				logf(opts.Log, "Skipping %s: symlink to a non-regular file\n", name)
+				return nil
+			}
+		} else if d.IsDir() && opts.Private {
+			dirs = append(dirs, name)
+			return nil
+		} else if d.IsDir() {
+			// Record directories so empty ones survive the round trip
+			_, err := dst.Create(name + "/")
+			return err
+		} else if !d.Type().IsRegular() {
+			logf(opts.Log, "Skipping %s: not a regular file\n", name)
+			return nil
+		}
+		entry := name + PayloadSuffix
+		if opts.Private {
+			if entry, err = opaqueEntryName(); err != nil {
+				return err
+			}
+		}
+		mf, err := encryptFile(ctx, dst, src, name, entry, suite, k, chunkSize, opts.Private)
+		if err != nil {
+			return fmt.Errorf("encrypting %s: %w", name, err)
+		}
+		m.Files = append(m.Files, *mf)
+		logf(opts.Log, "Encrypted %s -> %s\n", name, mf.Entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if opts.Private {
+		// Sealed with the whole data key, before any split below
+		if m.Index, err = writeIndex(dst, m.Files, dirs, suite, k, chunkSize); err != nil {
+			return fmt.Errorf("writing %s: %w", IndexName, err)
+		}
+		logf(opts.Log, "Wrote %s (%d files)\n", IndexName, len(m.Files))
+		m.Files = []ManifestFile{}
+	}
+
+	if opts.License {
+		m.License = &LicensePolicy{Required: true, VendorPublicKey: VendorKeyName}
+	}
+	if opts.LicenseKeyShare {
+		vendorPub, err := ParseRSAPublicKey(opts.VendorPublicKey)
+		if err != nil {
+			return fmt.Errorf("parsing vendor public key: %w", err)
+		}
+		share, rest, err := splitKey(k)
+		if err != nil {
+			return err
+		}
+		wrappedShare, err := wrapShare(vendorPub, share)
+		if err != nil {
+			return fmt.Errorf("wrapping key share: %w", err)
+		}
+		if err := writeEntry(dst, KeyShareName, wrappedShare); err != nil {
+			return err
+		}
+		logf(opts.Log, "Wrote %s (issue tokens for this package with -package)\n", KeyShareName)
+		m.License.KeyShare = KeyShareName
+		k = rest
+	}
+
+	if len(opts.Custodians) > 0 {
+		shares, err := splitSecret(k[:], opts.Threshold, len(opts.Custodians))
+		if err != nil {
+			return err
+		}
+		for i, w := range opts.Custodians {
+			recipients = append(recipients, custodianWrapper{w, i + 1, shares[i]})
+		}
+		m.Threshold = opts.Threshold
+	}
+	m.Recipients, err = wrapForRecipients(dst, recipients, k, len(recipients) > 1, opts.Log)
+	if err != nil {
+		return err
+	}
+
+	if opts.SigningKey != nil {
+		kid, err := KeyFingerprint(&opts.SigningKey.PublicKey)
+		if err != nil {
+			return err
+		}
+		m.Signer = &SignerInfo{Algorithm: SigRSAPSS, KeyID: kid}
+	}
+	mb, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(dst, ManifestName, mb); err != nil {
+		return err
+	}
+	logf(opts.Log, "Wrote %s (package %s)\n", ManifestName, m.PackageID)
+	if opts.SigningKey != nil {
+		sig, err := signManifest(opts.SigningKey, mb)
+		if err != nil {
+			return fmt.Errorf("signing manifest: %w", err)
+		}
+		if err := writeEntry(dst, SignatureName, sig); err != nil {
+			return err
+		}
+		logf(opts.Log, "Wrote %s (vendor key %s)\n", SignatureName, m.Signer.KeyID)
+	}
+
+	if opts.License {
+		// Ship the vendor public key alongside the manifest so the unpacker can
+		// verify tokens without external files
+		if err := writeEntry(dst, VendorKeyName, opts.VendorPublicKey); err != nil {
+			return err
+		}
+		logf(opts.Log, "Wrote %s for license enforcement\n", VendorKeyName)
+	}
+	return nil
+}
+
+// wrapForRecipients writes the data key wrapped for each recipient. A single
+// recipient's key goes to wrapped_key.bin as it always has; when the package
+// has several (multi), they are written to wrapped_keys/<key ID>.bin.
+func wrapForRecipients(dst EntryWriter, recipients []KeyWrapper, k *fernet.Key, multi bool,
+	log io.Writer) ([]ManifestRecipient, error) {
+	var out []ManifestRecipient
+	seen := make(map[string]bool, len(recipients))
+	for _, w := range recipients {
+		kid := w.KeyID()
+		if seen[kid] {
+			return nil, fmt.Errorf("recipient %s given twice", kid)
+		}
+		seen[kid] = true
+		key, share := k[:], 0
+		if cw, ok := w.(custodianWrapper); ok {
+			key, share = cw.share, cw.index
+		}
+		wrapped, err := w.WrapKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("wrapping key for %s: %w", kid, err)
+		}
+		entry := WrappedKeyName
+		if multi {
+			entry = WrappedKeysDir + kid + ".bin"
+		}
+		if err := writeEntry(dst, entry, wrapped); err != nil {
+			return nil, err
+		}
+		if share != 0 {
+			logf(log, "Wrote %s (custodian %s, share %d)\n", entry, kid, share)
+		} else {
+			logf(log, "Wrote %s (recipient %s)\n", entry, kid)
+		}
+		sum := sha256.Sum256(wrapped)
+		r := ManifestRecipient{
+			KeyWrap: w.Algorithm(),
+			KeyID:   kid,
+			Entry:   entry,
+			SHA256:  hex.EncodeToString(sum[:]),
+			Share:   share,
+		}
+		if pw, ok := w.(passphraseWrapper); ok {
+			r.KDF = pw.kdf()
+		}
+		if cw, ok := w.(certWrapper); ok {
+			r.Certificate = cw.cert
+		}
+		if _, ok := w.(escrowWrapper); ok {
+			r.Escrow = true
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// encryptFile streams the named file from src into the payload entry and
+// returns its inventory record. With pad, the file is zero-padded to its size
+// bucket inside the payload.
+func encryptFile(ctx context.Context, dst EntryWriter, src fs.FS, name, entry, suite string,
+	k *fernet.Key, chunkSize int, pad bool) (*ManifestFile, error) {
+	in, err := src.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	mf := &ManifestFile{Name: name, Entry: entry}
+	w, err := dst.Create(mf.Entry)
+	if err != nil {
+		return nil, err
+	}
+	ch := sha256.New()
+	ew, err := NewSuiteEncryptWriter(io.MultiWriter(w, ch), suite, k, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if mf.Size, err = io.Copy(io.MultiWriter(ew, h), ctxReader{ctx, in}); err != nil {
+		return nil, err
+	}
+	if pad {
+		mf.PaddedSize = paddedSize(mf.Size)
+		if err := writeZeros(ew, mf.PaddedSize-mf.Size); err != nil {
+			return nil, err
+		}
+	}
+	if err := ew.Close(); err != nil {
+		return nil, err
+	}
+	mf.SHA256 = hex.EncodeToString(h.Sum(nil))
+	mf.CiphertextSHA256 = hex.EncodeToString(ch.Sum(nil))
+	return mf, nil
+}
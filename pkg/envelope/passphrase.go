@@ -0,0 +1,270 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Passphrase key-wrap algorithms. The data key is sealed with AES-256-GCM
+// under a key derived from the passphrase with Argon2id or scrypt; the salt
+// and cost parameters are recorded with the recipient in the manifest. Each
+// package has a fresh salt, so every derived key seals exactly one message
+// and a zero nonce is safe.
+const (
+	KeyWrapArgon2id = "ARGON2ID-AES-256-GCM"
+	KeyWrapScrypt   = "SCRYPT-AES-256-GCM"
+)
+
+// KDF names accepted by NewPassphraseWrapper.
+const (
+	KDFArgon2id = "argon2id"
+	KDFScrypt   = "scrypt"
+)
+
+// KDFParams are the passphrase key-derivation parameters of a recipient.
+// Argon2id uses Time, MemoryKiB and Threads; scrypt uses N, R and P.
+type KDFParams struct {
+	Salt      []byte `json:"salt"`
+	Time      uint32 `json:"time,omitempty"`
+	MemoryKiB uint32 `json:"memory_kib,omitempty"`
+	Threads   uint8  `json:"threads,omitempty"`
+	N         int    `json:"n,omitempty"`
+	R         int    `json:"r,omitempty"`
+	P         int    `json:"p,omitempty"`
+}
+
+// validate bounds the parameters, so a crafted manifest cannot make unpack
+// spend unbounded memory or time before the passphrase is even checked.
+func (p *KDFParams) validate(alg string) error {
+	if len(p.Salt) < 16 || len(p.Salt) > 64 {
+		return errors.New("invalid kdf salt")
+	}
+	switch alg {
+	case KeyWrapArgon2id:
+		if p.N != 0 || p.R != 0 || p.P != 0 || p.Time < 1 || p.Time > 16 ||
+			p.Threads < 1 || p.Threads > 64 || p.MemoryKiB < 8*uint32(p.Threads) || p.MemoryKiB > 4<<20 {
+			return errors.New("invalid argon2id parameters")
+		}
+	case KeyWrapScrypt:
+		if p.Time != 0 || p.MemoryKiB != 0 || p.Threads != 0 || !validScrypt(p.N, p.R, p.P) {
+			return errors.New("invalid scrypt parameters")
+		}
+	}
+	return nil
+}
+
+// validScrypt reports whether scrypt cost parameters are strong enough to
+// slow down guessing, yet bounded in memory and time.
+func validScrypt(n, r, p int) bool {
+	return n >= 1<<10 && n <= 1<<22 && n&(n-1) == 0 && r >= 1 && r <= 32 && p >= 1 && p <= 16 && n*r <= 1<<24
+}
+
+// keyID identifies a passphrase recipient, which has no public key, by the
+// hex SHA-256 of its salt.
+func (p *KDFParams) keyID() string {
+	sum := sha256.Sum256(p.Salt)
+	return hex.EncodeToString(sum[:])
+}
+
+// kek derives the AES-256-GCM key encryption key from passphrase.
+func (p *KDFParams) kek(alg string, passphrase []byte) (cipher.AEAD, error) {
+	var k []byte
+	switch alg {
+	case KeyWrapArgon2id:
+		k = argon2.IDKey(passphrase, p.Salt, p.Time, p.MemoryKiB, p.Threads, 32)
+	case KeyWrapScrypt:
+		var err error
+		if k, err = scrypt.Key(passphrase, p.Salt, p.N, p.R, p.P, 32); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key_wrap %q", alg)
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func isPassphraseWrap(alg string) bool {
+	return alg == KeyWrapArgon2id || alg == KeyWrapScrypt
+}
+
+type passphraseWrapper struct {
+	passphrase []byte
+	alg        string
+	params     *KDFParams
+}
+
+// NewPassphraseWrapper returns a KeyWrapper that wraps the data key for a
+// passphrase, with kdf (KDFArgon2id or KDFScrypt) at its default cost: 64 MiB
+// and 3 passes for Argon2id, N=2^17, r=8, p=1 for scrypt. Customers without a
+// key pair can then unpack with NewPassphraseUnwrapper.
+func NewPassphraseWrapper(passphrase []byte, kdf string) (KeyWrapper, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	w := passphraseWrapper{passphrase: passphrase, params: &KDFParams{Salt: make([]byte, 16)}}
+	switch kdf {
+	case KDFArgon2id:
+		w.alg = KeyWrapArgon2id
+		w.params.Time, w.params.MemoryKiB, w.params.Threads = 3, 64<<10, 4
+	case KDFScrypt:
+		w.alg = KeyWrapScrypt
+		w.params.N, w.params.R, w.params.P = 1<<17, 8, 1
+	default:
+		return nil, fmt.Errorf("unsupported kdf %q", kdf)
+	}
+	if _, err := rand.Read(w.params.Salt); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w passphraseWrapper) Algorithm() string { return w.alg }
+func (w passphraseWrapper) KeyID() string     { return w.params.keyID() }
+func (w passphraseWrapper) kdf() *KDFParams   { return w.params }
+
+func (w passphraseWrapper) WrapKey(key []byte) ([]byte, error) {
+	aead, err := w.params.kek(w.alg, w.passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), key, []byte(w.alg)), nil
+}
+
+// passphraseUnwrapper holds a passphrase until OpenArchive binds it to the
+// package's passphrase recipient.
+type passphraseUnwrapper struct {
+	passphrase []byte
+	alg, kid   string
+	params     *KDFParams
+}
+
+// NewPassphraseUnwrapper returns a KeyUnwrapper for packages wrapped for a
+// passphrase. The KDF parameters are taken from the package manifest.
+func NewPassphraseUnwrapper(passphrase []byte) KeyUnwrapper {
+	return passphraseUnwrapper{passphrase: passphrase}
+}
+
+func (u passphraseUnwrapper) Algorithm() string { return u.alg }
+func (u passphraseUnwrapper) KeyID() string     { return u.kid }
+
+// bind returns u set up for the passphrase recipient of m.
+func (u passphraseUnwrapper) bind(m *Manifest) (KeyUnwrapper, error) {
+	if m != nil {
+		for _, r := range m.Recipients {
+			if isPassphraseWrap(r.KeyWrap) {
+				u.alg, u.kid, u.params = r.KeyWrap, r.KeyID, r.KDF
+				return u, nil
+			}
+		}
+	}
+	return nil, errors.New("package is not wrapped for a passphrase")
+}
+
+func (u passphraseUnwrapper) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	if u.params == nil {
+		return nil, errors.New("passphrase unwrapper not bound to a package")
+	}
+	aead, err := u.params.kek(u.alg, u.passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := aead.Open(nil, make([]byte, aead.NonceSize()), wrapped, []byte(u.alg))
+	if err != nil {
+		return nil, errors.New("wrong passphrase")
+	}
+	return key, nil
+}
+
+// ReadPassphraseFD reads a passphrase from the open file descriptor fd, up to
+// the first newline, so scripts can pass one without it showing up in the
+// process list or the environment.
+func ReadPassphraseFD(fd int) ([]byte, error) {
+	f := os.NewFile(uintptr(fd), "passphrase")
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, fmt.Errorf("reading passphrase from fd %d: %w", fd, err)
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return line, nil
+}
+
+// PromptPassphrase reads a passphrase from the terminal without echoing it.
+// With confirm set it is asked for twice and must match.
+func PromptPassphrase(prompt string, confirm bool) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, errors.New("no terminal to prompt for a passphrase on")
+		}
+		tty = os.Stdin
+	} else {
+		defer tty.Close()
+	}
+	read := func(prompt string) ([]byte, error) {
+		fmt.Fprint(tty, prompt)
+		p, err := term.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(tty)
+		return p, err
+	}
+	p, err := read(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		again, err := read("Confirm passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(p, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return p, nil
+}
+
+// KeyPassphrase returns a passphrase callback for ReadPrivateKeyFunc. The
+// passphrase is taken from the environment variable named env if env is
+// set, else from the file descriptor fd if it is not negative, else prompted
+// for on the terminal.
+func KeyPassphrase(env string, fd int) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		switch {
+		case env != "":
+			p := os.Getenv(env)
+			if p == "" {
+				return nil, fmt.Errorf("$%s is not set", env)
+			}
+			return []byte(p), nil
+		case fd >= 0:
+			return ReadPassphraseFD(fd)
+		}
+		return PromptPassphrase("Private key passphrase: ", false)
+	}
+}
@@ -0,0 +1,85 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestKDFParamsValidate(t *testing.T) {
+	salt := bytes.Repeat([]byte{1}, 16)
+	argon := KDFParams{Salt: salt, Time: 1, MemoryKiB: 64, Threads: 1}
+	scr := KDFParams{Salt: salt, N: 1 << 10, R: 8, P: 1}
+	tests := []struct {
+		name  string
+		alg   string
+		edit  func(p *KDFParams)
+		valid bool
+	}{
+		{"argon2id", KeyWrapArgon2id, func(p *KDFParams) {}, true},
+		{"scrypt", KeyWrapScrypt, func(p *KDFParams) {}, true},
+		{"salt of 15 bytes", KeyWrapArgon2id, func(p *KDFParams) { p.Salt = salt[:15] }, false},
+		{"salt of 64 bytes", KeyWrapArgon2id, func(p *KDFParams) { p.Salt = make([]byte, 64) }, true},
+		{"salt of 65 bytes", KeyWrapScrypt, func(p *KDFParams) { p.Salt = make([]byte, 65) }, false},
+		{"argon2id at 4 GiB", KeyWrapArgon2id, func(p *KDFParams) { p.MemoryKiB = 4 << 20 }, true},
+		{"argon2id above 4 GiB", KeyWrapArgon2id, func(p *KDFParams) { p.MemoryKiB = 4<<20 + 1 }, false},
+		{"argon2id below 8 KiB per thread", KeyWrapArgon2id, func(p *KDFParams) { p.Threads, p.MemoryKiB = 4, 31 }, false},
+		{"argon2id time 0", KeyWrapArgon2id, func(p *KDFParams) { p.Time = 0 }, false},
+		{"argon2id time 17", KeyWrapArgon2id, func(p *KDFParams) { p.Time = 17 }, false},
+		{"argon2id threads 0", KeyWrapArgon2id, func(p *KDFParams) { p.Threads = 0 }, false},
+		{"scrypt N not a power of two", KeyWrapScrypt, func(p *KDFParams) { p.N = 3 << 10 }, false},
+		{"scrypt N below 2^10", KeyWrapScrypt, func(p *KDFParams) { p.N = 1 << 9 }, false},
+		{"scrypt N*r at 2^24", KeyWrapScrypt, func(p *KDFParams) { p.N, p.R = 1<<19, 32 }, true},
+		{"scrypt N*r above 2^24", KeyWrapScrypt, func(p *KDFParams) { p.N, p.R = 1<<20, 32 }, false},
+		{"scrypt p 0", KeyWrapScrypt, func(p *KDFParams) { p.P = 0 }, false},
+		{"argon2id with scrypt N", KeyWrapArgon2id, func(p *KDFParams) { p.N = 1 << 10 }, false},
+		{"scrypt with argon2id time", KeyWrapScrypt, func(p *KDFParams) { p.Time = 1 }, false},
+		{"scrypt with argon2id memory", KeyWrapScrypt, func(p *KDFParams) { p.MemoryKiB = 64 }, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := scr
+			if tc.alg == KeyWrapArgon2id {
+				p = argon
+			}
+			tc.edit(&p)
+			if err := p.validate(tc.alg); (err == nil) != tc.valid {
+				t.Errorf("validate = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+// TestPassphraseRoundTrip packs for a passphrase with each KDF at a cheap
+// cost and unpacks with the right and a wrong passphrase.
+func TestPassphraseRoundTrip(t *testing.T) {
+	salt := bytes.Repeat([]byte{7}, 16)
+	wrappers := map[string]passphraseWrapper{
+		KDFArgon2id: {passphrase: []byte("correct horse"), alg: KeyWrapArgon2id, params: &KDFParams{Salt: salt, Time: 1, MemoryKiB: 64, Threads: 1}},
+		KDFScrypt:   {passphrase: []byte("correct horse"), alg: KeyWrapScrypt, params: &KDFParams{Salt: salt, N: 1 << 10, R: 8, P: 1}},
+	}
+	for kdf, w := range wrappers {
+		t.Run(kdf, func(t *testing.T) {
+			zb := packTest(t, PackOptions{Recipients: []KeyWrapper{w}})
+			r := manifestOf(t, zb).Recipients[0]
+			if r.KeyWrap != w.alg || r.KDF == nil || !bytes.Equal(r.KDF.Salt, salt) {
+				t.Fatalf("manifest recipient %+v", r)
+			}
+			unpackTest(t, zb, UnpackOptions{KeyUnwrapper: NewPassphraseUnwrapper([]byte("correct horse"))})
+
+			u := NewPassphraseUnwrapper([]byte("correct horse battery"))
+			err := Unpack(context.Background(), bytes.NewReader(zb), int64(len(zb)), memWriter{}, UnpackOptions{KeyUnwrapper: u})
+			if err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+				t.Errorf("wrong passphrase: got %v", err)
+			}
+		})
+	}
+
+	if _, err := NewPassphraseWrapper(nil, KDFScrypt); err == nil {
+		t.Error("empty passphrase accepted")
+	}
+	if _, err := NewPassphraseWrapper([]byte("x"), "pbkdf2"); err == nil {
+		t.Error("unknown kdf accepted")
+	}
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package envelope
+
+import (
+	"net"
+	"syscall"
+)
+
+const peerCredentialsSupported = true
+
+// peerCredentials returns the user, group and process ID of the process that
+// connected c, as recorded by the kernel when it connected.
+func peerCredentials(c *net.UnixConn) (uid, gid, pid int, err error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var cred *syscall.Ucred
+	cerr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if cerr != nil {
+		return 0, 0, 0, cerr
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return int(cred.Uid), int(cred.Gid), int(cred.Pid), nil
+}
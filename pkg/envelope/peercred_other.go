@@ -0,0 +1,14 @@
+//go:build !linux
+
+package envelope
+
+import (
+	"errors"
+	"net"
+)
+
+const peerCredentialsSupported = false
+
+func peerCredentials(c *net.UnixConn) (uid, gid, pid int, err error) {
+	return 0, 0, 0, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,86 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const pkcs8Testdata = "testdata/pkcs8"
+
+var pkcs8Passphrase = []byte("correct horse battery staple")
+
+func readPKCS8Fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(pkcs8Testdata, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseOpenSSLEncryptedKeys(t *testing.T) {
+	tests := []struct {
+		file, plain string
+	}{
+		{"p256_pbkdf2_sha256_aes256.pem", "p256.pem"},
+		{"rsa_pbkdf2_sha1_aes128.pem", "rsa.pem"},
+		{"x25519_pbkdf2_sha512_aes192.pem", "x25519.pem"},
+		{"p256_scrypt.pem", "p256.pem"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.file, func(t *testing.T) {
+			want, err := ParsePrivateKey(readPKCS8Fixture(t, tc.plain))
+			if err != nil {
+				t.Fatal(err)
+			}
+			enc := readPKCS8Fixture(t, tc.file)
+			got, err := ParseEncryptedPrivateKey(enc, pkcs8Passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !want.(interface{ Equal(crypto.PrivateKey) bool }).Equal(got) {
+				t.Error("decrypted key does not match the plain key")
+			}
+			if _, err := ParsePrivateKey(enc); err != ErrEncryptedKey {
+				t.Errorf("parsing without a passphrase: %v, want ErrEncryptedKey", err)
+			}
+			if _, err := ParseEncryptedPrivateKey(enc, []byte("wrong")); err == nil {
+				t.Error("wrong passphrase accepted")
+			}
+		})
+	}
+}
+
+func TestEncryptedKeyRoundTrip(t *testing.T) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := MarshalEncryptedPrivateKeyPEM(priv, pkcs8Passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseEncryptedPrivateKey(enc, pkcs8Passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !priv.Equal(got) {
+		t.Error("key does not round-trip")
+	}
+}
+
+func TestRejectWeakPBES2Parameters(t *testing.T) {
+	for _, file := range []string{"weak_scrypt.pem", "weak_pbkdf2.pem"} {
+		t.Run(file, func(t *testing.T) {
+			_, err := ParseEncryptedPrivateKey(readPKCS8Fixture(t, file), pkcs8Passphrase)
+			if err == nil || !strings.Contains(err.Error(), "weak") {
+				t.Errorf("weak parameters: %v", err)
+			}
+		})
+	}
+}
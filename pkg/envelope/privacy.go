@@ -0,0 +1,128 @@
+package envelope
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/bits"
+
+	"github.com/fernet/fernet-go"
+)
+
+// In privacy mode (PackOptions.Private) a package gives away as little about
+// its files as it can without the data key. Payload entries get random names,
+// the inventory that the manifest normally lists moves to an encrypted index
+// entry, and every file is zero-padded inside its payload to a size bucket,
+// so the entry sizes only reveal roughly how large each file is. The number
+// of files is still visible.
+
+// minPaddedSize is the smallest size bucket; files up to it all look alike.
+const minPaddedSize = 4096
+
+// paddedSize returns the size bucket for a file of n bytes. Above
+// minPaddedSize it follows the Padmé scheme: the size is rounded up so that
+// only its top bits, about log2 of the bit length, can vary, which costs less
+// than 7% overhead.
+func paddedSize(n int64) int64 {
+	if n <= minPaddedSize {
+		return minPaddedSize
+	}
+	e := bits.Len64(uint64(n)) - 1
+	s := bits.Len64(uint64(e))
+	mask := int64(1)<<(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+// opaqueEntryName returns a random payload entry name.
+func opaqueEntryName() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]) + PayloadSuffix, nil
+}
+
+// writeZeros writes n zero bytes to w.
+func writeZeros(w io.Writer, n int64) error {
+	var zeros [4096]byte
+	for n > 0 {
+		c := min(n, int64(len(zeros)))
+		if _, err := w.Write(zeros[:c]); err != nil {
+			return err
+		}
+		n -= c
+	}
+	return nil
+}
+
+// writeIndex encrypts the file inventory and directory list with the data key
+// into the index entry, and returns its manifest record.
+func writeIndex(dst EntryWriter, files []ManifestFile, dirs []string, suite string, k *fernet.Key, chunkSize int) (*ManifestIndex, error) {
+	b, err := json.Marshal(packageIndex{Files: files, Dirs: dirs})
+	if err != nil {
+		return nil, err
+	}
+	w, err := dst.Create(IndexName)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	ew, err := NewSuiteEncryptWriter(io.MultiWriter(w, h), suite, k, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ew.Write(b); err != nil {
+		return nil, err
+	}
+	if err := ew.Close(); err != nil {
+		return nil, err
+	}
+	return &ManifestIndex{Entry: IndexName, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// readIndex decrypts the encrypted index of a package in privacy mode and
+// fills in the manifest's file inventory and the packaged directories.
+func (a *Archive) readIndex(entries map[string]*zip.File) error {
+	mi := a.manifest.Index
+	f, ok := entries[mi.Entry]
+	if !ok {
+		return fmt.Errorf("package has no %s", mi.Entry)
+	}
+	ct, err := readZipFile(f)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(ct)
+	if err := checkSHA256(mi.Entry, sum[:], mi.SHA256); err != nil {
+		return err
+	}
+	pr, err := newPayloadReader(bytes.NewReader(ct), a.suite, a.key)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(pr)
+	if err != nil {
+		return fmt.Errorf("decrypting %s: %w", mi.Entry, err)
+	}
+	var idx packageIndex
+	if err := decodeStrict(b, &idx); err != nil {
+		return fmt.Errorf("invalid %s: %w", mi.Entry, err)
+	}
+	if err := validateFiles(idx.Files); err != nil {
+		return fmt.Errorf("invalid %s: %w", mi.Entry, err)
+	}
+	for _, dir := range idx.Dirs {
+		if !fs.ValidPath(dir) || dir == "." {
+			return fmt.Errorf("illegal file path: %s", dir)
+		}
+	}
+	a.manifest.Files = idx.Files
+	a.dirs = append(a.dirs, idx.Dirs...)
+	return nil
+}
@@ -0,0 +1,139 @@
+package envelope
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPaddedSize(t *testing.T) {
+	tests := []struct{ n, want int64 }{
+		{0, 4096},
+		{1, 4096},
+		{4095, 4096},
+		{4096, 4096},
+		{4097, 4352},
+		{4352, 4352},
+		{4353, 4608},
+		{5000, 5120},
+		{8191, 8192},
+		{8192, 8192},
+		{8193, 8704},
+		{1 << 16, 1 << 16},
+		{1<<16 + 1, 1<<16 + 1<<11},
+		{1 << 20, 1 << 20},
+		{1<<20 + 1, 1<<20 + 1<<15},
+		{1 << 30, 1 << 30},
+		{1<<30 + 1, 1<<30 + 1<<25},
+	}
+	for _, tc := range tests {
+		if got := paddedSize(tc.n); got != tc.want {
+			t.Errorf("paddedSize(%d) = %d, want %d", tc.n, got, tc.want)
+		}
+	}
+	for n := int64(minPaddedSize); n < 1<<40; n = n*5/4 + 3 {
+		p := paddedSize(n)
+		if p < n || float64(p-n) > 0.07*float64(n) || paddedSize(p) != p {
+			t.Fatalf("paddedSize(%d) = %d", n, p)
+		}
+	}
+}
+
+// forgeIndex returns zb with its index replaced by idx, encrypted with the
+// data key, and the manifest updated to match.
+func forgeIndex(t *testing.T, zb []byte, a *Archive, idx packageIndex) []byte {
+	t.Helper()
+	dst := memWriter{}
+	mi, err := writeIndex(dst, idx.Files, idx.Dirs, a.suite, a.key, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zb = editEntry(t, zb, IndexName, func([]byte) []byte { return dst[IndexName].Bytes() })
+	return editEntry(t, zb, ManifestName, func(b []byte) []byte {
+		m, err := ParseManifest(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Index = mi
+		if b, err = m.Marshal(); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	})
+}
+
+func TestPrivatePackage(t *testing.T) {
+	w, u := newTestKey(t, KeyTypeX25519)
+	for _, suite := range testSuites {
+		t.Run(suite, func(t *testing.T) {
+			zb := packTest(t, PackOptions{Recipients: []KeyWrapper{w}, CipherSuite: suite, Private: true})
+			m := manifestOf(t, zb)
+			if len(m.Files) != 0 || m.Index == nil {
+				t.Fatalf("manifest lists files %v, index %v", m.Files, m.Index)
+			}
+			zr, err := zip.NewReader(bytes.NewReader(zb), int64(len(zb)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sizes []uint64
+			for _, f := range zr.File {
+				for _, name := range []string{"a.txt", "b.bin", "c.txt", "dir", "sub"} {
+					if strings.Contains(f.Name, name) {
+						t.Errorf("entry %s gives away %s", f.Name, name)
+					}
+				}
+				if strings.HasSuffix(f.Name, PayloadSuffix) {
+					sizes = append(sizes, f.UncompressedSize64)
+				}
+			}
+			// Every test file fits the smallest bucket
+			if len(sizes) != len(testFiles) || sizes[0] != sizes[1] || sizes[1] != sizes[2] {
+				t.Errorf("payload entry sizes %v", sizes)
+			}
+
+			unpackTest(t, zb, UnpackOptions{KeyUnwrapper: u})
+			a, err := OpenArchive(context.Background(), bytes.NewReader(zb), int64(len(zb)), UnpackOptions{KeyUnwrapper: u})
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := a.Manifest().Files
+			if len(files) != len(testFiles) {
+				t.Fatalf("index lists %d files", len(files))
+			}
+			for _, f := range files {
+				if tf := testFiles[f.Name]; tf == nil || f.Size != int64(len(tf.Data)) || f.PaddedSize != paddedSize(f.Size) {
+					t.Errorf("index entry %+v", f)
+				}
+			}
+
+			// A faithful forgery still unpacks, so the failures below are
+			// down to what was changed
+			unpackTest(t, forgeIndex(t, zb, a, packageIndex{Files: files, Dirs: a.dirs}), UnpackOptions{KeyUnwrapper: u})
+
+			tests := []struct {
+				name string
+				zb   []byte
+				want string // error substring
+			}{
+				{"index tampered", editEntry(t, zb, IndexName, func(b []byte) []byte {
+					b[len(b)-1] ^= 1
+					return b
+				}), "SHA-256 does not match"},
+				{"index missing", dropEntry(t, zb, IndexName), "package has no " + IndexName},
+				{"file missing from index", forgeIndex(t, zb, a, packageIndex{Files: files[1:], Dirs: a.dirs}), files[0].Entry},
+				{"parent dir in index", forgeIndex(t, zb, a, packageIndex{Files: files, Dirs: append([]string{"../evil"}, a.dirs...)}), "illegal file path: ../evil"},
+				{"parent file in index", forgeIndex(t, zb, a, packageIndex{Files: append([]ManifestFile{{Name: "../evil", Entry: files[0].Entry, Size: 1, PaddedSize: 4096, SHA256: files[0].SHA256}}, files[1:]...), Dirs: a.dirs}), "illegal file path: ../evil"},
+			}
+			for _, tc := range tests {
+				t.Run(tc.name, func(t *testing.T) {
+					err := Unpack(context.Background(), bytes.NewReader(tc.zb), int64(len(tc.zb)), memWriter{}, UnpackOptions{KeyUnwrapper: u})
+					if err == nil || !strings.Contains(err.Error(), tc.want) {
+						t.Errorf("got %v, want an error containing %q", err, tc.want)
+					}
+				})
+			}
+		})
+	}
+}
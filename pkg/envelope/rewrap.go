@@ -0,0 +1,243 @@
+package envelope
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fernet/fernet-go"
+)
+
+// escrowWrapper marks a recipient as a vendor escrow key.
+type escrowWrapper struct {
+	KeyWrapper
+}
+
+// NewEscrowWrapper returns w marked as a vendor escrow recipient. The data key
+// is wrapped for it like for any other recipient, and the manifest flags it
+// with escrow, so the vendor can later give a customer who lost their private
+// key access again with Rewrap, without re-encrypting the package.
+func NewEscrowWrapper(w KeyWrapper) KeyWrapper {
+	return escrowWrapper{w}
+}
+
+// RewrapOptions configures Rewrap.
+type RewrapOptions struct {
+	// KeyUnwrapper unwraps the data key; it must match one of the package's
+	// recipients.
+	KeyUnwrapper KeyUnwrapper
+	// RequireEscrow refuses to rewrap unless KeyUnwrapper is an escrow
+	// recipient of the package.
+	RequireEscrow bool
+	// Recipients are the key wrappers the data key is newly wrapped for.
+	Recipients []KeyWrapper
+	// Keep reports which of the package's current recipients stay, with
+	// their wrapped keys copied unchanged. Nil keeps every current
+	// recipient, except a custodian whose share moves to a new key.
+	Keep func(r ManifestRecipient) bool
+	// SigningKey re-signs the rewritten manifest. A signed package needs it
+	// or DropSignature, since the old signature no longer matches.
+	SigningKey *rsa.PrivateKey
+	// DropSignature writes an unsigned copy of a signed package when there
+	// is no SigningKey, as customers do not hold the vendor signing key.
+	// Unpack then refuses the copy if it pins a vendor signing key.
+	DropSignature bool
+	// Log receives progress messages; nil discards them.
+	Log io.Writer
+}
+
+// Rewrap reads the zip package from r and writes to w a copy whose data key is
+// wrapped for a new set of recipients, e.g. when a customer rotates their key.
+// Payload entries, and every other entry except the wrapped keys and the
+// manifest, are copied byte for byte: the data key and the ciphertext do not
+// change. The package ID is kept, so license tokens bound to it stay valid,
+// unless they are also bound to a customer key that is no longer a recipient.
+//
+// Packages made before manifests listed recipients hold a single
+// wrapped_key.bin, which is taken to be wrapped for KeyUnwrapper. Those
+// without a versioned manifest can only be rewrapped for a single RSA key,
+// since their wrapped_key.bin is all that unpack reads.
+//
+// A custodian of a package split with a threshold holds only a share of the
+// data key: with its key as KeyUnwrapper, Rewrap moves that share to the one
+// new recipient, e.g. the custodian's replacement key. Custodians cannot be
+// dropped, as the threshold counts on their shares.
+func Rewrap(ctx context.Context, w io.Writer, r io.ReaderAt, size int64, opts RewrapOptions) error {
+	u := opts.KeyUnwrapper
+	if u == nil {
+		return errors.New("no private key to unwrap the data key with")
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	var m *Manifest
+	if mf, ok := entries[ManifestName]; ok {
+		mb, err := readZipFile(mf)
+		if err != nil {
+			return err
+		}
+		if m, err = ParseManifest(mb); err != nil {
+			return err
+		}
+	}
+	versioned := m != nil && m.FormatVersion > 0
+	if _, signed := entries[SignatureName]; (signed || versioned && m.Signer != nil) && opts.SigningKey == nil {
+		if !opts.DropSignature {
+			return errors.New("package is signed; a signing key is needed to re-sign it, or the signature must be dropped")
+		}
+		logf(opts.Log, "⚠️ WARNING: dropping the package signature; the rewrapped copy is unsigned.\n")
+	}
+	if p, ok := u.(passphraseUnwrapper); ok {
+		if u, err = p.bind(m); err != nil {
+			return err
+		}
+	}
+	recipients := []ManifestRecipient{{KeyWrap: KeyWrapRSAOAEP, KeyID: u.KeyID(), Entry: WrappedKeyName}}
+	switch {
+	case versioned && len(m.Recipients) > 0:
+		recipients = m.Recipients
+	case versioned:
+		recipients[0].KeyWrap, recipients[0].SHA256 = m.KeyWrap, m.WrappedKeySHA256
+	}
+
+	// Unwrap the data key as stored, which for packages split with a
+	// license key share is only the customer half
+	var from *ManifestRecipient
+	for i := range recipients {
+		if recipients[i].KeyID == u.KeyID() {
+			from = &recipients[i]
+		}
+	}
+	if from == nil {
+		return fmt.Errorf("package is not wrapped for private key %s", u.KeyID())
+	}
+	if opts.RequireEscrow && !from.Escrow {
+		return fmt.Errorf("key %s is not an escrow recipient of this package", from.KeyID)
+	}
+	if from.KeyWrap != u.Algorithm() {
+		return fmt.Errorf("%s is wrapped with %s, but the private key is for %s", from.Entry, from.KeyWrap, u.Algorithm())
+	}
+	wf, ok := entries[from.Entry]
+	if !ok {
+		return fmt.Errorf("package has no %s", from.Entry)
+	}
+	wrapped, err := readZipFile(wf)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(wrapped)
+	if err := checkSHA256(from.Entry, sum[:], from.SHA256); err != nil {
+		return err
+	}
+	raw, err := u.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return fmt.Errorf("unwrap failed: %w", err)
+	}
+	if len(raw) != len(fernet.Key{}) {
+		return fmt.Errorf("unwrap failed: invalid key length %d", len(raw))
+	}
+
+	keep := opts.Keep
+	if keep == nil {
+		keep = func(r ManifestRecipient) bool { return from.Share == 0 || r.KeyID != from.KeyID }
+	}
+	newRecipients := opts.Recipients
+	if from.Share != 0 {
+		// A custodian only holds its share, which can move to a new key of
+		// the same custodian but never stand in for the data key
+		if len(newRecipients) != 1 || keep(*from) {
+			return fmt.Errorf("key %s holds custodian share %d, which can only be moved to one new custodian key", from.KeyID, from.Share)
+		}
+		newRecipients = []KeyWrapper{custodianWrapper{newRecipients[0], from.Share, raw}}
+	}
+	var kept []ManifestRecipient
+	drop := map[string]bool{SignatureName: true}
+	seen := make(map[string]bool)
+	for _, r := range recipients {
+		if keep(r) {
+			kept = append(kept, r)
+			seen[r.KeyID] = true
+		} else if r.Share != 0 && r.KeyID != from.KeyID {
+			return fmt.Errorf("custodian %s holds share %d and cannot be dropped", r.KeyID, r.Share)
+		} else {
+			drop[r.Entry] = true
+			logf(opts.Log, "Dropped recipient %s\n", r.KeyID)
+		}
+	}
+	for _, nw := range newRecipients {
+		if seen[nw.KeyID()] {
+			return fmt.Errorf("recipient %s given twice", nw.KeyID())
+		}
+		if _, ok := nw.(escrowWrapper); ok && versioned && m.Threshold > 0 {
+			return fmt.Errorf("escrow recipient %s could recover the data key without the custodians", nw.KeyID())
+		}
+	}
+	if len(kept)+len(newRecipients) == 0 {
+		return errors.New("no recipients left to wrap the data key for")
+	}
+	if !versioned && (len(kept) > 0 || len(newRecipients) != 1 || newRecipients[0].Algorithm() != KeyWrapRSAOAEP) {
+		return errors.New("package has no versioned manifest and can only be rewrapped for a single RSA key; package it again for more")
+	}
+	if versioned {
+		drop[ManifestName] = true
+	}
+
+	zw := zip.NewWriter(w)
+	for _, f := range zr.File {
+		if drop[f.Name] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := zw.Copy(f); err != nil {
+			return fmt.Errorf("copying %s: %w", f.Name, err)
+		}
+	}
+	dst := ZipEntryWriter(zw)
+	added, err := wrapForRecipients(dst, newRecipients, (*fernet.Key)(raw), len(kept)+len(newRecipients) > 1, opts.Log)
+	if err != nil {
+		return err
+	}
+	if !versioned {
+		return zw.Close()
+	}
+	m.KeyWrap, m.WrappedKeySHA256 = "", ""
+	m.Recipients = append(kept, added...)
+	m.Signer = nil
+	if opts.SigningKey != nil {
+		kid, err := KeyFingerprint(&opts.SigningKey.PublicKey)
+		if err != nil {
+			return err
+		}
+		m.Signer = &SignerInfo{Algorithm: SigRSAPSS, KeyID: kid}
+	}
+	mb, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(dst, ManifestName, mb); err != nil {
+		return err
+	}
+	logf(opts.Log, "Wrote %s (package %s)\n", ManifestName, m.PackageID)
+	if opts.SigningKey != nil {
+		sig, err := signManifest(opts.SigningKey, mb)
+		if err != nil {
+			return fmt.Errorf("signing manifest: %w", err)
+		}
+		if err := writeEntry(dst, SignatureName, sig); err != nil {
+			return err
+		}
+		logf(opts.Log, "Wrote %s (vendor key %s)\n", SignatureName, m.Signer.KeyID)
+	}
+	return zw.Close()
+}
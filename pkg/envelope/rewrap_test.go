@@ -0,0 +1,82 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+)
+
+// TestRecoverKeepsRecipients checks that recovering a package with the escrow
+// key, with the options cmd/recover uses, adds the new key without locking
+// out the customers that still hold theirs.
+func TestRecoverKeepsRecipients(t *testing.T) {
+	cw, cu := newTestKey(t, KeyTypeX25519)
+	ow, ou := newTestKey(t, KeyTypeP256)
+	ew, eu := newTestKey(t, KeyTypeX25519)
+	nw, nu := newTestKey(t, KeyTypeX25519)
+	zb := packTest(t, PackOptions{Recipients: []KeyWrapper{cw, ow, NewEscrowWrapper(ew)}})
+
+	var out bytes.Buffer
+	opts := RewrapOptions{KeyUnwrapper: eu, RequireEscrow: true, Recipients: []KeyWrapper{nw}}
+	if err := Rewrap(context.Background(), &out, bytes.NewReader(zb), int64(len(zb)), opts); err != nil {
+		t.Fatalf("Rewrap: %v", err)
+	}
+	for _, u := range []KeyUnwrapper{cu, ou, eu, nu} {
+		unpackTest(t, out.Bytes(), UnpackOptions{KeyUnwrapper: u})
+	}
+
+	// Only a customer key that is not escrow is refused
+	opts.KeyUnwrapper = cu
+	if err := Rewrap(context.Background(), &out, bytes.NewReader(zb), int64(len(zb)), opts); err == nil {
+		t.Error("recovery with a customer key accepted")
+	}
+}
+
+// TestRewrapSignedPackage checks that a customer without the vendor signing
+// key can rewrap a signed package, unsigned or signed with their own key.
+func TestRewrapSignedPackage(t *testing.T) {
+	vendor, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	customer, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw, cu := newTestKey(t, KeyTypeX25519)
+	nw, nu := newTestKey(t, KeyTypeX25519)
+	zb := packTest(t, PackOptions{Recipients: []KeyWrapper{cw}, SigningKey: vendor})
+	rewrap := func(opts RewrapOptions) ([]byte, error) {
+		opts.KeyUnwrapper, opts.Recipients = cu, []KeyWrapper{nw}
+		var out bytes.Buffer
+		err := Rewrap(context.Background(), &out, bytes.NewReader(zb), int64(len(zb)), opts)
+		return out.Bytes(), err
+	}
+
+	if _, err := rewrap(RewrapOptions{}); err == nil {
+		t.Error("signed package rewrapped without a signing key")
+	}
+
+	unsigned, err := rewrap(RewrapOptions{DropSignature: true})
+	if err != nil {
+		t.Fatalf("Rewrap with DropSignature: %v", err)
+	}
+	unpackTest(t, unsigned, UnpackOptions{KeyUnwrapper: nu})
+	err = Unpack(context.Background(), bytes.NewReader(unsigned), int64(len(unsigned)), memWriter{}, UnpackOptions{KeyUnwrapper: nu, SignerPublicKey: &vendor.PublicKey})
+	if !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned copy with a pinned vendor key: %v, want ErrUnsigned", err)
+	}
+
+	signed, err := rewrap(RewrapOptions{SigningKey: customer})
+	if err != nil {
+		t.Fatalf("Rewrap with the customer's key: %v", err)
+	}
+	unpackTest(t, signed, UnpackOptions{KeyUnwrapper: nu, SignerPublicKey: &customer.PublicKey})
+	err = Unpack(context.Background(), bytes.NewReader(signed), int64(len(signed)), memWriter{}, UnpackOptions{KeyUnwrapper: nu, SignerPublicKey: &vendor.PublicKey})
+	if err == nil {
+		t.Error("customer-signed copy verified against the vendor key")
+	}
+}
@@ -0,0 +1,309 @@
+package envelope
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fernet/fernet-go"
+)
+
+// MaxCustodians is the largest number of custodians a data key can be split
+// between: shares are evaluated at the non-zero elements of GF(256).
+const MaxCustodians = 255
+
+// shareFileType identifies custodian share files.
+const shareFileType = "secure-packager-custodian-share"
+
+// gfMul multiplies in GF(256) with the AES polynomial, without branching on
+// its operands.
+func gfMul(a, b byte) byte {
+	var p byte
+	for range 8 {
+		p ^= a & -(b & 1)
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse of a non-zero a, as a^254.
+func gfInv(a byte) byte {
+	r := a
+	for range 6 {
+		r = gfMul(gfMul(r, r), a)
+	}
+	return gfMul(r, r)
+}
+
+// splitSecret splits secret with Shamir's scheme into n shares, any m of which
+// recover it. Share i is the evaluation at x = i+1 of random polynomials of
+// degree m-1 whose constant terms are the bytes of secret.
+func splitSecret(secret []byte, m, n int) ([][]byte, error) {
+	if m < 2 || m > n || n > MaxCustodians {
+		return nil, fmt.Errorf("invalid threshold %d of %d", m, n)
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	coef := make([]byte, m)
+	defer clear(coef)
+	for j, s := range secret {
+		coef[0] = s
+		if _, err := rand.Read(coef[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x, y := byte(i+1), byte(0)
+			for k := m - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coef[k]
+			}
+			shares[i][j] = y
+		}
+	}
+	return shares, nil
+}
+
+// combineShares interpolates the shares at x = 0. It rejects x coordinates
+// that are zero or repeated; with fewer shares than the threshold the result
+// is meaningless rather than an error.
+func combineShares(xs []byte, ys [][]byte) ([]byte, error) {
+	if len(xs) == 0 || len(xs) != len(ys) {
+		return nil, errors.New("no shares to combine")
+	}
+	var seen [256]bool
+	for i, x := range xs {
+		if x == 0 || seen[x] {
+			return nil, fmt.Errorf("invalid or duplicate share index %d", x)
+		}
+		if len(ys[i]) != len(ys[0]) {
+			return nil, errors.New("shares differ in length")
+		}
+		seen[x] = true
+	}
+	basis := make([]byte, len(xs))
+	for i, xi := range xs {
+		num, den := byte(1), byte(1)
+		for k, xk := range xs {
+			if k != i {
+				num, den = gfMul(num, xk), gfMul(den, xk^xi)
+			}
+		}
+		basis[i] = gfMul(num, gfInv(den))
+	}
+	secret := make([]byte, len(ys[0]))
+	for j := range secret {
+		for i := range xs {
+			secret[j] ^= gfMul(ys[i][j], basis[i])
+		}
+	}
+	return secret, nil
+}
+
+// custodianWrapper wraps one Shamir share of the data key, instead of the key
+// itself, for a custodian.
+type custodianWrapper struct {
+	KeyWrapper
+	index int
+	share []byte
+}
+
+// CustodianShare is one custodian's unwrapped share of a package's data key,
+// as exported with ExportCustodianShare.
+type CustodianShare struct {
+	PackageID string
+	// KeyID identifies the custodian key the share was wrapped for.
+	KeyID string
+	// Index is the share's position, as recorded with the custodian in the
+	// manifest.
+	Index     int
+	Threshold int
+	Share     []byte
+}
+
+// shareFile is the JSON form of a CustodianShare. The share is either in the
+// clear or wrapped for the key of whoever collects the shares.
+type shareFile struct {
+	Type         string `json:"type"`
+	PackageID    string `json:"package_id"`
+	KeyID        string `json:"key_id"`
+	Index        int    `json:"index"`
+	Threshold    int    `json:"threshold"`
+	Share        string `json:"share,omitempty"`
+	KeyWrap      string `json:"key_wrap,omitempty"`
+	WrappedFor   string `json:"wrapped_for,omitempty"`
+	WrappedShare string `json:"wrapped_share,omitempty"`
+}
+
+// ExportCustodianShare opens the package in r, unwraps the share of its data
+// key held by the custodian key u, and returns it as a share file. If to is
+// not nil the share is wrapped for it, so the file can be carried to whoever
+// combines the shares without exposing it on the way.
+func ExportCustodianShare(ctx context.Context, r io.ReaderAt, size int64, u KeyUnwrapper, to KeyWrapper) ([]byte, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	mf, ok := entries[ManifestName]
+	if !ok {
+		return nil, fmt.Errorf("package has no %s", ManifestName)
+	}
+	mb, err := readZipFile(mf)
+	if err != nil {
+		return nil, err
+	}
+	m, err := ParseManifest(mb)
+	if err != nil {
+		return nil, err
+	}
+	if m.Threshold == 0 {
+		return nil, errors.New("package data key is not split between custodians")
+	}
+	var from *ManifestRecipient
+	for i := range m.Recipients {
+		if m.Recipients[i].KeyID == u.KeyID() {
+			from = &m.Recipients[i]
+		}
+	}
+	if from == nil || from.Share == 0 {
+		return nil, fmt.Errorf("key %s is not a custodian of this package", u.KeyID())
+	}
+	if from.KeyWrap != u.Algorithm() {
+		return nil, fmt.Errorf("%s is wrapped with %s, but the private key is for %s", from.Entry, from.KeyWrap, u.Algorithm())
+	}
+	wf, ok := entries[from.Entry]
+	if !ok {
+		return nil, fmt.Errorf("package has no %s", from.Entry)
+	}
+	wrapped, err := readZipFile(wf)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(wrapped)
+	if err := checkSHA256(from.Entry, sum[:], from.SHA256); err != nil {
+		return nil, err
+	}
+	share, err := u.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap failed: %w", err)
+	}
+	if len(share) != len(fernet.Key{}) {
+		return nil, fmt.Errorf("unwrap failed: invalid share length %d", len(share))
+	}
+
+	sf := shareFile{Type: shareFileType, PackageID: m.PackageID, KeyID: from.KeyID, Index: from.Share, Threshold: m.Threshold}
+	if to == nil {
+		sf.Share = base64.RawURLEncoding.EncodeToString(share)
+	} else {
+		ws, err := to.WrapKey(share)
+		if err != nil {
+			return nil, fmt.Errorf("wrapping share for %s: %w", to.KeyID(), err)
+		}
+		sf.KeyWrap, sf.WrappedFor, sf.WrappedShare = to.Algorithm(), to.KeyID(), base64.RawURLEncoding.EncodeToString(ws)
+	}
+	b, err := json.MarshalIndent(sf, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// ParseCustodianShare decodes a share file written by ExportCustodianShare.
+// Shares wrapped for a collector key are unwrapped with u, which may be nil
+// for shares in the clear.
+func ParseCustodianShare(ctx context.Context, b []byte, u KeyUnwrapper) (*CustodianShare, error) {
+	var sf shareFile
+	if err := decodeStrict(b, &sf); err != nil {
+		return nil, fmt.Errorf("invalid share file: %w", err)
+	}
+	if sf.Type != shareFileType {
+		return nil, fmt.Errorf("not a custodian share file (type %q)", sf.Type)
+	}
+	if sf.PackageID == "" || !isSHA256Hex(sf.KeyID) || sf.Index < 1 || sf.Index > MaxCustodians || sf.Threshold < 2 {
+		return nil, errors.New("invalid share file")
+	}
+	var share []byte
+	var err error
+	switch {
+	case sf.Share != "" && sf.WrappedShare == "":
+		if share, err = base64.RawURLEncoding.DecodeString(sf.Share); err != nil {
+			return nil, fmt.Errorf("invalid share: %w", err)
+		}
+	case sf.Share == "" && sf.WrappedShare != "":
+		if u == nil {
+			return nil, fmt.Errorf("share is wrapped for key %s; a private key is needed to read it", sf.WrappedFor)
+		}
+		if sf.WrappedFor != u.KeyID() || sf.KeyWrap != u.Algorithm() {
+			return nil, fmt.Errorf("share is wrapped for key %s, not %s", sf.WrappedFor, u.KeyID())
+		}
+		ws, err := base64.RawURLEncoding.DecodeString(sf.WrappedShare)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wrapped share: %w", err)
+		}
+		if share, err = u.UnwrapKey(ctx, ws); err != nil {
+			return nil, fmt.Errorf("unwrapping share: %w", err)
+		}
+	default:
+		return nil, errors.New("invalid share file: exactly one of share and wrapped_share is needed")
+	}
+	if len(share) != len(fernet.Key{}) {
+		return nil, fmt.Errorf("invalid share length %d", len(share))
+	}
+	return &CustodianShare{PackageID: sf.PackageID, KeyID: sf.KeyID, Index: sf.Index, Threshold: sf.Threshold, Share: share}, nil
+}
+
+// ReadCustodianShare reads a share file with ParseCustodianShare.
+func ReadCustodianShare(ctx context.Context, path string, u KeyUnwrapper) (*CustodianShare, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCustodianShare(ctx, b, u)
+}
+
+// joinCustodianShares recovers the data key, as wrapped for recipients, from
+// the custodian shares of a package split with a threshold.
+func (a *Archive) joinCustodianShares(shares []*CustodianShare) ([]byte, error) {
+	m := a.manifest
+	if m == nil || m.Threshold == 0 {
+		return nil, errors.New("package data key is not split between custodians")
+	}
+	custodians := make(map[string]int)
+	for _, r := range m.Recipients {
+		if r.Share != 0 {
+			custodians[r.KeyID] = r.Share
+		}
+	}
+	var xs []byte
+	var ys [][]byte
+	seen := make(map[int]bool)
+	for _, s := range shares {
+		if s.PackageID != m.PackageID {
+			return nil, fmt.Errorf("share from %s is for package %s, not %s", s.KeyID, s.PackageID, m.PackageID)
+		}
+		if idx, ok := custodians[s.KeyID]; !ok || idx != s.Index {
+			return nil, fmt.Errorf("share from %s is not custodian share %d of this package", s.KeyID, s.Index)
+		}
+		if seen[s.Index] {
+			return nil, fmt.Errorf("custodian share %d given twice", s.Index)
+		}
+		seen[s.Index] = true
+		xs, ys = append(xs, byte(s.Index)), append(ys, s.Share)
+	}
+	if len(xs) < m.Threshold {
+		return nil, fmt.Errorf("%d of %d custodian shares are needed, got %d", m.Threshold, len(custodians), len(xs))
+	}
+	return combineShares(xs, ys)
+}
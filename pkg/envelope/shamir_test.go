@@ -0,0 +1,157 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+)
+
+// subsets calls f with every k-element subset of 0..n-1.
+func subsets(n, k int, f func([]int)) {
+	var rec func(start int, cur []int)
+	rec = func(start int, cur []int) {
+		if len(cur) == k {
+			f(cur)
+			return
+		}
+		for i := start; i < n; i++ {
+			rec(i+1, append(cur, i))
+		}
+	}
+	rec(0, nil)
+}
+
+func combineSubset(t *testing.T, shares [][]byte, idx []int) []byte {
+	t.Helper()
+	var xs []byte
+	var ys [][]byte
+	for _, i := range idx {
+		xs, ys = append(xs, byte(i+1)), append(ys, shares[i])
+	}
+	secret, err := combineShares(xs, ys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestSplitCombine(t *testing.T) {
+	for _, tc := range []struct{ m, n int }{{2, 2}, {2, 3}, {3, 5}, {4, 7}, {5, 5}} {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		shares, err := splitSecret(secret, tc.m, tc.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subsets(tc.n, tc.m, func(idx []int) {
+			if !bytes.Equal(combineSubset(t, shares, idx), secret) {
+				t.Errorf("%d of %d: shares %v do not recover the secret", tc.m, tc.n, idx)
+			}
+		})
+		subsets(tc.n, tc.m-1, func(idx []int) {
+			if len(idx) > 0 && bytes.Equal(combineSubset(t, shares, idx), secret) {
+				t.Errorf("%d of %d: shares %v below the threshold recover the secret", tc.m, tc.n, idx)
+			}
+		})
+	}
+
+	secret := make([]byte, 32)
+	shares, err := splitSecret(secret, 3, MaxCustodians)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(combineSubset(t, shares, []int{0, 127, 254}), secret) {
+		t.Error("shares at the ends of the field do not recover the secret")
+	}
+	for _, bad := range []struct{ m, n int }{{1, 3}, {4, 3}, {2, MaxCustodians + 1}} {
+		if _, err := splitSecret(secret, bad.m, bad.n); err == nil {
+			t.Errorf("threshold %d of %d accepted", bad.m, bad.n)
+		}
+	}
+}
+
+func TestCombineRejectsBadIndices(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := splitSecret(secret, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, xs := range [][]byte{{1, 1}, {0, 2}, {2, 0}} {
+		if _, err := combineShares(xs, shares[:2]); err == nil {
+			t.Errorf("share indices %v accepted", xs)
+		}
+	}
+}
+
+func TestJoinCustodianShares(t *testing.T) {
+	ctx := context.Background()
+	var ws []KeyWrapper
+	var us []KeyUnwrapper
+	for range 3 {
+		w, u := newTestKey(t, KeyTypeX25519)
+		ws, us = append(ws, w), append(us, u)
+	}
+	zb := packTest(t, PackOptions{Custodians: ws, Threshold: 2})
+	var shares []*CustodianShare
+	for _, u := range us {
+		b, err := ExportCustodianShare(ctx, bytes.NewReader(zb), int64(len(zb)), u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := ParseCustodianShare(ctx, b, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares = append(shares, s)
+	}
+	subsets(3, 2, func(idx []int) {
+		unpackTest(t, zb, UnpackOptions{CustodianShares: []*CustodianShare{shares[idx[0]], shares[idx[1]]}})
+	})
+
+	stray := *shares[0]
+	stray.KeyID, stray.Index = ws[0].KeyID()[:63]+"0", 0
+	for name, bad := range map[string][]*CustodianShare{
+		"below threshold":  {shares[0]},
+		"duplicate":        {shares[0], shares[0]},
+		"unknown, index 0": {shares[1], &stray},
+	} {
+		err := Unpack(ctx, bytes.NewReader(zb), int64(len(zb)), memWriter{}, UnpackOptions{CustodianShares: bad})
+		if err == nil {
+			t.Errorf("%s: shares accepted", name)
+		}
+	}
+	if err := Unpack(ctx, bytes.NewReader(zb), int64(len(zb)), memWriter{}, UnpackOptions{KeyUnwrapper: us[0]}); err == nil {
+		t.Error("a single custodian key unwrapped the package")
+	}
+}
+
+func TestCustodiansRejectEscrow(t *testing.T) {
+	c1, _ := newTestKey(t, KeyTypeX25519)
+	c2, _ := newTestKey(t, KeyTypeX25519)
+	ew, _ := newTestKey(t, KeyTypeX25519)
+	opts := PackOptions{Recipients: []KeyWrapper{NewEscrowWrapper(ew)}, Custodians: []KeyWrapper{c1, c2}, Threshold: 2}
+	if err := Pack(context.Background(), new(bytes.Buffer), testFiles, opts); err == nil {
+		t.Error("escrow recipient accepted next to custodians")
+	}
+
+	m := &Manifest{
+		FormatVersion: ManifestVersion,
+		PackageID:     "2f0c5f8e-8c55-4c1e-9a51-2b7f3f1f6d0a",
+		CipherSuite:   SuiteFernet,
+		ChunkSize:     DefaultChunkSize,
+		Threshold:     2,
+		Files:         []ManifestFile{},
+	}
+	for i, w := range []KeyWrapper{c1, c2, ew} {
+		r := ManifestRecipient{KeyWrap: w.Algorithm(), KeyID: w.KeyID(), Entry: WrappedKeysDir + w.KeyID() + ".bin", SHA256: w.KeyID(), Share: i + 1}
+		m.Recipients = append(m.Recipients, r)
+	}
+	if err := m.validate(); err != nil {
+		t.Fatalf("custodian manifest rejected: %v", err)
+	}
+	m.Recipients[2].Escrow, m.Recipients[2].Share = true, 0
+	if err := m.validate(); err == nil {
+		t.Error("manifest with an escrow recipient next to custodians accepted")
+	}
+}
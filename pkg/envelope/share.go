@@ -0,0 +1,104 @@
+package envelope
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fernet/fernet-go"
+)
+
+// KeyShareSize is the size of the license key share: one Fernet key.
+const KeyShareSize = 32
+
+// shareWrapLabel is the RSA-OAEP label of the key share wrapped for the
+// vendor, distinct from keyWrapLabel so neither can stand in for the other.
+var shareWrapLabel = []byte("secure_packager-license-share")
+
+// ErrNoKeyShare is returned when a package's data key is split with the
+// license token but the token carries no key share.
+var ErrNoKeyShare = errors.New("license token carries no key share for this package")
+
+// ErrWrongKeyShare is returned when the key share in the license token does
+// not recover the data key of the package.
+var ErrWrongKeyShare = errors.New("license token key share does not unlock this package")
+
+// splitKey returns a random share and k XOR share. Both halves are needed to
+// recover k, and either alone reveals nothing about it.
+func splitKey(k *fernet.Key) (share []byte, rest *fernet.Key, err error) {
+	share = make([]byte, KeyShareSize)
+	if _, err := rand.Read(share); err != nil {
+		return nil, nil, err
+	}
+	rest = new(fernet.Key)
+	for i := range rest {
+		rest[i] = k[i] ^ share[i]
+	}
+	return share, rest, nil
+}
+
+// joinKey reverses splitKey.
+func joinKey(rest *fernet.Key, share []byte) (*fernet.Key, error) {
+	if len(share) != KeyShareSize {
+		return nil, fmt.Errorf("invalid key share length %d", len(share))
+	}
+	k := new(fernet.Key)
+	for i := range k {
+		k[i] = rest[i] ^ share[i]
+	}
+	return k, nil
+}
+
+// wrapShare encrypts the key share with RSA-OAEP SHA-256 for the vendor.
+func wrapShare(vendorPub *rsa.PublicKey, share []byte) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, vendorPub, share, shareWrapLabel)
+}
+
+// ReadKeyShare opens the package in r with the vendor private key and
+// returns its package ID and, for packages whose data key is split with the
+// license token, the key share to put in the token. The share is nil for
+// other packages.
+func ReadKeyShare(r io.ReaderAt, size int64, vendorPriv *rsa.PrivateKey) (packageID string, share []byte, err error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", nil, err
+	}
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	mf, ok := entries[ManifestName]
+	if !ok {
+		return "", nil, fmt.Errorf("package has no %s", ManifestName)
+	}
+	mb, err := readZipFile(mf)
+	if err != nil {
+		return "", nil, err
+	}
+	m, err := ParseManifest(mb)
+	if err != nil {
+		return "", nil, err
+	}
+	if m.License == nil || m.License.KeyShare == "" {
+		return m.PackageID, nil, nil
+	}
+	sf, ok := entries[m.License.KeyShare]
+	if !ok {
+		return "", nil, fmt.Errorf("package is missing %s listed in the manifest", m.License.KeyShare)
+	}
+	wrapped, err := readZipFile(sf)
+	if err != nil {
+		return "", nil, err
+	}
+	if share, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, vendorPriv, wrapped, shareWrapLabel); err != nil {
+		return "", nil, fmt.Errorf("unwrapping key share (is this the vendor key the package was made for?): %w", err)
+	}
+	if len(share) != KeyShareSize {
+		return "", nil, fmt.Errorf("invalid key share length %d", len(share))
+	}
+	return m.PackageID, share, nil
+}
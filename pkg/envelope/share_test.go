@@ -0,0 +1,128 @@
+package envelope
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// editEntry returns a copy of the zip package zb with the named entry
+// replaced by edit of its contents.
+func editEntry(t *testing.T, zb []byte, name string, edit func([]byte) []byte) []byte {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(zb), int64(len(zb)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		if f.Name != name {
+			if err := zw.Copy(f); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		b, err := readZipFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: f.Method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(edit(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLicenseKeyShare(t *testing.T) {
+	vendor, vendorPEM := newVendorKey(t)
+	other, _ := newVendorKey(t)
+	w, u := newTestKey(t, KeyTypeX25519)
+	opts := PackOptions{Recipients: []KeyWrapper{w}, License: true, LicenseKeyShare: true, VendorPublicKey: vendorPEM}
+	zb := packTest(t, opts)
+	opts.Private = true
+	private := packTest(t, opts)
+	otherPkg := packTest(t, PackOptions{Recipients: []KeyWrapper{w}, License: true, LicenseKeyShare: true, VendorPublicKey: vendorPEM})
+
+	readShare := func(zb []byte) (string, []byte) {
+		t.Helper()
+		id, share, err := ReadKeyShare(bytes.NewReader(zb), int64(len(zb)), vendor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(share) != KeyShareSize {
+			t.Fatalf("share of %d bytes", len(share))
+		}
+		return id, share
+	}
+	id, share := readShare(zb)
+	privateID, privateShare := readShare(private)
+	otherID, otherShare := readShare(otherPkg)
+	flipped := append([]byte(nil), share...)
+	flipped[0] ^= 1
+
+	expiry := time.Now().Add(30 * 24 * time.Hour)
+	tests := []struct {
+		name  string
+		zb    []byte
+		pkg   string
+		share []byte
+		want  error // nil for success, errAny for any error
+	}{
+		{"bound token", zb, id, share, nil},
+		{"private, bound token", private, privateID, privateShare, nil},
+		{"no share", zb, id, nil, ErrNoKeyShare},
+		{"unbound share", zb, "", share, ErrNoKeyShare},
+		{"token for another package", zb, otherID, otherShare, errAny},
+		{"share of another package", zb, id, otherShare, ErrWrongKeyShare},
+		{"tampered share", zb, id, flipped, ErrWrongKeyShare},
+		{"private, tampered share", private, privateID, flipped, ErrWrongKeyShare},
+	}
+	for version, issue := range issuers {
+		for _, tc := range tests {
+			t.Run(version+"/"+tc.name, func(t *testing.T) {
+				tok, err := issue(vendor, License{Expiry: expiry, Company: "Acme", Email: "ops@example.com", PackageID: tc.pkg, KeyShare: tc.share})
+				if err != nil {
+					t.Fatal(err)
+				}
+				uo := UnpackOptions{KeyUnwrapper: u, LicenseToken: tok}
+				if tc.want == nil {
+					unpackTest(t, tc.zb, uo)
+					return
+				}
+				err = Unpack(context.Background(), bytes.NewReader(tc.zb), int64(len(tc.zb)), memWriter{}, uo)
+				if err == nil || tc.want != errAny && !errors.Is(err, tc.want) {
+					t.Errorf("got %v, want %v", err, tc.want)
+				}
+			})
+		}
+	}
+
+	if err := Unpack(context.Background(), bytes.NewReader(zb), int64(len(zb)), memWriter{}, UnpackOptions{KeyUnwrapper: u}); !errors.Is(err, ErrLicenseRequired) {
+		t.Errorf("without a token: got %v, want %v", err, ErrLicenseRequired)
+	}
+	if _, _, err := ReadKeyShare(bytes.NewReader(zb), int64(len(zb)), other); err == nil {
+		t.Error("share read with the wrong vendor key")
+	}
+	tampered := editEntry(t, zb, KeyShareName, func(b []byte) []byte {
+		b[len(b)/2] ^= 1
+		return b
+	})
+	if _, _, err := ReadKeyShare(bytes.NewReader(tampered), int64(len(tampered)), vendor); err == nil {
+		t.Error("tampered wrapped share read")
+	}
+	plain := packTest(t, PackOptions{Recipients: []KeyWrapper{w}, License: true, VendorPublicKey: vendorPEM})
+	if _, s, err := ReadKeyShare(bytes.NewReader(plain), int64(len(plain)), vendor); err != nil || s != nil {
+		t.Errorf("package without a share: %x, %v", s, err)
+	}
+}
@@ -0,0 +1,54 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// SigRSAPSS identifies manifest signatures made with RSA-PSS over the
+// SHA-256 of manifest.json, the scheme license tokens use.
+const SigRSAPSS = "RSA-PSS-SHA256"
+
+var (
+	// ErrUnsigned is returned when a signature is required but the package
+	// has no manifest.sig.
+	ErrUnsigned = errors.New("package is not signed")
+	// ErrNoSignerKey is returned when a signature is required but no vendor
+	// signing key was pinned to verify it with.
+	ErrNoSignerKey = errors.New("package signature required but no vendor signing key is pinned")
+)
+
+// SignerInfo identifies the key a package was signed with.
+type SignerInfo struct {
+	Algorithm string `json:"alg"`
+	// KeyID is the KeyFingerprint of the vendor signing key.
+	KeyID string `json:"key_id"`
+}
+
+// signManifest signs the encoded manifest and returns the contents of
+// manifest.sig: the base64 signature followed by a newline.
+func signManifest(priv *rsa.PrivateKey, manifest []byte) ([]byte, error) {
+	sum := sha256.Sum256(manifest)
+	sig, err := rsa.SignPSS(rand.Reader, priv, crypto.SHA256, sum[:], nil)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sig) + "\n"), nil
+}
+
+// verifyManifest checks manifest.sig against the exact bytes of
+// manifest.json.
+func verifyManifest(pub *rsa.PublicKey, manifest, sigFile []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sigFile)))
+	if err != nil {
+		return fmt.Errorf("invalid signature b64: %w", err)
+	}
+	sum := sha256.Sum256(manifest)
+	return rsa.VerifyPSS(pub, crypto.SHA256, sum[:], sig, nil)
+}
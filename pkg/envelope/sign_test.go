@@ -0,0 +1,95 @@
+package envelope
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+)
+
+// TestSignaturePolicy checks which packages unpack accepts with each way of
+// pinning the vendor signing key.
+func TestSignaturePolicy(t *testing.T) {
+	vendor, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := new(TrustStore)
+	if err := store.Add("vendor", &vendor.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	w, u := newTestKey(t, KeyTypeX25519)
+	packages := map[string][]byte{
+		"unsigned":        packTest(t, PackOptions{Recipients: []KeyWrapper{w}}),
+		"signed":          packTest(t, PackOptions{Recipients: []KeyWrapper{w}, SigningKey: vendor}),
+		"signed by other": packTest(t, PackOptions{Recipients: []KeyWrapper{w}, SigningKey: other}),
+	}
+	packages["stripped"] = dropEntry(t, packages["signed"], SignatureName)
+	tests := []struct {
+		name, pkg string
+		opts      UnpackOptions
+		want      error // nil for success, errAny for any error
+	}{
+		{"no policy, unsigned", "unsigned", UnpackOptions{}, nil},
+		{"no policy, signed by other", "signed by other", UnpackOptions{}, nil},
+		{"required, unpinned", "signed", UnpackOptions{RequireSignature: true}, ErrNoSignerKey},
+		{"required, unsigned", "unsigned", UnpackOptions{RequireSignature: true, TrustStore: store}, ErrUnsigned},
+		{"trust store, unsigned", "unsigned", UnpackOptions{TrustStore: store}, ErrUnsigned},
+		{"trust store, unsigned allowed", "unsigned", UnpackOptions{TrustStore: store, AllowUnsigned: true}, nil},
+		{"trust store, signature stripped", "stripped", UnpackOptions{TrustStore: store}, ErrUnsigned},
+		{"trust store, signed", "signed", UnpackOptions{TrustStore: store}, nil},
+		{"trust store, untrusted signer", "signed by other", UnpackOptions{TrustStore: store}, errAny},
+		{"required, unsigned allowed", "unsigned", UnpackOptions{RequireSignature: true, TrustStore: store, AllowUnsigned: true}, ErrUnsigned},
+		{"pinned, unsigned allowed", "unsigned", UnpackOptions{SignerPublicKey: &vendor.PublicKey, AllowUnsigned: true}, ErrUnsigned},
+		{"required, trust store", "signed", UnpackOptions{RequireSignature: true, TrustStore: store}, nil},
+		{"required, untrusted signer", "signed by other", UnpackOptions{RequireSignature: true, TrustStore: store}, errAny},
+		{"pinned, unsigned", "unsigned", UnpackOptions{SignerPublicKey: &vendor.PublicKey}, ErrUnsigned},
+		{"pinned, signed", "signed", UnpackOptions{SignerPublicKey: &vendor.PublicKey}, nil},
+		{"pinned, signed by other", "signed by other", UnpackOptions{SignerPublicKey: &vendor.PublicKey}, errAny},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			zb := packages[tc.pkg]
+			tc.opts.KeyUnwrapper = u
+			err := Unpack(context.Background(), bytes.NewReader(zb), int64(len(zb)), memWriter{}, tc.opts)
+			switch {
+			case tc.want == nil && err != nil:
+				t.Errorf("refused: %v", err)
+			case tc.want == errAny && err == nil, tc.want != nil && tc.want != errAny && !errors.Is(err, tc.want):
+				t.Errorf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+var errAny = errors.New("any error")
+
+// dropEntry returns a copy of the zip package zb without the named entry.
+func dropEntry(t *testing.T, zb []byte, name string) []byte {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(zb), int64(len(zb)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		if f.Name == name {
+			continue
+		}
+		if err := zw.Copy(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
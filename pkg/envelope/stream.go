@@ -0,0 +1,542 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/fernet/fernet-go"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Chunked payload format.
+//
+// Payloads are split into fixed-size chunks so that files of any size can be
+// encrypted and decrypted with constant memory:
+//
+//	header: "SPKS" | version (1 byte) | chunk size (uint32 BE) | stream ID (16 bytes)
+//	chunk:  sealed length (uint32 BE) | sealed chunk
+//
+// Every sealed chunk authenticates and encrypts
+//
+//	stream ID (16 bytes) | chunk index (uint64 BE) | final flag (1 byte) | data
+//
+// so chunks cannot be moved between payloads, reordered, dropped or have the
+// stream truncated after them without the reader noticing. Every chunk but the
+// last holds exactly chunk size bytes of data; the last one has the final flag
+// set and may be empty.
+//
+// How chunks are sealed depends on the cipher suite recorded in the manifest.
+// With SuiteFernet each chunk is a Fernet token, with its own random IV and
+// HMAC. With the AEAD suites each payload gets its own key, derived from the
+// data key with HKDF-SHA256 salted with the stream ID, and each chunk is the
+// raw binary AEAD ciphertext under a nonce holding the chunk index.
+const (
+	DefaultChunkSize = 64 << 10
+	MaxChunkSize     = 16 << 20
+
+	streamMagic     = "SPKS"
+	streamVersion   = 1
+	streamIDSize    = 16
+	streamHeaderLen = len(streamMagic) + 1 + 4 + streamIDSize
+	chunkHeaderLen  = streamIDSize + 8 + 1
+)
+
+// ErrTruncated is returned when a chunked payload ends before its final chunk.
+var ErrTruncated = errors.New("encrypted payload is truncated")
+
+type streamHeader struct {
+	chunkSize int
+	id        [streamIDSize]byte
+}
+
+func (h *streamHeader) marshal() []byte {
+	b := make([]byte, 0, streamHeaderLen)
+	b = append(b, streamMagic...)
+	b = append(b, streamVersion)
+	b = binary.BigEndian.AppendUint32(b, uint32(h.chunkSize))
+	return append(b, h.id[:]...)
+}
+
+func parseStreamHeader(b []byte) (*streamHeader, error) {
+	if len(b) != streamHeaderLen || string(b[:4]) != streamMagic {
+		return nil, errors.New("not a chunked payload")
+	}
+	if b[4] != streamVersion {
+		return nil, fmt.Errorf("unsupported chunked payload version %d", b[4])
+	}
+	h := &streamHeader{chunkSize: int(binary.BigEndian.Uint32(b[5:9]))}
+	if h.chunkSize <= 0 || h.chunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d", h.chunkSize)
+	}
+	copy(h.id[:], b[9:])
+	return h, nil
+}
+
+// chunkCipher seals the chunks of one payload.
+type chunkCipher interface {
+	seal(index uint64, msg []byte) ([]byte, error)
+	open(index uint64, sealed []byte) ([]byte, error)
+	// sealedLen returns the sealed size of a chunk with n bytes of data.
+	// Full chunks therefore all have the same size on disk.
+	sealedLen(n int) int
+}
+
+func newChunkCipher(suite string, key *fernet.Key, hdr *streamHeader) (chunkCipher, error) {
+	var aead cipher.AEAD
+	switch suite {
+	case SuiteFernet:
+		return fernetChunks{key}, nil
+	case SuiteAES256GCM:
+		k, err := payloadKey(suite, key, hdr)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		if aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	case SuiteXChaCha20Poly1305:
+		k, err := payloadKey(suite, key, hdr)
+		if err != nil {
+			return nil, err
+		}
+		if aead, err = chacha20poly1305.NewX(k); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite %q", suite)
+	}
+	return aeadChunks{aead}, nil
+}
+
+// payloadKey derives the AEAD key of one payload. Stream IDs are random, so
+// no two payloads share a key and the chunk index alone is a safe nonce.
+func payloadKey(suite string, key *fernet.Key, hdr *streamHeader) ([]byte, error) {
+	return hkdf.Key(sha256.New, key[:], hdr.id[:], "secure_packager payload "+suite, 32)
+}
+
+type fernetChunks struct {
+	key *fernet.Key
+}
+
+func (c fernetChunks) seal(_ uint64, msg []byte) ([]byte, error) {
+	return fernet.EncryptAndSign(msg, c.key)
+}
+
+func (c fernetChunks) open(_ uint64, tok []byte) ([]byte, error) {
+	msg := fernet.VerifyAndDecrypt(tok, 0, []*fernet.Key{c.key})
+	if msg == nil {
+		return nil, errors.New("authentication failed")
+	}
+	return msg, nil
+}
+
+func (c fernetChunks) sealedLen(n int) int {
+	// version + timestamp + IV + padded ciphertext + HMAC, base64url encoded
+	raw := 1 + 8 + 16 + (chunkHeaderLen+n)/16*16 + 16 + 32
+	return (raw + 2) / 3 * 4
+}
+
+type aeadChunks struct {
+	aead cipher.AEAD
+}
+
+func (c aeadChunks) nonce(index uint64) []byte {
+	n := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], index)
+	return n
+}
+
+func (c aeadChunks) seal(index uint64, msg []byte) ([]byte, error) {
+	return c.aead.Seal(nil, c.nonce(index), msg, nil), nil
+}
+
+func (c aeadChunks) open(index uint64, sealed []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nonce(index), sealed, nil)
+}
+
+func (c aeadChunks) sealedLen(n int) int {
+	return chunkHeaderLen + n + c.aead.Overhead()
+}
+
+type encryptWriter struct {
+	w     io.Writer
+	c     chunkCipher
+	hdr   streamHeader
+	buf   []byte
+	index uint64
+	err   error
+}
+
+// NewEncryptWriter returns a WriteCloser that encrypts everything written to
+// it into the chunked payload format on w, sealing chunks with Fernet. Close
+// must be called to write the final chunk; it does not close w. A chunkSize
+// of zero selects DefaultChunkSize.
+func NewEncryptWriter(w io.Writer, key *fernet.Key, chunkSize int) (io.WriteCloser, error) {
+	return NewSuiteEncryptWriter(w, SuiteFernet, key, chunkSize)
+}
+
+// NewSuiteEncryptWriter is like NewEncryptWriter but seals chunks with the
+// given cipher suite.
+func NewSuiteEncryptWriter(w io.Writer, suite string, key *fernet.Key, chunkSize int) (io.WriteCloser, error) {
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < 0 || chunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	ew := &encryptWriter{w: w, hdr: streamHeader{chunkSize: chunkSize}}
+	if _, err := rand.Read(ew.hdr.id[:]); err != nil {
+		return nil, err
+	}
+	var err error
+	if ew.c, err = newChunkCipher(suite, key, &ew.hdr); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(ew.hdr.marshal()); err != nil {
+		return nil, err
+	}
+	ew.buf = make([]byte, 0, chunkSize)
+	return ew, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n := 0
+	for len(p) > 0 {
+		// A full buffer is only known not to be the last chunk once more
+		// data arrives
+		if len(ew.buf) == cap(ew.buf) {
+			if ew.err = ew.seal(false); ew.err != nil {
+				return n, ew.err
+			}
+		}
+		c := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (ew *encryptWriter) Close() error {
+	if ew.err != nil {
+		return ew.err
+	}
+	ew.err = ew.seal(true)
+	if ew.err == nil {
+		ew.err = errors.New("write to closed encrypt writer")
+		return nil
+	}
+	return ew.err
+}
+
+func (ew *encryptWriter) seal(final bool) error {
+	msg := make([]byte, 0, chunkHeaderLen+len(ew.buf))
+	msg = append(msg, ew.hdr.id[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, ew.index)
+	if final {
+		msg = append(msg, 1)
+	} else {
+		msg = append(msg, 0)
+	}
+	msg = append(msg, ew.buf...)
+	tok, err := ew.c.seal(ew.index, msg)
+	if err != nil {
+		return err
+	}
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(tok)))
+	if _, err := ew.w.Write(l[:]); err != nil {
+		return err
+	}
+	if _, err := ew.w.Write(tok); err != nil {
+		return err
+	}
+	ew.index++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+type decryptReader struct {
+	r     io.Reader
+	c     chunkCipher
+	hdr   *streamHeader
+	tok   []byte
+	buf   []byte
+	index uint64
+	done  bool
+	err   error
+}
+
+// NewDecryptReader returns a Reader that decrypts a chunked payload sealed
+// with Fernet from r. Each chunk is authenticated before any of its data is
+// returned; a payload that ends without its final chunk yields ErrTruncated.
+func NewDecryptReader(r io.Reader, key *fernet.Key) (io.Reader, error) {
+	return NewSuiteDecryptReader(r, SuiteFernet, key)
+}
+
+// NewSuiteDecryptReader is like NewDecryptReader for payloads sealed with
+// the given cipher suite.
+func NewSuiteDecryptReader(r io.Reader, suite string, key *fernet.Key) (io.Reader, error) {
+	b := make([]byte, streamHeaderLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	hdr, err := parseStreamHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newChunkCipher(suite, key, hdr)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, c: c, hdr: hdr}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.done {
+			return 0, io.EOF
+		}
+		dr.err = dr.next()
+	}
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+// next reads, authenticates and decrypts the next chunk into dr.buf.
+func (dr *decryptReader) next() error {
+	var l [4]byte
+	if _, err := io.ReadFull(dr.r, l[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrTruncated
+		}
+		return err
+	}
+	n := int(binary.BigEndian.Uint32(l[:]))
+	if n > dr.c.sealedLen(dr.hdr.chunkSize) {
+		return fmt.Errorf("chunk %d: invalid length %d", dr.index, n)
+	}
+	if cap(dr.tok) < n {
+		dr.tok = make([]byte, n)
+	}
+	dr.tok = dr.tok[:n]
+	if _, err := io.ReadFull(dr.r, dr.tok); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrTruncated
+		}
+		return err
+	}
+	data, final, err := openChunk(dr.hdr, dr.c, dr.index, dr.tok)
+	if err != nil {
+		return err
+	}
+	if final {
+		// Nothing may follow the final chunk
+		var extra [1]byte
+		if _, err := io.ReadFull(dr.r, extra[:]); err == nil {
+			return errors.New("unexpected data after final chunk")
+		}
+		dr.done = true
+	}
+	dr.index++
+	dr.buf = data
+	return nil
+}
+
+type decryptReaderAt struct {
+	r      io.ReaderAt
+	c      chunkCipher
+	hdr    *streamHeader
+	chunks int64
+	size   int64
+
+	mu        sync.Mutex
+	cacheIdx  int64
+	cacheData []byte
+}
+
+// NewDecryptReaderAt gives random access to the chunked payload of size
+// bytes in r, sealed with Fernet. Only the chunks covering a read are fetched
+// and authenticated, and the most recently used chunk is cached. The
+// plaintext size is derived from the payload layout and the authenticated
+// final chunk.
+func NewDecryptReaderAt(r io.ReaderAt, size int64, key *fernet.Key) (*io.SectionReader, error) {
+	return NewSuiteDecryptReaderAt(r, size, SuiteFernet, key)
+}
+
+// NewSuiteDecryptReaderAt is like NewDecryptReaderAt for payloads sealed
+// with the given cipher suite.
+func NewSuiteDecryptReaderAt(r io.ReaderAt, size int64, suite string, key *fernet.Key) (*io.SectionReader, error) {
+	b := make([]byte, streamHeaderLen)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	hdr, err := parseStreamHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newChunkCipher(suite, key, hdr)
+	if err != nil {
+		return nil, err
+	}
+	d := &decryptReaderAt{r: r, c: c, hdr: hdr, cacheIdx: -1}
+	// Every chunk but the last occupies exactly stride bytes
+	stride := int64(4 + c.sealedLen(hdr.chunkSize))
+	body := size - int64(streamHeaderLen)
+	if body <= 0 {
+		return nil, ErrTruncated
+	}
+	d.chunks = (body + stride - 1) / stride
+	last, err := d.chunk(d.chunks - 1)
+	if err != nil {
+		return nil, err
+	}
+	d.size = (d.chunks-1)*int64(hdr.chunkSize) + int64(len(last))
+	return io.NewSectionReader(d, 0, d.size), nil
+}
+
+func (d *decryptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	cs := int64(d.hdr.chunkSize)
+	n := 0
+	for n < len(p) {
+		if off >= d.size {
+			return n, io.EOF
+		}
+		data, err := d.chunk(off / cs)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[off%cs:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// chunk returns the authenticated data of chunk i, which must not be
+// modified. The final flag must be set on the last chunk and only there, so a
+// payload cut at a chunk boundary is detected.
+func (d *decryptReaderAt) chunk(i int64) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cacheIdx == i {
+		return d.cacheData, nil
+	}
+	stride := int64(4 + d.c.sealedLen(d.hdr.chunkSize))
+	off := int64(streamHeaderLen) + i*stride
+	var l [4]byte
+	if _, err := d.r.ReadAt(l[:], off); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint32(l[:]))
+	isLast := i == d.chunks-1
+	if n > d.c.sealedLen(d.hdr.chunkSize) || (!isLast && int64(n) != stride-4) {
+		return nil, fmt.Errorf("chunk %d: invalid length %d", i, n)
+	}
+	tok := make([]byte, n+1)
+	m, err := d.r.ReadAt(tok, off+4)
+	if m < n {
+		if err == nil || errors.Is(err, io.EOF) {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	if isLast && m > n {
+		return nil, errors.New("unexpected data after final chunk")
+	}
+	data, final, err := openChunk(d.hdr, d.c, uint64(i), tok[:n])
+	if err != nil {
+		return nil, err
+	}
+	if final != isLast {
+		if isLast {
+			return nil, ErrTruncated
+		}
+		return nil, fmt.Errorf("chunk %d: unexpected final chunk", i)
+	}
+	d.cacheIdx, d.cacheData = i, data
+	return data, nil
+}
+
+// openChunk authenticates and decrypts the chunk with the given index.
+func openChunk(hdr *streamHeader, c chunkCipher, index uint64, sealed []byte) ([]byte, bool, error) {
+	msg, err := c.open(index, sealed)
+	if err != nil || len(msg) < chunkHeaderLen {
+		return nil, false, fmt.Errorf("chunk %d: authentication failed", index)
+	}
+	if !bytes.Equal(msg[:streamIDSize], hdr.id[:]) || binary.BigEndian.Uint64(msg[streamIDSize:]) != index {
+		return nil, false, fmt.Errorf("chunk %d: out of place", index)
+	}
+	final := msg[streamIDSize+8] == 1
+	data := msg[chunkHeaderLen:]
+	if (!final && len(data) != hdr.chunkSize) || len(data) > hdr.chunkSize {
+		return nil, false, fmt.Errorf("chunk %d: invalid size %d", index, len(data))
+	}
+	return data, final, nil
+}
+
+// newPayloadReader decrypts either a chunked payload or, for Fernet packages
+// made by older versions, a single Fernet token holding the whole file.
+func newPayloadReader(r io.Reader, suite string, key *fernet.Key) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(streamMagic)); string(magic) == streamMagic {
+		return NewSuiteDecryptReader(br, suite, key)
+	}
+	if suite != SuiteFernet {
+		return nil, errors.New("not a chunked payload")
+	}
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	pt := fernet.VerifyAndDecrypt(data, 0, []*fernet.Key{key})
+	if pt == nil {
+		return nil, errors.New("authentication failed")
+	}
+	return bytes.NewReader(pt), nil
+}
+
+// ctxReader fails reads once its context is done, so long copies can be
+// cancelled between chunks.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,160 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/fernet/fernet-go"
+)
+
+const testChunkSize = 64
+
+var testSuites = []string{SuiteFernet, SuiteAES256GCM, SuiteXChaCha20Poly1305}
+
+func newTestDataKey(t *testing.T) *fernet.Key {
+	t.Helper()
+	k := new(fernet.Key)
+	if err := k.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func encryptTest(t *testing.T, suite string, k *fernet.Key, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	ew, err := NewSuiteEncryptWriter(&buf, suite, k, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ew.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decryptBoth decrypts payload with the streaming and the random-access
+// reader, which must agree.
+func decryptBoth(t *testing.T, suite string, k *fernet.Key, payload []byte) ([]byte, error) {
+	t.Helper()
+	dr, err := NewSuiteDecryptReader(bytes.NewReader(payload), suite, k)
+	var got []byte
+	if err == nil {
+		got, err = io.ReadAll(dr)
+	}
+	sr, errAt := NewSuiteDecryptReaderAt(bytes.NewReader(payload), int64(len(payload)), suite, k)
+	var gotAt []byte
+	if errAt == nil {
+		gotAt, errAt = io.ReadAll(sr)
+	}
+	if (err == nil) != (errAt == nil) {
+		t.Fatalf("streaming reader: %v, random-access reader: %v", err, errAt)
+	}
+	if err == nil && !bytes.Equal(got, gotAt) {
+		t.Fatal("streaming and random-access readers disagree")
+	}
+	return got, err
+}
+
+// splitChunks returns the header and the length-prefixed chunks of payload.
+func splitChunks(t *testing.T, payload []byte) ([]byte, [][]byte) {
+	t.Helper()
+	hdr, rest := payload[:streamHeaderLen], payload[streamHeaderLen:]
+	var chunks [][]byte
+	for len(rest) > 0 {
+		n := 4 + int(binary.BigEndian.Uint32(rest))
+		chunks = append(chunks, rest[:n])
+		rest = rest[n:]
+	}
+	return hdr, chunks
+}
+
+func joinChunks(hdr []byte, chunks ...[]byte) []byte {
+	return bytes.Join(append([][]byte{hdr}, chunks...), nil)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	sizes := []struct {
+		name   string
+		n      int
+		chunks int
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"chunk minus one", testChunkSize - 1, 1},
+		{"one chunk", testChunkSize, 1},
+		{"one chunk plus one", testChunkSize + 1, 2},
+		{"three chunks", 3 * testChunkSize, 3},
+	}
+	for _, suite := range testSuites {
+		k := newTestDataKey(t)
+		for _, tc := range sizes {
+			t.Run(suite+"/"+tc.name, func(t *testing.T) {
+				data := make([]byte, tc.n)
+				rand.Read(data)
+				payload := encryptTest(t, suite, k, data)
+				if _, chunks := splitChunks(t, payload); len(chunks) != tc.chunks {
+					t.Errorf("%d chunks, want %d", len(chunks), tc.chunks)
+				}
+				got, err := decryptBoth(t, suite, k, payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Error("plaintext does not round-trip")
+				}
+			})
+		}
+	}
+}
+
+func TestStreamRejectsTampering(t *testing.T) {
+	for _, suite := range testSuites {
+		k := newTestDataKey(t)
+		data := make([]byte, 3*testChunkSize+10)
+		rand.Read(data)
+		hdr, c := splitChunks(t, encryptTest(t, suite, k, data))
+		_, other := splitChunks(t, encryptTest(t, suite, k, data))
+
+		// A stream whose last chunk is complete but lacks the final flag
+		var buf bytes.Buffer
+		w, err := NewSuiteEncryptWriter(&buf, suite, k, testChunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ew := w.(*encryptWriter)
+		ew.buf = append(ew.buf, data[:testChunkSize]...)
+		if err := ew.seal(false); err != nil {
+			t.Fatal(err)
+		}
+		noFinal := buf.Bytes()
+
+		cases := []struct {
+			name    string
+			payload []byte
+		}{
+			{"final chunk dropped", joinChunks(hdr, c[0], c[1], c[2])},
+			{"cut inside a chunk", joinChunks(hdr, c[0], c[1], c[2], c[3][:len(c[3])-1])},
+			{"header only", hdr},
+			{"reordered", joinChunks(hdr, c[1], c[0], c[2], c[3])},
+			{"duplicated", joinChunks(hdr, c[0], c[0], c[1], c[2], c[3])},
+			{"final chunk duplicated", joinChunks(hdr, c[0], c[1], c[2], c[3], c[3])},
+			{"chunk from another stream", joinChunks(hdr, c[0], other[1], c[2], c[3])},
+			{"missing final flag", noFinal},
+			{"data after final chunk", append(joinChunks(hdr, c...), 0)},
+		}
+		for _, tc := range cases {
+			t.Run(suite+"/"+tc.name, func(t *testing.T) {
+				if _, err := decryptBoth(t, suite, k, tc.payload); err == nil {
+					t.Error("tampered payload accepted")
+				}
+			})
+		}
+	}
+}
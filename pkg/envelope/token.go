@@ -0,0 +1,199 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version 2 tokens use the JWS compact serialization:
+// base64url(header) "." base64url(claims) "." base64url(signature), unpadded,
+// signed with PS256 (RSA-PSS, SHA-256, salt length equal to the hash).
+const (
+	tokenAlg  = "PS256"
+	tokenType = "secure-packager-license+jwt"
+)
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// tokenClaims are the JSON claims of a version 2 token. Times are seconds
+// since the Unix epoch, as in JWT.
+type tokenClaims struct {
+	Subject      string         `json:"sub,omitempty"`
+	IssuedAt     int64          `json:"iat"`
+	NotBefore    int64          `json:"nbf,omitempty"`
+	Expiry       int64          `json:"exp"`
+	Company      string         `json:"company"`
+	Email        string         `json:"email"`
+	PackageID    string         `json:"package_id,omitempty"`
+	CustomerKey  string         `json:"customer_key,omitempty"`
+	Entitlements map[string]any `json:"entitlements,omitempty"`
+	// KeyShare is the base64url license key share.
+	KeyShare string `json:"key_share,omitempty"`
+}
+
+var pss256 = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+
+// IssueLicense signs l with the vendor private key and returns a version 2
+// token. IssuedAt defaults to the current time. The token names the signing
+// key by its KeyFingerprint, so verifiers holding several vendor keys can
+// pick the right one.
+func IssueLicense(priv *rsa.PrivateKey, l License) ([]byte, error) {
+	kid, err := KeyFingerprint(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if l.IssuedAt.IsZero() {
+		l.IssuedAt = time.Now()
+	}
+	c := tokenClaims{
+		Subject:      l.Subject,
+		IssuedAt:     l.IssuedAt.Unix(),
+		Expiry:       l.Expiry.Unix(),
+		Company:      l.Company,
+		Email:        l.Email,
+		PackageID:    l.PackageID,
+		CustomerKey:  l.CustomerKey,
+		Entitlements: l.Entitlements,
+	}
+	if l.KeyShare != nil {
+		c.KeyShare = b64(l.KeyShare)
+	}
+	if !l.NotBefore.IsZero() {
+		c.NotBefore = l.NotBefore.Unix()
+	}
+	hb, err := json.Marshal(tokenHeader{Alg: tokenAlg, Typ: tokenType, Kid: kid})
+	if err != nil {
+		return nil, err
+	}
+	cb, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	signingInput := b64(hb) + "." + b64(cb)
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPSS(rand.Reader, priv, crypto.SHA256, sum[:], pss256)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(signingInput + "." + b64(sig)), nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// isTokenV2 tells version 2 tokens from legacy ones, whose base64 alphabet
+// has no dots.
+func isTokenV2(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// tokenKeyID returns the kid of a version 2 token without verifying it, or
+// "" for legacy tokens.
+func tokenKeyID(token []byte) string {
+	t := strings.TrimSpace(string(token))
+	if !isTokenV2(t) {
+		return ""
+	}
+	h, err := base64.RawURLEncoding.DecodeString(t[:strings.IndexByte(t, '.')])
+	if err != nil {
+		return ""
+	}
+	var th tokenHeader
+	if json.Unmarshal(h, &th) != nil {
+		return ""
+	}
+	return th.Kid
+}
+
+func verifyTokenV2(token string, vendorPub *rsa.PublicKey) (*License, error) {
+	parts := strings.Split(token, ".")
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token header b64: %w", err)
+	}
+	var h tokenHeader
+	if err := decodeStrict(hb, &h); err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+	if h.Alg != tokenAlg || h.Typ != tokenType {
+		return nil, fmt.Errorf("unsupported token type %q / alg %q", h.Typ, h.Alg)
+	}
+	kid, err := KeyFingerprint(vendorPub)
+	if err != nil {
+		return nil, err
+	}
+	if h.Kid != kid {
+		return nil, fmt.Errorf("token signed by vendor key %s, not %s", h.Kid, kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature b64: %w", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPSS(vendorPub, crypto.SHA256, sum[:], sig, pss256); err != nil {
+		return nil, fmt.Errorf("token signature invalid: %w", err)
+	}
+
+	cb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token claims b64: %w", err)
+	}
+	// Unknown claims are rejected: a newer issuer may have added a
+	// restriction this release would otherwise ignore
+	var c tokenClaims
+	if err := decodeStrict(cb, &c); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	if c.Expiry == 0 {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	l := &License{
+		Version:      2,
+		KeyID:        h.Kid,
+		Expiry:       time.Unix(c.Expiry, 0).UTC(),
+		Company:      c.Company,
+		Email:        c.Email,
+		IssuedAt:     time.Unix(c.IssuedAt, 0).UTC(),
+		Subject:      c.Subject,
+		PackageID:    c.PackageID,
+		CustomerKey:  c.CustomerKey,
+		Entitlements: c.Entitlements,
+	}
+	if c.NotBefore != 0 {
+		l.NotBefore = time.Unix(c.NotBefore, 0).UTC()
+	}
+	if c.KeyShare != "" {
+		if l.KeyShare, err = base64.RawURLEncoding.DecodeString(c.KeyShare); err != nil || len(l.KeyShare) != KeyShareSize {
+			return nil, fmt.Errorf("invalid token key_share")
+		}
+	}
+	return l, nil
+}
+
+// formatEntitlements renders entitlements as sorted key=value pairs.
+func formatEntitlements(e map[string]any) string {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		v, _ := json.Marshal(e[k])
+		pairs[i] = k + "=" + string(v)
+	}
+	return strings.Join(pairs, ", ")
+}
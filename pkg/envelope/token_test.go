@@ -0,0 +1,158 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyLicense(t *testing.T) {
+	vendor, _ := newVendorKey(t)
+	other, _ := newVendorKey(t)
+	kid, err := KeyFingerprint(&vendor.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	l := License{
+		Expiry: expiry, Company: "Acme", Email: "ops@example.com",
+		IssuedAt: time.Date(2029, 1, 2, 0, 0, 0, 0, time.UTC), NotBefore: time.Date(2029, 2, 1, 0, 0, 0, 0, time.UTC),
+		Subject: "cust-42", Entitlements: map[string]any{"seats": 5.0},
+	}
+	legacy, err := IssueLegacyLicense(vendor, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := IssueLicense(vendor, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := VerifyLicense(legacy, &vendor.PublicKey)
+	if err != nil {
+		t.Fatalf("legacy token: %v", err)
+	}
+	if got.Version != 1 || !got.Expiry.Equal(expiry) || got.Company != l.Company || got.Email != l.Email || got.Subject != "" {
+		t.Errorf("legacy token parsed as %+v", got)
+	}
+	got, err = VerifyLicense(append(v2, '\n'), &vendor.PublicKey)
+	if err != nil {
+		t.Fatalf("v2 token: %v", err)
+	}
+	if got.Version != 2 || got.KeyID != kid || !got.Expiry.Equal(expiry) || !got.NotBefore.Equal(l.NotBefore) ||
+		!got.IssuedAt.Equal(l.IssuedAt) || got.Subject != l.Subject || got.Entitlements["seats"] != 5.0 {
+		t.Errorf("v2 token parsed as %+v", got)
+	}
+
+	// sign makes a version 2 token from arbitrary header and claims
+	sign := func(header, claims any) []byte {
+		hb, err := json.Marshal(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cb, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := b64(hb) + "." + b64(cb)
+		sum := sha256.Sum256([]byte(in))
+		sig, err := vendor.Sign(rand.Reader, sum[:], pss256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []byte(in + "." + b64(sig))
+	}
+	claims := map[string]any{"iat": 1, "exp": expiry.Unix(), "company": "Acme", "email": "ops@example.com"}
+	header := func(alg, typ string) map[string]any {
+		return map[string]any{"alg": alg, "typ": typ, "kid": kid}
+	}
+	parts := strings.Split(string(v2), ".")
+	noneHeader, _ := json.Marshal(header("none", tokenType))
+	forged := l
+	forged.Company = "Evil"
+	byOther, err := IssueLicense(other, forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyByOther, err := IssueLegacyLicense(other, forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherParts := strings.Split(string(byOther), ".")
+
+	tests := []struct {
+		name  string
+		token []byte
+		want  string // error substring
+	}{
+		{"alg none, unsigned", []byte(b64(noneHeader) + "." + parts[1] + "."), "unsupported token"},
+		{"alg none, signed", sign(header("none", tokenType), claims), "unsupported token"},
+		{"alg RS256", sign(header("RS256", tokenType), claims), "unsupported token"},
+		{"wrong typ", sign(header(tokenAlg, "JWT"), claims), "unsupported token"},
+		{"unknown header field", sign(map[string]any{"alg": tokenAlg, "typ": tokenType, "kid": kid, "crit": []string{"x"}}, claims), "invalid token header"},
+		{"unknown claim", sign(header(tokenAlg, tokenType), map[string]any{"exp": expiry.Unix(), "scope": "all"}), "invalid token claims"},
+		{"no expiry", sign(header(tokenAlg, tokenType), map[string]any{"company": "Acme"}), "no expiry"},
+		{"untrusted key", byOther, "not " + kid},
+		{"untrusted key, kid swapped", []byte(parts[0] + "." + otherParts[1] + "." + otherParts[2]), "signature invalid"},
+		{"legacy, untrusted key", legacyByOther, "signature invalid"},
+		{"claims swapped", []byte(parts[0] + "." + otherParts[1] + "." + parts[2]), "signature invalid"},
+		{"trailing garbage", append(append([]byte{}, v2...), "AAAA"...), "signature invalid"},
+		{"trailing segment", append(append([]byte{}, v2...), ".e30"...), "invalid token"},
+		{"legacy, trailing garbage", append(append([]byte{}, legacy...), "QUFB"...), "invalid"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := VerifyLicense(tc.token, &vendor.PublicKey)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// TestLicenseExpiry checks token validity dates against UnpackOptions.Now.
+func TestLicenseExpiry(t *testing.T) {
+	vendor, vendorPEM := newVendorKey(t)
+	w, u := newTestKey(t, KeyTypeX25519)
+	zb := packTest(t, PackOptions{Recipients: []KeyWrapper{w}, License: true, VendorPublicKey: vendorPEM})
+	expiry := time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC)
+	notBefore := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want string // error substring; empty for success
+	}{
+		{"valid", time.Date(2030, 3, 1, 0, 0, 0, 0, time.UTC), ""},
+		{"expiring soon", expiry.Add(-3 * 24 * time.Hour), ""},
+		{"within 24 hours", expiry.Add(-12 * time.Hour), "expires within 24 hours"},
+		{"expired", expiry.Add(time.Hour), "expired"},
+		{"not yet valid", notBefore.Add(-time.Hour), "not valid before"},
+	}
+	for version, issue := range issuers {
+		tok, err := issue(vendor, License{Expiry: expiry, NotBefore: notBefore, Company: "Acme", Email: "ops@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range tests {
+			t.Run(version+"/"+tc.name, func(t *testing.T) {
+				if version == "legacy" && tc.now.Before(notBefore) {
+					t.Skip("legacy tokens carry no not-before date")
+				}
+				opts := UnpackOptions{KeyUnwrapper: u, LicenseToken: tok, Now: tc.now}
+				err := Unpack(context.Background(), bytes.NewReader(zb), int64(len(zb)), memWriter{}, opts)
+				switch {
+				case tc.want == "" && err != nil:
+					t.Errorf("refused: %v", err)
+				case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+					t.Errorf("got %v, want an error containing %q", err, tc.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package envelope
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// TrustedKey is a vendor public key pinned in a TrustStore.
+type TrustedKey struct {
+	// ID is the key's KeyFingerprint.
+	ID string
+	// Source is the file the key was loaded from.
+	Source string
+	Key    *rsa.PublicKey
+}
+
+// TrustStore is a local set of vendor public keys that license tokens and
+// package signatures are verified against, in preference to any key shipped
+// inside a package.
+type TrustStore struct {
+	keys []TrustedKey
+}
+
+// LoadTrustStore reads trusted vendor keys from path, which is either a PEM
+// file holding one or more public keys, or a directory whose *.pem files are
+// read in name order. A key pinned twice is an error, as one of the copies
+// is likely stale.
+func LoadTrustStore(path string) (*TrustStore, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if fi.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.pem")); err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+	ts := new(TrustStore)
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := ts.add(f, b); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+	}
+	if len(ts.keys) == 0 {
+		return nil, fmt.Errorf("no vendor keys found in %s", path)
+	}
+	return ts, nil
+}
+
+func (ts *TrustStore) add(source string, b []byte) error {
+	keys, err := ParseRSAPublicKeys(b)
+	if err != nil {
+		return err
+	}
+	for _, pub := range keys {
+		id, err := KeyFingerprint(pub)
+		if err != nil {
+			return err
+		}
+		for _, k := range ts.keys {
+			if k.ID == id {
+				return fmt.Errorf("vendor key %s is already pinned by %s", id, k.Source)
+			}
+		}
+		ts.keys = append(ts.keys, TrustedKey{ID: id, Source: source, Key: pub})
+	}
+	return nil
+}
+
+// Add pins pub, recording source as where it came from.
+func (ts *TrustStore) Add(source string, pub *rsa.PublicKey) error {
+	id, err := KeyFingerprint(pub)
+	if err != nil {
+		return err
+	}
+	if _, ok := ts.Lookup(id); !ok {
+		ts.keys = append(ts.keys, TrustedKey{ID: id, Source: source, Key: pub})
+	}
+	return nil
+}
+
+// Keys returns the pinned keys.
+func (ts *TrustStore) Keys() []TrustedKey {
+	return append([]TrustedKey(nil), ts.keys...)
+}
+
+// Lookup returns the pinned key with the given ID.
+func (ts *TrustStore) Lookup(id string) (*rsa.PublicKey, bool) {
+	if ts == nil {
+		return nil, false
+	}
+	for _, k := range ts.keys {
+		if k.ID == id {
+			return k.Key, true
+		}
+	}
+	return nil, false
+}
+
+// verifyLicense verifies token against the pinned key it names, or for
+// legacy tokens, which do not say which key signed them, against each pinned
+// key in turn.
+func (ts *TrustStore) verifyLicense(token []byte) (*License, *TrustedKey, error) {
+	if kid := tokenKeyID(token); kid != "" {
+		for i := range ts.keys {
+			if ts.keys[i].ID == kid {
+				lic, err := VerifyLicense(token, ts.keys[i].Key)
+				return lic, &ts.keys[i], err
+			}
+		}
+		return nil, nil, fmt.Errorf("token signed by vendor key %s, which is not in the trust store", kid)
+	}
+	var errs []error
+	for i := range ts.keys {
+		lic, err := VerifyLicense(token, ts.keys[i].Key)
+		if err == nil {
+			return lic, &ts.keys[i], nil
+		}
+		errs = append(errs, fmt.Errorf("key %s: %w", ts.keys[i].ID, err))
+	}
+	return nil, nil, fmt.Errorf("token not signed by any trusted vendor key: %w", errors.Join(errs...))
+}
@@ -0,0 +1,137 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newVendorKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes, err := MarshalPublicKeyPEM(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pemBytes
+}
+
+func writeStore(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadTrustStore(t *testing.T) {
+	k1, pem1 := newVendorKey(t)
+	k2, pem2 := newVendorKey(t)
+	k3, pem3 := newVendorKey(t)
+	dir := writeStore(t, map[string][]byte{
+		"a.pem":      pem1,
+		"b.pem":      append(append([]byte("bundle\n"), pem2...), pem3...),
+		"readme.txt": []byte("not a key"),
+	})
+	ts, err := LoadTrustStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(ts.Keys()); n != 3 {
+		t.Fatalf("loaded %d keys, want 3", n)
+	}
+	for _, k := range []*rsa.PrivateKey{k1, k2, k3} {
+		id, err := KeyFingerprint(&k.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pub, ok := ts.Lookup(id); !ok || !pub.Equal(&k.PublicKey) {
+			t.Errorf("Lookup(%s) = %v, %v", id, pub, ok)
+		}
+	}
+	if _, ok := ts.Lookup(strings.Repeat("0", 64)); ok {
+		t.Error("Lookup found an unknown key ID")
+	}
+	if got := ts.Keys()[0].Source; got != filepath.Join(dir, "a.pem") {
+		t.Errorf("first key loaded from %s, want a.pem", got)
+	}
+
+	single, err := LoadTrustStore(filepath.Join(dir, "b.pem"))
+	if err != nil || len(single.Keys()) != 2 {
+		t.Errorf("loading a bundle file: %v", err)
+	}
+
+	for name, files := range map[string]map[string][]byte{
+		"duplicate key":         {"a.pem": pem1, "b.pem": pem1},
+		"duplicate in a bundle": {"a.pem": append(append([]byte{}, pem1...), pem1...)},
+		"malformed key":         {"a.pem": pem1, "b.pem": []byte("-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----\n")},
+		"no PEM":                {"a.pem": []byte("not a key")},
+		"empty":                 {},
+	} {
+		if _, err := LoadTrustStore(writeStore(t, files)); err == nil {
+			t.Errorf("%s: store loaded", name)
+		}
+	}
+	if _, err := LoadTrustStore(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing store loaded")
+	}
+}
+
+// TestForbidArchiveKeys checks that a token minted with the vendor key
+// shipped in the package only opens it while archive keys are allowed.
+func TestForbidArchiveKeys(t *testing.T) {
+	vendor, _ := newVendorKey(t)
+	minter, minterPEM := newVendorKey(t)
+	store := new(TrustStore)
+	if err := store.Add("vendor", &vendor.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	w, u := newTestKey(t, KeyTypeX25519)
+	zb := packTest(t, PackOptions{Recipients: []KeyWrapper{w}, SigningKey: vendor, License: true, VendorPublicKey: minterPEM})
+	lic := License{Expiry: time.Now().Add(30 * 24 * time.Hour), Company: "Acme", Email: "ops@example.com"}
+	minted, err := IssueLicense(minter, lic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := IssueLicense(vendor, lic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts UnpackOptions
+		want error // nil for success, errAny for any error
+	}{
+		{"archive key allowed", UnpackOptions{LicenseToken: minted}, nil},
+		{"archive key forbidden", UnpackOptions{LicenseToken: minted, ForbidArchiveKeys: true}, ErrArchiveKeyForbidden},
+		{"trust store, archive key allowed", UnpackOptions{LicenseToken: minted, TrustStore: store}, nil},
+		{"trust store, archive key forbidden", UnpackOptions{LicenseToken: minted, TrustStore: store, ForbidArchiveKeys: true}, errAny},
+		{"trusted vendor, archive key forbidden", UnpackOptions{LicenseToken: issued, TrustStore: store, ForbidArchiveKeys: true}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.KeyUnwrapper = u
+			err := Unpack(context.Background(), bytes.NewReader(zb), int64(len(zb)), memWriter{}, tc.opts)
+			switch {
+			case tc.want == nil && err != nil:
+				t.Errorf("refused: %v", err)
+			case tc.want == errAny && err == nil, tc.want != nil && tc.want != errAny && !errors.Is(err, tc.want):
+				t.Errorf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
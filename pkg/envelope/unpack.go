@@ -0,0 +1,93 @@
+package envelope
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	// ErrLicenseRequired is returned when a package needs a license token and
+	// none was supplied.
+	ErrLicenseRequired = errors.New("license required: no license token provided")
+	// ErrNoVendorKey is returned when a license token must be verified but no
+	// vendor public key was supplied or shipped in the package.
+	ErrNoVendorKey = errors.New("license required: vendor public key not found")
+	// ErrArchiveKeyForbidden is returned when the only vendor key available
+	// to verify a license token is the one shipped in the package and
+	// UnpackOptions.ForbidArchiveKeys is set.
+	ErrArchiveKeyForbidden = errors.New("license required: the package's own vendor key may not be used and no pinned key was supplied")
+)
+
+// UnpackOptions configures Unpack and OpenArchive.
+type UnpackOptions struct {
+	// PrivateKey is the customer's RSA private key used to unwrap the data key.
+	PrivateKey *rsa.PrivateKey
+	// KeyUnwrapper unwraps the data key instead of PrivateKey, for
+	// elliptic-curve keys (see NewKeyUnwrapper) or keys held elsewhere.
+	KeyUnwrapper KeyUnwrapper
+	// CustodianShares recover the data key of a package split between
+	// custodians, instead of unwrapping it (see ReadCustodianShare).
+	CustodianShares []*CustodianShare
+	// LicenseToken is the vendor license token. It is required when the
+	// package manifest asks for licensing, and verified whenever present.
+	LicenseToken []byte
+	// VendorPublicKey verifies the license token. When nil, the token is
+	// verified against TrustStore, falling back to the vendor public key
+	// shipped in the package.
+	VendorPublicKey *rsa.PublicKey
+	// TrustStore holds pinned vendor keys for verifying license tokens and
+	// package signatures. Once it is set, unsigned packages are refused
+	// unless AllowUnsigned is set too.
+	TrustStore *TrustStore
+	// AllowUnsigned opens unsigned packages even though TrustStore is set.
+	// It does not override SignerPublicKey or RequireSignature.
+	AllowUnsigned bool
+	// ForbidArchiveKeys refuses to verify license tokens with a vendor key
+	// shipped inside the package.
+	ForbidArchiveKeys bool
+	// SignerPublicKey is the pinned vendor key the package signature must
+	// verify against. Once it is set, unsigned packages are refused. When nil,
+	// signatures are checked against TrustStore by the signer's key ID.
+	SignerPublicKey *rsa.PublicKey
+	// RequireSignature refuses packages that are unsigned or whose signature
+	// cannot be checked because neither SignerPublicKey nor TrustStore is
+	// set. When no key is pinned and it is not set, unsigned packages open,
+	// and so do signed ones with only a warning, so a stripped or swapped
+	// signature goes unnoticed.
+	RequireSignature bool
+	// Now is the time license expiry is checked against; zero means time.Now.
+	Now time.Time
+	// Log receives progress and license messages; nil discards them.
+	Log io.Writer
+}
+
+// Unpack reads the zip package from r, enforces licensing, and writes every
+// decrypted file to dst under its original relative path, recreating the
+// packaged directory tree. Chunked payloads are decrypted as they are
+// streamed; if a chunk fails authentication Unpack returns an error, and the
+// plaintext already written for that file must be discarded by the caller.
+func Unpack(ctx context.Context, r io.ReaderAt, size int64, dst EntryWriter, opts UnpackOptions) error {
+	a, err := OpenArchive(ctx, r, size, opts)
+	if err != nil {
+		return err
+	}
+	for _, dir := range a.dirs {
+		if _, err := dst.Create(dir + "/"); err != nil {
+			return err
+		}
+	}
+	for _, name := range a.names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := a.decrypt(ctx, dst, name); err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", a.payloads[name].Name, err)
+		}
+		logf(opts.Log, "Decrypted %s -> %s\n", a.payloads[name].Name, name)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package envelope
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/fernet/fernet-go"
+)
+
+// Key-wrap algorithms recorded per recipient in the manifest. The ECDH-ES
+// algorithms agree a secret with a fresh ephemeral key, derive a key
+// encryption key from it with HKDF-SHA256, and seal the data key with
+// AES-256-GCM; the wrapped key is the ephemeral public key followed by the
+// sealed data key.
+const (
+	KeyWrapX25519 = "ECDH-ES-X25519-HKDF-SHA256"
+	KeyWrapP256   = "ECDH-ES-P256-HKDF-SHA256"
+)
+
+// keyWrapLabel is the RSA-OAEP label bound into every wrapped key.
+var keyWrapLabel = []byte("secure_packager")
+
+// KeyWrapper wraps data keys for one recipient.
+type KeyWrapper interface {
+	// Algorithm is the key_wrap identifier recorded in the manifest.
+	Algorithm() string
+	// KeyID is the KeyFingerprint of the recipient's public key.
+	KeyID() string
+	WrapKey(key []byte) ([]byte, error)
+}
+
+// KeyUnwrapper recovers data keys wrapped for one private key. Implementations
+// need not hold the key themselves.
+type KeyUnwrapper interface {
+	Algorithm() string
+	KeyID() string
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// NewKeyWrapper returns the KeyWrapper for an RSA, X25519, P-256 or hybrid
+// ML-KEM-768 + X25519 public key.
+func NewKeyWrapper(pub crypto.PublicKey) (KeyWrapper, error) {
+	kid, err := KeyFingerprint(pub)
+	if err != nil {
+		return nil, err
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsaWrapper{pub, kid}, nil
+	case *ecdsa.PublicKey:
+		epub, err := pub.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		return NewKeyWrapper(epub)
+	case *ecdh.PublicKey:
+		alg, err := ecdhAlgorithm(pub.Curve())
+		if err != nil {
+			return nil, err
+		}
+		return ecdhWrapper{pub, alg, kid}, nil
+	case *HybridPublicKey:
+		return hybridWrapper{pub}, nil
+	}
+	return nil, fmt.Errorf("unsupported recipient key type %T", pub)
+}
+
+// NewKeyUnwrapper returns the KeyUnwrapper for an RSA, X25519, P-256 or
+// hybrid ML-KEM-768 + X25519 private key.
+func NewKeyUnwrapper(priv crypto.PrivateKey) (KeyUnwrapper, error) {
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		kid, err := KeyFingerprint(&priv.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return rsaUnwrapper{priv, kid}, nil
+	case *ecdsa.PrivateKey:
+		epriv, err := priv.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		return NewKeyUnwrapper(epriv)
+	case *ecdh.PrivateKey:
+		alg, err := ecdhAlgorithm(priv.Curve())
+		if err != nil {
+			return nil, err
+		}
+		kid, err := KeyFingerprint(priv.PublicKey())
+		if err != nil {
+			return nil, err
+		}
+		return ecdhUnwrapper{priv, alg, kid}, nil
+	case *HybridPrivateKey:
+		return hybridUnwrapper{priv, priv.Public().fingerprint()}, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", priv)
+}
+
+// WrapKey encrypts the base64 encoded Fernet key with RSA-OAEP SHA-256 for pub.
+func WrapKey(pub *rsa.PublicKey, key *fernet.Key) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, []byte(key.Encode()), keyWrapLabel)
+}
+
+// UnwrapKey reverses WrapKey using the customer's private key.
+func UnwrapKey(priv *rsa.PrivateKey, wrapped []byte) (*fernet.Key, error) {
+	raw, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, wrapped, keyWrapLabel)
+	if err != nil {
+		return nil, err
+	}
+	// raw holds the base64-url encoded fernet key string
+	k, err := fernet.DecodeKey(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode fernet key: %w", err)
+	}
+	return k, nil
+}
+
+type rsaWrapper struct {
+	pub *rsa.PublicKey
+	kid string
+}
+
+func (w rsaWrapper) Algorithm() string { return KeyWrapRSAOAEP }
+func (w rsaWrapper) KeyID() string     { return w.kid }
+
+// WrapKey wraps the base64 encoding of key, as WrapKey always has.
+func (w rsaWrapper) WrapKey(key []byte) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, w.pub, []byte(base64.URLEncoding.EncodeToString(key)), keyWrapLabel)
+}
+
+type rsaUnwrapper struct {
+	priv *rsa.PrivateKey
+	kid  string
+}
+
+func (u rsaUnwrapper) Algorithm() string { return KeyWrapRSAOAEP }
+func (u rsaUnwrapper) KeyID() string     { return u.kid }
+
+func (u rsaUnwrapper) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	k, err := UnwrapKey(u.priv, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return k[:], nil
+}
+
+func ecdhAlgorithm(c ecdh.Curve) (string, error) {
+	switch c {
+	case ecdh.X25519():
+		return KeyWrapX25519, nil
+	case ecdh.P256():
+		return KeyWrapP256, nil
+	}
+	return "", fmt.Errorf("unsupported curve %v", c)
+}
+
+type ecdhWrapper struct {
+	pub      *ecdh.PublicKey
+	alg, kid string
+}
+
+func (w ecdhWrapper) Algorithm() string { return w.alg }
+func (w ecdhWrapper) KeyID() string     { return w.kid }
+
+func (w ecdhWrapper) WrapKey(key []byte) ([]byte, error) {
+	eph, err := w.pub.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(w.pub)
+	if err != nil {
+		return nil, err
+	}
+	epk := eph.PublicKey().Bytes()
+	aead, err := ecdhKEK(w.alg, shared, epk, w.pub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(epk, make([]byte, aead.NonceSize()), key, []byte(w.alg)), nil
+}
+
+type ecdhUnwrapper struct {
+	priv     *ecdh.PrivateKey
+	alg, kid string
+}
+
+func (u ecdhUnwrapper) Algorithm() string { return u.alg }
+func (u ecdhUnwrapper) KeyID() string     { return u.kid }
+
+func (u ecdhUnwrapper) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	n := len(u.priv.PublicKey().Bytes())
+	if len(wrapped) < n {
+		return nil, errors.New("wrapped key too short")
+	}
+	eph, err := u.priv.Curve().NewPublicKey(wrapped[:n])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	shared, err := u.priv.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := ecdhKEK(u.alg, shared, wrapped[:n], u.priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), wrapped[n:], []byte(u.alg))
+}
+
+// ecdhKEK derives the key encryption key from the agreed secret, salted with
+// both public keys.
+func ecdhKEK(alg string, shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte(nil), ephemeral...), recipient...)
+	return deriveKEK(alg, shared, salt)
+}
+
+// deriveKEK derives an AES-256-GCM key encryption key with HKDF-SHA256, using
+// the algorithm name as context. Every wrap uses fresh ephemeral secrets, so
+// the key encryption key seals exactly one message and a zero nonce is safe.
+func deriveKEK(alg string, secret, salt []byte) (cipher.AEAD, error) {
+	kek, err := hkdf.Key(sha256.New, secret, salt, "secure_packager "+alg, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}